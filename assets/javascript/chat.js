@@ -2,6 +2,23 @@ var msg = document.getElementById("msg");
 var log = document.getElementById("log");
 
 var slideOpen = false;
+var lastMessageId = "";
+var lastDirectId = "";
+var directTarget = null;
+var replyTarget = null;
+var seenMessages = {};
+var messageItems = {};
+var typingUsers = {};
+var typingTimer = null;
+var lastReadSent = "";
+var me = null;
+var messageReactions = {};
+var participants = {};
+var unlisted = 0;
+var pinnedIds = {};
+var myVotes = {};
+var chatWs = null;
+var chatChannel = null;
 
 function slideToggle() {
   var chat = document.getElementById("chat-content");
@@ -13,9 +30,112 @@ function slideToggle() {
     document.getElementById("chat-alert").style.display = "none";
     document.getElementById("msg").focus();
     slideOpen = true;
+    markRead();
   }
 }
 
+// chatSend sends a frame over the DataChannel when it is open, over the websocket otherwise
+function chatSend(data) {
+  if (chatChannel && chatChannel.readyState === "open") {
+    chatChannel.send(data);
+    return true;
+  }
+  if (chatWs && chatWs.readyState === WebSocket.OPEN) {
+    chatWs.send(data);
+    return true;
+  }
+  return false;
+}
+
+// sendEvent sends an ephemeral event if the chat is connected
+function sendEvent(event) {
+  event.v = 1;
+  chatSend(JSON.stringify(event));
+}
+
+// markRead tells the room we have read everything shown in the open chat
+function markRead() {
+  if (slideOpen && lastMessageId && lastMessageId !== lastReadSent) {
+    lastReadSent = lastMessageId;
+    sendEvent({ kind: "read", ref: lastMessageId });
+  }
+}
+
+// stopTyping clears our typing indicator for the other participants
+function stopTyping() {
+  if (typingTimer) {
+    clearTimeout(typingTimer);
+    typingTimer = null;
+    sendEvent({ kind: "typing_stop" });
+  }
+}
+
+function renderTyping() {
+  var names = Object.keys(typingUsers).map(function (id) {
+    return typingUsers[id];
+  });
+  var typing = document.getElementById("typing");
+  if (names.length === 0) {
+    typing.innerText = "";
+  } else if (names.length === 1) {
+    typing.innerText = names[0] + " is typing...";
+  } else {
+    typing.innerText = names.join(", ") + " are typing...";
+  }
+}
+
+// receivePresence applies a roster snapshot or event, it reports whether the message was one
+function receivePresence(message) {
+  switch (message.kind) {
+    case "presence":
+      participants = {};
+      (message.participants || []).forEach(function (p) {
+        participants[p.id] = p;
+      });
+      // A crowded room only lists part of its audience
+      unlisted = Math.max((message.count || 0) - Object.keys(participants).length, 0);
+      break;
+    case "join":
+    case "presence_update":
+      message.participants.forEach(function (p) {
+        participants[p.id] = p;
+      });
+      break;
+    case "leave":
+      message.participants.forEach(function (p) {
+        delete participants[p.id];
+      });
+      break;
+    default:
+      return false;
+  }
+  renderRoster();
+  return true;
+}
+
+function renderRoster() {
+  var names = Object.keys(participants)
+    .map(function (id) {
+      return participants[id];
+    })
+    .sort(function (a, b) {
+      return a.joined_at < b.joined_at ? -1 : 1;
+    })
+    .map(function (p) {
+      var name = p.name;
+      if (p.role === "host") {
+        name += " (host)";
+      } else if (p.role === "viewer") {
+        name += " (viewer)";
+      }
+      return name;
+    });
+  if (unlisted > 0) {
+    names.push("and " + unlisted + " more");
+  }
+  document.getElementById("roster").innerText = names.length ? "Here: " + names.join(", ") : "";
+}
+
 function appendLog(item) {
   var doScroll = log.scrollTop > log.scrollHeight - log.clientHeight - 1;
   log.appendChild(item);
@@ -24,8 +144,7 @@ function appendLog(item) {
   }
 }
 
-function currentTime() {
-  var date = new Date();
+function formatTime(date) {
   hour = date.getHours();
   minute = date.getMinutes();
   if (hour < 10) {
@@ -38,40 +157,448 @@ function currentTime() {
 }
 
 document.getElementById("form").onsubmit = function () {
-  if (!chatWs) {
+  if (!msg.value) {
     return false;
   }
-  if (!msg.value) {
+  var sent;
+  if (directTarget) {
+    sent = chatSend(JSON.stringify({ v: 1, kind: "direct", to: [directTarget.id], body: msg.value }));
+  } else if (replyTarget) {
+    sent = chatSend(JSON.stringify({ v: 1, kind: "text", parent: replyTarget.id, body: msg.value }));
+  } else {
+    sent = chatSend(JSON.stringify({ v: 1, kind: "text", body: msg.value }));
+  }
+  if (!sent) {
     return false;
   }
-  chatWs.send(msg.value);
   msg.value = "";
+  setReplyTarget(null);
+  stopTyping();
   return false;
 };
 
+msg.oninput = function () {
+  if (!typingTimer) {
+    sendEvent({ kind: "typing" });
+  } else {
+    clearTimeout(typingTimer);
+  }
+  typingTimer = setTimeout(stopTyping, 3000);
+};
+
+// setDirectTarget switches the input between the room and a private conversation
+function setDirectTarget(target) {
+  directTarget = target;
+  replyTarget = null;
+  msg.placeholder = target ? "private message to " + target.name + " (Esc to cancel)" : "type message...";
+  msg.focus();
+}
+
+// setReplyTarget makes the next message a reply in the thread of the given message
+function setReplyTarget(message) {
+  if (!message && !replyTarget) {
+    return;
+  }
+  replyTarget = message;
+  directTarget = null;
+  msg.placeholder = message ? "reply to " + message.display_name + " (Esc to cancel)" : "type message...";
+  msg.focus();
+}
+
+msg.onkeydown = function (evt) {
+  if (evt.key === "Escape") {
+    setDirectTarget(null);
+  }
+};
+
+function chatAddr() {
+  return ChatWebsocketAddr + chatQuery();
+}
+
+// chatQuery returns the parameters a chat connection identifies and resumes with
+function chatQuery() {
+  var addr = "?v=1";
+  var name = localStorage.getItem("chat-name");
+  if (name) {
+    addr += "&name=" + encodeURIComponent(name);
+  }
+  if (lastMessageId) {
+    // Resume after the last message we saw so nothing is lost across reconnects
+    addr += "&after=" + encodeURIComponent(lastMessageId);
+  }
+  if (lastDirectId) {
+    addr += "&after_direct=" + encodeURIComponent(lastDirectId);
+  }
+  return addr;
+}
+
+// setBody shows a message after its prefix, using the HTML the server rendered from its Markdown
+function setBody(el, prefix, message) {
+  el.textContent = prefix;
+  var body = document.createElement("span");
+  if (message.html) {
+    // The server escapes everything outside bold, italics, code, links and mentions
+    body.innerHTML = message.html;
+  } else {
+    body.textContent = message.body;
+  }
+  el.appendChild(body);
+}
+
+function renderMessage(message) {
+  var item = document.createElement("div");
+  var text = document.createElement("span");
+  text.className = "text";
+  item.appendChild(text);
+  var time = formatTime(new Date(message.ts));
+  // The prefix is kept so edits and deletions can rewrite the text after it
+  var prefix = time + " - " + message.display_name + ": ";
+  var reply = message.parent ? "\u21B3 " : "";
+  if (message.parent) {
+    item.classList.add("reply");
+  }
+  if (message.kind === "system" || message.kind === "warning" || message.kind === "rejected") {
+    item.className = message.kind;
+    prefix = time + " - ";
+    text.innerText = prefix + message.body;
+  } else if (message.kind === "direct") {
+    item.className = "direct";
+    prefix = time + " - (private) " + message.display_name + ": ";
+    text.innerText = prefix + (message.deleted ? "message deleted" : message.body);
+  } else if (message.kind === "action" && !message.deleted) {
+    item.classList.add("action");
+    prefix = time + " - " + reply + "* " + message.display_name + " ";
+    setBody(text, prefix, message);
+  } else if (message.kind === "poll" && !message.deleted) {
+    item.classList.add("poll");
+    prefix = time + " - " + message.display_name + " asks: ";
+    setBody(text, prefix, message);
+    item.appendChild(renderPoll(message));
+  } else if (message.deleted) {
+    item.classList.add("deleted");
+    prefix = time + " - " + reply + message.display_name + ": ";
+    text.innerText = prefix + "message deleted";
+  } else {
+    prefix = time + " - " + reply + message.display_name + ": ";
+    setBody(text, prefix, message);
+  }
+  item.dataset.prefix = prefix;
+  item.dataset.sender = message.sender_id || "";
+  if (message.attachments && !message.deleted) {
+    message.attachments.forEach(function (attachment) {
+      item.appendChild(renderAttachment(attachment));
+    });
+  }
+  if (message.edited_at && !message.deleted) {
+    text.appendChild(document.createTextNode(" (edited)"));
+  }
+  if (message.id) {
+    messageItems[message.id] = item;
+  }
+  if (message.id && !message.deleted && message.kind !== "system") {
+    var reactions = document.createElement("span");
+    reactions.className = "reactions";
+    item.appendChild(reactions);
+    messageReactions[message.id] = {};
+    Object.keys(message.reactions || {}).forEach(function (emoji) {
+      var users = message.reactions[emoji];
+      messageReactions[message.id][emoji] = {
+        count: users.length,
+        mine: me !== null && users.indexOf(me.id) >= 0,
+      };
+    });
+    renderReactions(message.id);
+  }
+  if (message.id && !message.deleted && (message.kind === "text" || message.kind === "action")) {
+    item.appendChild(threadActions(message));
+  }
+  if (message.id && me && !message.deleted && (message.sender_id === me.id || me.role === "host")) {
+    item.appendChild(messageActions(message));
+  }
+  if (message.sender_id) {
+    // Clicking a message starts a private conversation with its author
+    item.onclick = function () {
+      setDirectTarget({ id: message.sender_id, name: message.display_name });
+    };
+  }
+  return item;
+}
+
+// attachmentUrl returns the download address of an attachment of this room or stream
+function attachmentUrl(id) {
+  return location.pathname.replace(/\/$/, "") + "/chat/attachments/" + encodeURIComponent(id);
+}
+
+function renderAttachment(attachment) {
+  var link = document.createElement("a");
+  link.href = attachmentUrl(attachment.id);
+  link.target = "_blank";
+  link.rel = "noopener";
+  if (attachment.type.indexOf("image/") === 0) {
+    var image = document.createElement("img");
+    image.src = link.href;
+    image.alt = attachment.name;
+    image.className = "attachment";
+    link.appendChild(image);
+  } else {
+    link.innerText = " [" + attachment.name + "]";
+  }
+  return link;
+}
+
+document.getElementById("chat-file").onchange = function (evt) {
+  var file = evt.target.files[0];
+  evt.target.value = "";
+  if (!file) {
+    return;
+  }
+  var form = new FormData();
+  form.append("file", file);
+  fetch(location.pathname.replace(/\/$/, "") + "/chat/attachments", { method: "POST", body: form })
+    .then(function (response) {
+      if (!response.ok) {
+        return response.text().then(function (text) {
+          throw new Error(text);
+        });
+      }
+      return response.json();
+    })
+    .then(function (attachment) {
+      var message = { kind: "text", body: msg.value, attachments: [{ id: attachment.id }] };
+      if (directTarget) {
+        message.kind = "direct";
+        message.to = [directTarget.id];
+      }
+      sendEvent(message);
+      msg.value = "";
+    })
+    .catch(function (err) {
+      alert("Upload failed: " + err.message);
+    });
+};
+
+// renderReactions draws the reaction counts of a message, clicking one toggles our own reaction
+function renderReactions(id) {
+  var item = messageItems[id];
+  var reactions = item && item.querySelector(".reactions");
+  if (!reactions) {
+    return;
+  }
+  reactions.innerHTML = "";
+  var state = messageReactions[id];
+  Object.keys(state).forEach(function (emoji) {
+    var chip = document.createElement("a");
+    chip.className = state[emoji].mine ? "reaction mine" : "reaction";
+    chip.innerText = " " + emoji + " " + state[emoji].count;
+    chip.onclick = function (evt) {
+      evt.stopPropagation();
+      sendEvent({ kind: state[emoji].mine ? "unreact" : "react", ref: id, body: emoji });
+    };
+    reactions.appendChild(chip);
+  });
+  if (!state["\uD83D\uDC4D"]) {
+    var like = document.createElement("a");
+    like.className = "reaction";
+    like.innerText = " +\uD83D\uDC4D";
+    like.onclick = function (evt) {
+      evt.stopPropagation();
+      sendEvent({ kind: "react", ref: id, body: "\uD83D\uDC4D" });
+    };
+    reactions.appendChild(like);
+  }
+}
+
+// renderPoll draws the options of a poll with their tallies, clicking an open option votes for it
+function renderPoll(message) {
+  var poll = message.poll;
+  var box = document.createElement("div");
+  box.className = poll.closed ? "options closed" : "options";
+  if (!myVotes[message.id]) {
+    // Named polls tell us our own vote, for anonymous ones we remember what we sent
+    myVotes[message.id] = [];
+    poll.options.forEach(function (option, i) {
+      if (me && (option.voters || []).indexOf(me.id) >= 0) {
+        myVotes[message.id].push(i);
+      }
+    });
+  }
+  var total = poll.options.reduce(function (sum, option) {
+    return sum + option.count;
+  }, 0);
+  poll.options.forEach(function (option, i) {
+    var row = document.createElement("a");
+    var mine = myVotes[message.id].indexOf(i) >= 0;
+    row.className = mine ? "option mine" : "option";
+    var percent = total ? Math.round((option.count * 100) / total) : 0;
+    row.innerText = option.text + " - " + option.count + " (" + percent + "%)";
+    if (option.voters && option.voters.length) {
+      row.title = option.voters
+        .map(function (id) {
+          return participants[id] ? participants[id].name : id;
+        })
+        .join(", ");
+    }
+    if (!poll.closed) {
+      row.onclick = function (evt) {
+        evt.stopPropagation();
+        var choices = myVotes[message.id].slice();
+        if (mine) {
+          choices.splice(choices.indexOf(i), 1);
+        } else if (poll.multiple) {
+          choices.push(i);
+        } else {
+          choices = [i];
+        }
+        myVotes[message.id] = choices;
+        sendEvent({ kind: "vote", ref: message.id, choices: choices });
+      };
+    }
+    box.appendChild(row);
+  });
+  var status = document.createElement("span");
+  status.className = "status";
+  if (poll.closed) {
+    status.innerText = "Final results";
+  } else if (poll.closes_at) {
+    status.innerText = "Closes at " + formatTime(new Date(poll.closes_at));
+  }
+  if (poll.anonymous) {
+    status.innerText += (status.innerText ? ", " : "") + "anonymous";
+  }
+  box.appendChild(status);
+  if (!poll.closed && me && (message.sender_id === me.id || me.role === "host")) {
+    var end = document.createElement("a");
+    end.innerText = " close poll";
+    end.onclick = function (evt) {
+      evt.stopPropagation();
+      sendEvent({ kind: "poll_close", ref: message.id });
+    };
+    box.appendChild(end);
+  }
+  return box;
+}
+
+// updatePoll redraws the tallies of a poll shown in the log
+function updatePoll(message) {
+  var item = messageItems[message.ref];
+  var options = item && item.querySelector(".options");
+  if (!options) {
+    return;
+  }
+  var poll = { id: message.ref, poll: message.poll, sender_id: item.dataset.sender };
+  options.replaceWith(renderPoll(poll));
+}
+
+// threadActions builds the reply button of a message and the link loading its thread
+function threadActions(message) {
+  var actions = document.createElement("span");
+  actions.className = "actions";
+  var reply = document.createElement("a");
+  reply.innerText = " reply";
+  reply.onclick = function (evt) {
+    evt.stopPropagation();
+    setReplyTarget(message);
+  };
+  actions.appendChild(reply);
+  if (message.replies) {
+    var thread = document.createElement("a");
+    thread.innerText = " " + message.replies + (message.replies === 1 ? " reply" : " replies");
+    thread.onclick = function (evt) {
+      evt.stopPropagation();
+      sendEvent({ kind: "thread", ref: message.id });
+    };
+    actions.appendChild(thread);
+  }
+  return actions;
+}
+
+// messageActions builds the edit and delete buttons of a message
+function messageActions(message) {
+  var actions = document.createElement("span");
+  actions.className = "actions";
+  var edit = document.createElement("a");
+  edit.innerText = " edit";
+  edit.onclick = function (evt) {
+    evt.stopPropagation();
+    var body = prompt("Edit message", message.body);
+    if (body) {
+      sendEvent({ kind: "edit", ref: message.id, body: body });
+    }
+  };
+  var remove = document.createElement("a");
+  remove.innerText = " delete";
+  remove.onclick = function (evt) {
+    evt.stopPropagation();
+    sendEvent({ kind: "delete", ref: message.id });
+  };
+  if (message.sender_id === me.id) {
+    actions.appendChild(edit);
+  }
+  actions.appendChild(remove);
+  if (me.role === "host" && message.kind !== "direct") {
+    var pin = document.createElement("a");
+    pin.innerText = " pin";
+    pin.onclick = function (evt) {
+      evt.stopPropagation();
+      sendEvent({ kind: pinnedIds[message.id] ? "unpin" : "pin", ref: message.id });
+    };
+    actions.appendChild(pin);
+  }
+  return actions;
+}
+
+// describePolicy lists the chat modes a host switched on
+function describePolicy(policy) {
+  var modes = [];
+  if (policy.slow_mode) {
+    modes.push("slow mode (" + policy.slow_mode + "s)");
+  }
+  if (policy.followers_only) {
+    modes.push(policy.follower_age ? "followers-only (" + Math.round(policy.follower_age / 60) + "m)" : "followers-only");
+  }
+  if (policy.emote_only) {
+    modes.push("emote-only");
+  }
+  return modes.length ? "Chat modes: " + modes.join(", ") : "";
+}
+
+// renderRoomState shows the topic and the pinned messages above the chat log
+function renderRoomState(state) {
+  var topic = document.getElementById("topic");
+  topic.innerText = state.body ? "Topic: " + state.body : "";
+  document.getElementById("modes").innerText = describePolicy(state.policy || {});
+  var pinned = document.getElementById("pinned");
+  pinned.innerHTML = "";
+  pinnedIds = {};
+  (state.pinned || []).forEach(function (message) {
+    pinnedIds[message.id] = true;
+    var item = document.createElement("div");
+    setBody(item, "\uD83D\uDCCC " + message.display_name + ": ", message);
+    pinned.appendChild(item);
+  });
+}
+
 function connectChat() {
-  chatWs = new WebSocket(ChatWebsocketAddr);
+  if (chatChannel) {
+    return;
+  }
+  chatWs = new WebSocket(chatAddr());
 
   chatWs.onclose = function (evt) {
     console.log("websocket has closed");
+    if (chatChannel) {
+      // Chat moved to the DataChannel of the peer connection
+      return;
+    }
     document.getElementById("chat-button").disabled = true;
+    // Back off when the server closed us for a policy violation or closed the room
+    var delay = evt.code === 1008 || evt.code === 1001 ? 30000 : 1000;
     setTimeout(function () {
       connectChat();
-    }, 1000);
+    }, delay);
   };
 
-  chatWs.onmessage = function (evt) {
-    var messages = evt.data.split("\n");
-    if (slideOpen == false) {
-      document.getElementById("chat-alert").style.display = "block";
-    }
-    for (var i = 0; i < messages.length; i++) {
-      var item = document.createElement("div");
-
-      item.innerText = currentTime() + " - " + messages[i];
-      appendLog(item);
-    }
-  };
+  chatWs.onmessage = receiveChat;
 
   chatWs.onerror = function (evt) {
     console.log("error: " + evt.data);
@@ -84,4 +611,195 @@ function connectChat() {
   }, 1000);
 }
 
+// useChatChannel moves the chat to a DataChannel of the peer connection once it opens.
+// The websocket is used again if the channel closes.
+function useChatChannel(channel) {
+  channel.onmessage = receiveChat;
+  channel.onopen = function () {
+    chatChannel = channel;
+    document.getElementById("chat-button").disabled = false;
+    if (chatWs) {
+      chatWs.close();
+    }
+  };
+  channel.onclose = function () {
+    if (chatChannel !== channel) {
+      return;
+    }
+    chatChannel = null;
+    connectChat();
+  };
+}
+
+// renderQA shows the question queue apart from the chat log, with upvotes and the host's decisions
+function renderQA(state) {
+  var qa = document.getElementById("qa");
+  qa.innerHTML = "";
+  var host = me && me.role === "host";
+  var questions = state.questions || [];
+  if (state.body !== "open" && questions.length === 0 && !host) {
+    return;
+  }
+  var header = document.createElement("div");
+  header.className = "header";
+  header.innerText = state.body === "open" ? "Q&A" : "Q&A (closed)";
+  if (state.body === "open") {
+    header.appendChild(qaAction(" ask", function () {
+      var body = prompt("Your question");
+      if (body) {
+        sendEvent({ kind: "question", body: body });
+      }
+    }));
+  }
+  if (host) {
+    var toggle = state.body === "open" ? "close" : "open";
+    header.appendChild(qaAction(" " + toggle, function () {
+      sendEvent({ kind: "qa", body: toggle });
+    }));
+  }
+  qa.appendChild(header);
+  questions.forEach(function (question) {
+    var item = document.createElement("div");
+    item.className = "question " + question.status;
+    var voters = question.voters || [];
+    setBody(item, voters.length + " \u25B2 " + question.display_name + ": ", question);
+    if (question.status !== "approved") {
+      item.appendChild(document.createTextNode(" (" + question.status + ")"));
+    }
+    if (question.status === "approved") {
+      var voted = me && voters.indexOf(me.id) >= 0;
+      item.appendChild(qaAction(voted ? " unvote" : " upvote", function () {
+        sendEvent({ kind: voted ? "unvote" : "upvote", ref: question.id });
+      }));
+    }
+    if (host) {
+      ["approve", "answer", "dismiss"].forEach(function (kind) {
+        if (question.status !== kind + (kind === "dismiss" ? "ed" : "d")) {
+          item.appendChild(qaAction(" " + kind, function () {
+            sendEvent({ kind: kind, ref: question.id });
+          }));
+        }
+      });
+    }
+    qa.appendChild(item);
+  });
+}
+
+// qaAction builds a link of the Q&A panel
+function qaAction(label, action) {
+  var link = document.createElement("a");
+  link.innerText = label;
+  link.onclick = function (evt) {
+    evt.stopPropagation();
+    action();
+  };
+  return link;
+}
+
+// receiveChat handles a chat frame from the websocket or the DataChannel
+function receiveChat(evt) {
+  var message;
+  try {
+    message = JSON.parse(evt.data);
+  } catch (e) {
+    console.log("invalid chat message: " + evt.data);
+    return;
+  }
+  if (receivePresence(message)) {
+    return;
+  }
+  if (message.kind === "room_state") {
+    renderRoomState(message);
+    return;
+  }
+  if (message.kind === "qa_state") {
+    renderQA(message);
+    return;
+  }
+  if (message.kind === "welcome") {
+    me = { id: message.sender_id, name: message.display_name, role: message.role };
+    return;
+  }
+  if (message.kind === "edit") {
+    var edited = messageItems[message.ref];
+    if (edited) {
+      var editedText = edited.querySelector(".text");
+      setBody(editedText, edited.dataset.prefix, message);
+      editedText.appendChild(document.createTextNode(" (edited)"));
+    }
+    return;
+  }
+  if (message.kind === "react" || message.kind === "unreact") {
+    var state = messageReactions[message.ref];
+    if (state) {
+      if (message.count) {
+        var mine = state[message.body] ? state[message.body].mine : false;
+        if (me && message.sender_id === me.id) {
+          mine = message.kind === "react";
+        }
+        state[message.body] = { count: message.count, mine: mine };
+      } else {
+        delete state[message.body];
+      }
+      renderReactions(message.ref);
+    }
+    return;
+  }
+  if (message.kind === "poll_update" || message.kind === "poll_closed") {
+    updatePoll(message);
+    return;
+  }
+  if (message.kind === "typing") {
+    typingUsers[message.sender_id] = message.display_name;
+    renderTyping();
+    return;
+  }
+  if (message.kind === "typing_stop") {
+    delete typingUsers[message.sender_id];
+    renderTyping();
+    return;
+  }
+  if (message.kind === "read") {
+    return;
+  }
+  if (message.kind === "read_state") {
+    if (message.count > 0) {
+      document.getElementById("chat-alert").style.display = "block";
+    }
+    return;
+  }
+  if (message.kind === "delete") {
+    // Replace the deleted message by a tombstone
+    var deleted = messageItems[message.ref];
+    if (deleted) {
+      deleted.className = "deleted";
+      deleted.innerHTML = "";
+      var tombstone = document.createElement("span");
+      tombstone.innerText = deleted.dataset.prefix + "message deleted";
+      deleted.appendChild(tombstone);
+    }
+    return;
+  }
+  if (message.id) {
+    if (seenMessages[message.id]) {
+      return;
+    }
+    seenMessages[message.id] = true;
+    if (message.kind === "direct") {
+      lastDirectId = message.id;
+    } else {
+      lastMessageId = message.id;
+    }
+  }
+  if (slideOpen == false) {
+    document.getElementById("chat-alert").style.display = "block";
+  }
+  appendLog(renderMessage(message));
+  if (message.sender_id) {
+    delete typingUsers[message.sender_id];
+    renderTyping();
+  }
+  markRead();
+}
+
 connectChat();
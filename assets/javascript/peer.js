@@ -79,6 +79,7 @@ function connect(stream) {
     document.getElementById("noone").style.display = "none";
     document.getElementById("nocon").style.display = "none";
     document.getElementById("videos").appendChild(col);
+    sendTiles();
 
     event.track.onmute = function (event) {
       el.play();
@@ -87,6 +88,7 @@ function connect(stream) {
     event.streams[0].onremovetrack = ({ track }) => {
       if (el.parentNode) {
         el.parentNode.remove();
+        sendTiles();
       }
       if (document.getElementById("videos").childElementCount <= 3) {
         document.getElementById("noone").style.display = "grid";
@@ -95,9 +97,52 @@ function connect(stream) {
     };
   };
 
-  stream.getTracks().forEach((track) => pc.addTrack(track, stream));
+  // Publish the video in three simulcast layers, the server sends every peer the one that suits it
+  stream.getAudioTracks().forEach((track) => pc.addTrack(track, stream));
+  stream.getVideoTracks().forEach((track) =>
+    pc.addTransceiver(track, {
+      direction: "sendrecv",
+      streams: [stream],
+      sendEncodings: [
+        { rid: "q", scaleResolutionDownBy: 4, maxBitrate: 150000 },
+        { rid: "h", scaleResolutionDownBy: 2, maxBitrate: 500000 },
+        { rid: "f", maxBitrate: 1500000 },
+      ],
+    })
+  );
+
+  // Chat runs over a DataChannel negotiated with the same id on the server
+  useChatChannel(pc.createDataChannel("chat", { negotiated: true, id: 0 }));
+
+  let ws = new WebSocket(RoomWebsocketAddr + chatQuery());
+
+  // Tell the server how many videos we show, the more there are the smaller the layers we get
+  function sendTiles() {
+    if (ws.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    ws.send(
+      JSON.stringify({
+        event: "tiles",
+        data: String(document.querySelectorAll("#videos .peer video:not(#localVideo)").length),
+      })
+    );
+  }
 
-  let ws = new WebSocket(RoomWebsocketAddr);
+  // We offer first, the server can only receive simulcast layers it has been offered
+  ws.onopen = function () {
+    pc.createOffer()
+      .then((offer) => pc.setLocalDescription(offer))
+      .then(() => {
+        ws.send(
+          JSON.stringify({
+            event: "offer",
+            data: JSON.stringify(pc.localDescription),
+          })
+        );
+        sendTiles();
+      });
+  };
   pc.onicecandidate = (e) => {
     if (!e.candidate) {
       return;
@@ -142,6 +187,10 @@ function connect(stream) {
         if (!offer) {
           return console.log("failed to parse answer");
         }
+        // Our own offer wins a collision, the server rolls its offer back and sends it again
+        if (pc.signalingState !== "stable") {
+          return console.log("ignoring an offer while ours is pending");
+        }
         pc.setRemoteDescription(offer);
         pc.createAnswer().then((answer) => {
           pc.setLocalDescription(answer);
@@ -154,6 +203,14 @@ function connect(stream) {
         });
         return;
 
+      case "answer":
+        let answer = JSON.parse(msg.data);
+        if (!answer) {
+          return console.log("failed to parse answer");
+        }
+        pc.setRemoteDescription(answer);
+        return;
+
       case "candidate":
         let candidate = JSON.parse(msg.data);
         if (!candidate) {
@@ -161,6 +218,14 @@ function connect(stream) {
         }
 
         pc.addIceCandidate(candidate);
+        return;
+
+      case "presence":
+        receivePresence(JSON.parse(msg.data));
+        return;
+
+      case "close":
+        console.log("room closed: " + msg.data);
     }
   };
 
@@ -40,6 +40,7 @@ function connectStream() {
     document.getElementById("noonestream").style.display = "none";
     document.getElementById("nocon").style.display = "none";
     document.getElementById("videos").appendChild(col);
+    sendTiles();
 
     event.track.onmute = function (event) {
       el.play();
@@ -48,6 +49,7 @@ function connectStream() {
     event.streams[0].onremovetrack = ({ track }) => {
       if (el.parentNode) {
         el.parentNode.remove();
+        sendTiles();
       }
       if (document.getElementById("videos").childElementCount <= 2) {
         document.getElementById("noonestream").style.display = "flex";
@@ -56,6 +58,19 @@ function connectStream() {
   };
 
   let ws = new WebSocket(StreamWebsocketAddr);
+
+  // Tell the server how many videos we show, the more there are the smaller the layers we get
+  function sendTiles() {
+    if (ws.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    ws.send(
+      JSON.stringify({
+        event: "tiles",
+        data: String(document.querySelectorAll("#videos .peer video").length),
+      })
+    );
+  }
   pc.onicecandidate = (e) => {
     if (!e.candidate) {
       return;
@@ -119,6 +134,10 @@ function connectStream() {
         }
 
         pc.addIceCandidate(candidate);
+        return;
+
+      case "close":
+        console.log("room closed: " + msg.data);
     }
   };
 
@@ -8,7 +8,10 @@ require (
 	github.com/gofiber/template/html/v2 v2.1.1
 	github.com/gofiber/websocket/v2 v2.2.1
 	github.com/google/uuid v1.6.0
+	github.com/pion/interceptor v0.1.25
 	github.com/pion/rtcp v1.2.13
+	github.com/pion/rtp v1.8.3
+	github.com/pion/sdp/v3 v3.0.6
 	github.com/pion/turn/v2 v2.1.5
 	github.com/pion/webrtc/v3 v3.2.28
 )
@@ -25,13 +28,10 @@ require (
 	github.com/pion/datachannel v1.5.5 // indirect
 	github.com/pion/dtls/v2 v2.2.10 // indirect
 	github.com/pion/ice/v2 v2.3.14 // indirect
-	github.com/pion/interceptor v0.1.25 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.12 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtp v1.8.3 // indirect
 	github.com/pion/sctp v1.8.12 // indirect
-	github.com/pion/sdp/v3 v3.0.6 // indirect
 	github.com/pion/srtp/v2 v2.0.18 // indirect
 	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/transport/v2 v2.2.4 // indirect
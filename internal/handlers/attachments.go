@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ChatUpload stores a file uploaded by a member of a room's chat
+func ChatUpload(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	id := chatID(c)
+	if !isChatMember(c, hub, id) {
+		return fiber.ErrForbidden
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "missing file")
+	}
+	file, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	attachment, err := hub.Upload(id, header.Filename, file)
+	switch {
+	case errors.Is(err, chat.ErrAttachmentsDisabled):
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	case errors.Is(err, chat.ErrAttachmentTooLarge):
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, chat.ErrAttachmentType):
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, err.Error())
+	case err != nil:
+		log.Println("error storing attachment:", err)
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(attachment)
+}
+
+// ChatAttachment sends an attachment to a member of the room it was uploaded to
+func ChatAttachment(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	if !isChatMember(c, hub, chatID(c)) {
+		return fiber.ErrForbidden
+	}
+
+	attachment, content, err := hub.Download(c.Params("id"))
+	if errors.Is(err, chat.ErrAttachmentNotFound) || errors.Is(err, chat.ErrAttachmentsDisabled) {
+		return fiber.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only images are shown inline, everything else is downloaded, and nothing is sniffed or scripted
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.Type, "image/") {
+		disposition = "inline"
+	}
+	c.Set(fiber.HeaderContentType, attachment.Type)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("%s; filename=%q", disposition, attachment.Name))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "sandbox")
+	return c.SendStream(content, int(attachment.Size))
+}
+
+// isChatMember reports whether a participant has joined the hub's chat and is not banned
+func isChatMember(c *fiber.Ctx, hub *chat.Hub, id string) bool {
+	return id != "" && hub.IsMember(id) && !hub.Banned(id, c.IP())
+}
@@ -1,13 +1,31 @@
 package handlers
 
 import (
+	"net"
+	"strconv"
+	"time"
+
 	"github.com/amitamrutiya/videocall-project/pkg/chat"
 	w "github.com/amitamrutiya/videocall-project/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 )
 
+// chatTokenCookie is the cookie holding the secret that identifies a chat participant
+const chatTokenCookie = "chat_token"
+
+// ChatConfig holds the settings used for every chat hub created by the handlers
+var ChatConfig = chat.DefaultConfig()
+
+// newHub creates a chat hub for a room and starts it
+func newHub(room string) *chat.Hub {
+	hub := chat.NewHub(room, ChatConfig)
+	go hub.Run()
+	return hub
+}
+
 // RoomChat renders the chat room view
 func RoomChat(c *fiber.Ctx) error {
 	return c.Render("chat", fiber.Map{}, "layouts/main")
@@ -22,9 +40,9 @@ func RoomChatWebsocket(c *websocket.Conn) {
 
 	// Lock rooms map to ensure concurrent safety
 	w.RoomsLock.Lock()
-	defer w.RoomsLock.Unlock()
-
 	room := w.Rooms[uuid]
+	w.RoomsLock.Unlock()
+
 	if room == nil {
 		return
 	}
@@ -32,8 +50,14 @@ func RoomChatWebsocket(c *websocket.Conn) {
 		return
 	}
 
+	// Refuse banned participants before they reach the hub
+	info := chatClientInfo(c, chat.RoleParticipant)
+	if rejectBanned(c, room.Hub, info) {
+		return
+	}
+
 	// Establish chat connection for the peer
-	chat.PeerChatConn(c.Conn, room.Hub)
+	chat.PeerChatConn(c.Conn, room.Hub, info)
 }
 
 // StreamChatWebsocket handles websocket connections for chat in a stream
@@ -45,19 +69,136 @@ func StreamChatWebsocket(c *websocket.Conn) {
 
 	// Lock rooms map to ensure concurrent safety
 	w.RoomsLock.Lock()
-	defer w.RoomsLock.Unlock()
 
 	// Check if stream exists, if not, return
-	if stream, ok := w.Streams[suuid]; ok {
-		if stream.Hub == nil {
-			// If hub is nil, create a new hub and start it
-			hub := chat.NewHub()
-			stream.Hub = hub
-			go hub.Run()
-		}
-
-		// Establish chat connection for the peer
-		chat.PeerChatConn(c.Conn, stream.Hub)
+	stream, ok := w.Streams[suuid]
+	if !ok {
+		w.RoomsLock.Unlock()
 		return
 	}
+	if stream.Hub == nil {
+		// If hub is nil, create a new hub and start it
+		stream.Hub = newHub(suuid)
+	}
+	hub := stream.Hub
+	w.RoomsLock.Unlock()
+
+	// Refuse banned participants before they reach the hub
+	info := chatClientInfo(c, chat.RoleViewer)
+	if rejectBanned(c, hub, info) {
+		return
+	}
+
+	// Establish chat connection for the peer
+	chat.PeerChatConn(c.Conn, hub, info)
+}
+
+// RoomChatAudit returns the moderation and flood protection log of a room's chat to its hosts
+func RoomChatAudit(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	if !hub.IsHost(chatID(c)) {
+		return fiber.ErrForbidden
+	}
+	return c.JSON(hub.AuditLog())
+}
+
+// ChatThread returns the root and the replies of a thread to the members of a room or stream chat
+func ChatThread(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	if !isChatMember(c, hub, chatID(c)) {
+		return fiber.ErrForbidden
+	}
+
+	thread, err := hub.Thread(c.Params("id"), chatID(c))
+	if err == chat.ErrMessageNotFound {
+		return fiber.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(thread)
+}
+
+// chatHub returns the chat hub addressed by a room or a stream route, nil if there is none
+func chatHub(c *fiber.Ctx) *chat.Hub {
+	w.RoomsLock.Lock()
+	defer w.RoomsLock.Unlock()
+
+	room := w.Rooms[c.Params("uuid")]
+	if suuid := c.Params("suuid"); suuid != "" {
+		room = w.Streams[suuid]
+	}
+	if room == nil {
+		return nil
+	}
+	return room.Hub
+}
+
+// chatID returns the participant id of the browser behind a request, empty if it has no chat token
+func chatID(c *fiber.Ctx) string {
+	token := c.Cookies(chatTokenCookie)
+	if token == "" {
+		return ""
+	}
+	return chat.ClientID(token)
+}
+
+// rejectBanned closes the connection of a banned participant and reports whether it did
+func rejectBanned(c *websocket.Conn, hub *chat.Hub, info chat.ClientInfo) bool {
+	if !hub.Banned(info.ID, info.IP) {
+		return false
+	}
+	c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "banned"))
+	return true
+}
+
+// chatClientInfo collects the identity a chat websocket connects with.
+// Browsers carry the token cookie, bots may pass it as a query parameter instead.
+func chatClientInfo(c *websocket.Conn, role chat.Role) chat.ClientInfo {
+	version, _ := strconv.Atoi(c.Query("v"))
+	return chat.ClientInfo{
+		ID:           chat.ClientID(c.Cookies(chatTokenCookie, c.Query("token"))),
+		Role:         role,
+		Name:         c.Query("name"),
+		Version:      version,
+		Cursor:       c.Query("after"),
+		DirectCursor: c.Query("after_direct"),
+		IP:           remoteIP(c),
+	}
+}
+
+// ensureChatToken makes sure the browser carries a chat token cookie and returns it
+func ensureChatToken(c *fiber.Ctx) string {
+	if token := c.Cookies(chatTokenCookie); token != "" {
+		return token
+	}
+
+	token := uuid.New().String()
+	c.Cookie(&fiber.Cookie{
+		Name:     chatTokenCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(365 * 24 * time.Hour),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return token
+}
+
+// remoteIP returns the address of the peer behind a websocket connection
+func remoteIP(c *websocket.Conn) string {
+	addr := c.Conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
 }
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ChatExport sends the chat transcript of a room or stream to its hosts
+func ChatExport(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	if !hub.IsHost(chatID(c)) {
+		return fiber.ErrForbidden
+	}
+
+	format := chat.TranscriptFormat(c.Query("format", string(chat.TranscriptJSON)))
+	switch format {
+	case chat.TranscriptJSON, chat.TranscriptMarkdown, chat.TranscriptText:
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "format must be json, md or txt")
+	}
+
+	transcript, err := hub.Transcript()
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, format.ContentType())
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="chat-%s.%s"`, hub.Room, format))
+	return transcript.Write(c, format)
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// ChatMetrics sends the fanout counters of a room or stream chat to its hosts
+func ChatMetrics(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	if !hub.IsHost(chatID(c)) {
+		return fiber.ErrForbidden
+	}
+	return c.JSON(hub.FanoutStats())
+}
@@ -14,7 +14,6 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
-	"github.com/pion/webrtc/v3"
 )
 
 // RoomCreate creates a new room and redirects to it
@@ -36,7 +35,9 @@ func Room(c *fiber.Ctx) error {
 		ws = "wss"
 	}
 
-	uuid, suuid, _ := createOrGetRoom(uuid) // Create or get existing room
+	token := ensureChatToken(c)                // Identify the participant in chat
+	uuid, suuid, room := createOrGetRoom(uuid) // Create or get existing room
+	room.Hub.ClaimHost(chat.ClientID(token))   // The first visitor of a room becomes its host
 	fmt.Println("host name", c.Protocol())
 	return c.Render("peer", fiber.Map{
 		"RoomWebsocketAddr":   fmt.Sprintf("%s://%s/room/%s/websocket", ws, c.Hostname(), uuid),
@@ -56,7 +57,11 @@ func RoomWebsocket(c *websocket.Conn) {
 	}
 
 	_, _, room := createOrGetRoom(uuid)
-	w.RoomConn(c, room.Peers)
+
+	// Chat and presence also run over the peer connection
+	info := chatClientInfo(c, chat.RoleParticipant)
+	info.Version = chat.ProtocolVersion
+	w.RoomConn(c, room.Peers, room.Hub, info)
 }
 
 // createOrGetRoom creates or retrieves an existing room
@@ -78,9 +83,9 @@ func createOrGetRoom(uuid string) (string, string, *w.Room) {
 	}
 
 	// Create a new chat hub and peers object for the room
-	hub := chat.NewHub()
+	hub := newHub(uuid)
 	p := &w.Peers{}
-	p.TrackLocals = make(map[string]*webrtc.TrackLocalStaticRTP)
+	p.TrackLocals = make(map[string]*w.Track)
 	room := &w.Room{
 		Peers: p,
 		Hub:   hub,
@@ -89,9 +94,6 @@ func createOrGetRoom(uuid string) (string, string, *w.Room) {
 	// Add the room to the rooms map and the streams map
 	w.Rooms[uuid] = room
 	w.Streams[suuid] = room
-
-	// Start the chat hub
-	go hub.Run()
 	return uuid, suuid, room
 }
 
@@ -33,6 +33,7 @@ func Stream(c *fiber.Ctx) error {
 	// Check if stream exists, if yes, render stream page, else render page with no stream
 	if _, ok := w.Streams[suuid]; ok {
 		log.Println("Stream exists")
+		ensureChatToken(c) // Identify the viewer in chat
 		return c.Render("stream", fiber.Map{
 			"StreamWebsocketAddr": fmt.Sprintf("%s://%s/stream/%s/websocket", ws, c.Hostname(), suuid),
 			"ChatWebsocketAddr":   fmt.Sprintf("%s://%s/stream/%s/chat/websocket", ws, c.Hostname(), suuid),
@@ -54,12 +55,13 @@ func StreamWebsocket(c *websocket.Conn) {
 		return
 	}
 
-	// Lock rooms map to ensure concurrent safety
-	w.RoomsLock.Lock()
-	defer w.RoomsLock.Unlock()
+	// Look the stream up, the lock is released before the connection runs
+	w.RoomsLock.RLock()
+	stream, ok := w.Streams[suuid]
+	w.RoomsLock.RUnlock()
 
 	// Check if stream exists, if yes, establish connection
-	if stream, ok := w.Streams[suuid]; ok {
+	if ok {
 		w.StreamConn(c, stream.Peers)
 	} else {
 		log.Println("Stream does not exist")
@@ -73,12 +75,13 @@ func StreamViewerWebsocket(c *websocket.Conn) {
 		return
 	}
 
-	// Lock rooms map to ensure concurrent safety
-	w.RoomsLock.Lock()
-	defer w.RoomsLock.Unlock()
+	// Look the stream up, the lock is released before the connection runs
+	w.RoomsLock.RLock()
+	stream, ok := w.Streams[suuid]
+	w.RoomsLock.RUnlock()
 
 	// Check if stream exists, if yes, establish viewer connection
-	if stream, ok := w.Streams[suuid]; ok {
+	if ok {
 		viewerConn(c, stream.Peers)
 	} else {
 		log.Println("Stream does not exist")
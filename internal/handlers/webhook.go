@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ChatWebhook posts a message of an incoming webhook into a room, the request is signed with the room's secret
+func ChatWebhook(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	if hub.WebhookSecret() == "" {
+		return fiber.NewError(fiber.StatusNotFound, "incoming webhooks are disabled")
+	}
+	if err := hub.VerifyWebhook(c.Get(chat.WebhookTimestampHeader), c.Get(chat.WebhookSignatureHeader), c.Body()); err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+
+	var in chat.IncomingWebhook
+	if err := json.Unmarshal(c.Body(), &in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid JSON body")
+	}
+	m, err := hub.PostWebhook(in)
+	var reject *chat.RejectError
+	switch {
+	case errors.As(err, &reject):
+		return fiber.NewError(fiber.StatusUnprocessableEntity, reject.Reason)
+	case errors.Is(err, chat.ErrHubClosed):
+		return fiber.NewError(fiber.StatusGone, err.Error())
+	case err != nil:
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"id": m.ID})
+}
+
+// ChatWebhookSecret tells the hosts of a room the address and secret of its incoming webhook
+func ChatWebhookSecret(c *fiber.Ctx) error {
+	hub := chatHub(c)
+	if hub == nil {
+		return fiber.ErrNotFound
+	}
+	if !hub.IsHost(chatID(c)) {
+		return fiber.ErrForbidden
+	}
+	secret := hub.WebhookSecret()
+	if secret == "" {
+		return fiber.NewError(fiber.StatusNotFound, "incoming webhooks are disabled")
+	}
+	return c.JSON(fiber.Map{
+		"url":    c.BaseURL() + c.Path(),
+		"secret": secret,
+	})
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
+	w "github.com/amitamrutiya/videocall-project/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestChatWebhook(t *testing.T) {
+	config := chat.DefaultConfig()
+	config.Webhooks = &chat.Webhooks{Secret: "server secret"}
+	config.Filters = func(room string) []chat.Filter { return []chat.Filter{&chat.LengthFilter{Max: 20}} }
+	hub := chat.NewHub("webhook-room", config)
+	go hub.Run()
+	defer hub.Close("test over")
+	closed := chat.NewHub("closed-room", config)
+	go closed.Run()
+	closed.Close("test over")
+	<-closed.Done()
+
+	w.RoomsLock.Lock()
+	if w.Rooms == nil {
+		w.Rooms = make(map[string]*w.Room)
+	}
+	w.Rooms["webhook-room"] = &w.Room{Hub: hub}
+	w.Rooms["closed-room"] = &w.Room{Hub: closed}
+	w.RoomsLock.Unlock()
+	defer func() {
+		w.RoomsLock.Lock()
+		delete(w.Rooms, "webhook-room")
+		delete(w.Rooms, "closed-room")
+		w.RoomsLock.Unlock()
+	}()
+
+	app := fiber.New()
+	app.Post("/room/:uuid/chat/webhook", ChatWebhook)
+
+	secret := hub.WebhookSecret()
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		room   string
+		secret string // Secret the request is signed with
+		signed int64  // Unix time the request is signed at
+		body   string
+		status int
+	}{
+		{"posted", "webhook-room", secret, now, `{"name":"CI","body":"build passed"}`, fiber.StatusAccepted},
+		{"replayed", "webhook-room", secret, now, `{"name":"CI","body":"build passed"}`, fiber.StatusUnauthorized},
+		{"bad signature", "webhook-room", "guess", now, `{"body":"hello"}`, fiber.StatusUnauthorized},
+		{"server secret instead of the room's", "webhook-room", "server secret", now, `{"body":"hello"}`, fiber.StatusUnauthorized},
+		{"stale timestamp", "webhook-room", secret, now - 3600, `{"body":"hello"}`, fiber.StatusUnauthorized},
+		{"invalid JSON", "webhook-room", secret, now, `{"body":`, fiber.StatusBadRequest},
+		{"empty message", "webhook-room", secret, now, `{"body":"  "}`, fiber.StatusUnprocessableEntity},
+		{"rejected by a filter", "webhook-room", secret, now, `{"body":"` + strings.Repeat("a", 30) + `"}`, fiber.StatusUnprocessableEntity},
+		{"unknown room", "nowhere", secret, now, `{"body":"hello"}`, fiber.StatusNotFound},
+		{"closed room", "closed-room", closed.WebhookSecret(), now, `{"body":"hello"}`, fiber.StatusGone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timestamp := strconv.FormatInt(test.signed, 10)
+			req := httptest.NewRequest(http.MethodPost, "/room/"+test.room+"/chat/webhook", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(chat.WebhookTimestampHeader, timestamp)
+			req.Header.Set(chat.WebhookSignatureHeader, chat.SignWebhook(test.secret, timestamp, []byte(test.body)))
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, test.status)
+			}
+		})
+	}
+}
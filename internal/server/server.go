@@ -2,10 +2,17 @@ package server
 
 import (
 	"flag"
+	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/amitamrutiya/videocall-project/internal/handlers"
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
 	w "github.com/amitamrutiya/videocall-project/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
@@ -19,6 +26,35 @@ var (
 	addr = flag.String("addr", ":"+os.Getenv("PORT"), "")
 	cert = flag.String("cert", "", "")
 	key  = flag.String("key", "", "")
+
+	roomIdle  = flag.Duration("room-idle", 10*time.Minute, "time a room may stay without peers or chat clients before it is closed, 0 keeps rooms forever")
+	simulcast = flag.String("simulcast-policy", "tiles", "simulcast layer sent to each peer: tiles picks a smaller one the more videos the peer shows, high or low always send that one")
+
+	chatHistory    = flag.String("chat-history", "memory", "chat history backend: memory, file or none")
+	chatHistoryDir = flag.String("chat-history-dir", "./data/chat", "directory of the file chat history backend")
+	chatHistoryLen = flag.Int("chat-history-size", 500, "number of chat messages kept in memory per room")
+	chatReplay     = flag.Int("chat-replay", 50, "number of recent chat messages replayed to joining clients")
+	chatRate       = flag.Float64("chat-rate", 1, "chat messages per second allowed per client, 0 disables flood protection")
+	chatBurst      = flag.Int("chat-burst", 5, "chat messages a client may send in a burst")
+	chatIPRate     = flag.Float64("chat-ip-rate", 5, "chat messages per second allowed per IP address, 0 disables the IP limit")
+	chatIPBurst    = flag.Int("chat-ip-burst", 20, "chat messages an IP address may send in a burst")
+	chatIPConns    = flag.Int("chat-ip-connections", 50, "chat connections an IP address may hold in one room, 0 for no cap")
+	chatFilters    = flag.String("chat-filters", "length", "comma separated chat filters: length, profanity, links, pii")
+	chatMaxLength  = flag.Int("chat-max-length", 400, "longest chat message in characters, used by the length filter")
+	chatProfanity  = flag.String("chat-profanity", "", "comma separated words masked by the profanity filter")
+	chatLinkHosts  = flag.String("chat-allowed-links", "", "comma separated hosts the links filter allows")
+	chatFilesDir   = flag.String("chat-attachments-dir", "./data/attachments", "directory of chat attachments, empty disables attachments")
+	chatFileSize   = flag.Int64("chat-attachment-size", 10<<20, "largest chat attachment in bytes")
+	chatBroker     = flag.String("chat-broker", "", "broker sharing chat rooms between replicas: memory or redis://[:password@]host:port, empty disables it")
+	chatWebhooks   = flag.String("chat-webhooks", "", "comma separated URLs receiving the chat events of every room")
+	chatHookSecret = flag.String("chat-webhook-secret", "", "secret signing outgoing chat webhooks and deriving the incoming webhook secret of each room, empty disables incoming webhooks")
+	chatHookTries  = flag.Int("chat-webhook-attempts", 5, "deliveries tried per chat webhook event before it is dropped")
+	chatHookDelay  = flag.Duration("chat-webhook-backoff", time.Second, "wait after a failed chat webhook delivery, doubled after every further failure")
+	chatShards     = flag.Int("chat-shards", runtime.NumCPU(), "goroutines delivering the messages of each chat room")
+	chatBatch      = flag.Int("chat-batch", 64, "most chat messages handed to the delivery goroutines at once")
+	chatQueue      = flag.Int("chat-queue", 256, "chat frames buffered per client")
+	chatPressure   = flag.String("chat-backpressure", "disconnect", "what happens to chat clients that cannot keep up: disconnect, drop-newest or drop-oldest")
+	chatRoster     = flag.Int("chat-roster", 200, "most participants listed in a chat roster, viewers beyond it are only counted")
 )
 
 // Run starts the server
@@ -29,8 +65,17 @@ func Run() error {
 		*addr = ":8077"
 	}
 
+	chatConfig, err := newChatConfig()
+	if err != nil {
+		return err
+	}
+	handlers.ChatConfig = chatConfig
+
 	engine := html.New("./views", ".html")
-	app := fiber.New(fiber.Config{Views: engine})
+	app := fiber.New(fiber.Config{
+		Views:     engine,
+		BodyLimit: int(chatConfig.AttachmentLimits.MaxSize) + 1<<20, // Leave room for the multipart envelope
+	})
 	app.Use(logger.New())
 	app.Use(cors.New())
 
@@ -43,6 +88,14 @@ func Run() error {
 	}))
 	app.Get("/room/:uuid/chat", handlers.RoomChat)
 	app.Get("/room/:uuid/chat/websocket", websocket.New(handlers.RoomChatWebsocket))
+	app.Get("/room/:uuid/chat/audit", handlers.RoomChatAudit)
+	app.Get("/room/:uuid/chat/export", handlers.ChatExport)
+	app.Get("/room/:uuid/chat/threads/:id", handlers.ChatThread)
+	app.Get("/room/:uuid/chat/metrics", handlers.ChatMetrics)
+	app.Get("/room/:uuid/chat/webhook", handlers.ChatWebhookSecret)
+	app.Post("/room/:uuid/chat/webhook", handlers.ChatWebhook)
+	app.Post("/room/:uuid/chat/attachments", handlers.ChatUpload)
+	app.Get("/room/:uuid/chat/attachments/:id", handlers.ChatAttachment)
 	app.Get("/room/:uuid/viewer/websocket", websocket.New(handlers.RoomViewerWebsocket))
 
 	app.Get("/stream/:suuid", handlers.Stream)
@@ -50,10 +103,25 @@ func Run() error {
 		HandshakeTimeout: 10 * time.Second,
 	}))
 	app.Get("/stream/:suuid/chat/websocket", websocket.New(handlers.StreamChatWebsocket))
+	app.Get("/stream/:suuid/chat/export", handlers.ChatExport)
+	app.Get("/stream/:suuid/chat/threads/:id", handlers.ChatThread)
+	app.Get("/stream/:suuid/chat/metrics", handlers.ChatMetrics)
+	app.Get("/stream/:suuid/chat/webhook", handlers.ChatWebhookSecret)
+	app.Post("/stream/:suuid/chat/webhook", handlers.ChatWebhook)
+	app.Post("/stream/:suuid/chat/attachments", handlers.ChatUpload)
+	app.Get("/stream/:suuid/chat/attachments/:id", handlers.ChatAttachment)
 	app.Get("/stream/:suuid/viewer/websocket", websocket.New(handlers.StreamViewerWebsocket))
 
 	app.Static("/", "./assets")
 
+	// Pick the simulcast layers peers receive
+	switch policy := w.LayerPolicy(*simulcast); policy {
+	case w.LayerPolicyTiles, w.LayerPolicyHigh, w.LayerPolicyLow:
+		w.SimulcastPolicy = policy
+	default:
+		return fmt.Errorf("unknown simulcast policy %q", *simulcast)
+	}
+
 	// Initialize rooms and streams maps
 	w.Rooms = make(map[string]*w.Room)
 	w.Streams = make(map[string]*w.Room)
@@ -61,6 +129,12 @@ func Run() error {
 	// Start periodic key frame dispatching
 	go dispatchKeyFrames()
 
+	// Close idle rooms in the background, and every room when the server stops
+	if *roomIdle > 0 {
+		go closeIdleRooms(*roomIdle)
+	}
+	go shutdownOnSignal(app)
+
 	// Listen to the specified address
 	if *cert != "" {
 		return app.ListenTLS(*addr, *cert, *key)
@@ -71,8 +145,156 @@ func Run() error {
 // dispatchKeyFrames periodically dispatches key frames to all peers in all rooms
 func dispatchKeyFrames() {
 	for range time.NewTicker(time.Second * 3).C {
+		w.RoomsLock.RLock()
+		rooms := make([]*w.Room, 0, len(w.Rooms))
 		for _, room := range w.Rooms {
+			rooms = append(rooms, room)
+		}
+		w.RoomsLock.RUnlock()
+
+		for _, room := range rooms {
 			room.Peers.DispatchKeyFrame()
 		}
 	}
 }
+
+// closeIdleRooms periodically closes the rooms nobody has been connected to for the given duration
+func closeIdleRooms(idle time.Duration) {
+	// Check often enough that rooms do not outlive the idle period by much
+	interval := idle / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for range time.NewTicker(interval).C {
+		w.CloseIdleRooms(idle)
+	}
+}
+
+// shutdownOnSignal closes every room and stops the server on SIGINT or SIGTERM
+func shutdownOnSignal(app *fiber.App) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	log.Println("shutting down")
+	w.CloseRooms("server shutting down")
+	if err := app.ShutdownWithTimeout(5 * time.Second); err != nil {
+		log.Println("error shutting down:", err)
+	}
+}
+
+// newChatConfig builds the chat hub settings from the command line flags
+func newChatConfig() (chat.Config, error) {
+	config := chat.DefaultConfig()
+	config.ReplayLimit = *chatReplay
+	if *chatRate > 0 {
+		config.RateLimit.Rate = *chatRate
+		config.RateLimit.Burst = *chatBurst
+		config.RateLimit.IPRate = *chatIPRate
+		config.RateLimit.IPBurst = *chatIPBurst
+		config.RateLimit.IPConnections = *chatIPConns
+	} else {
+		config.RateLimit = nil
+	}
+
+	switch *chatHistory {
+	case "memory":
+		config.History = func(room string) (chat.History, error) {
+			return chat.NewMemoryHistory(*chatHistoryLen), nil
+		}
+	case "file":
+		config.History = func(room string) (chat.History, error) {
+			return chat.NewFileHistory(*chatHistoryDir, room, *chatHistoryLen)
+		}
+	case "none":
+		config.History = nil
+	default:
+		return config, fmt.Errorf("unknown chat history backend %q", *chatHistory)
+	}
+
+	filters, err := chatFilterFactory()
+	if err != nil {
+		return config, err
+	}
+	config.Filters = filters
+
+	config.AttachmentLimits.MaxSize = *chatFileSize
+	if *chatFilesDir != "" {
+		store, err := chat.NewDiskAttachmentStore(*chatFilesDir)
+		if err != nil {
+			return config, err
+		}
+		config.Attachments = store
+	}
+
+	switch {
+	case *chatBroker == "":
+	case *chatBroker == "memory":
+		config.Broker = chat.NewMemoryBroker()
+	case strings.HasPrefix(*chatBroker, "redis://"):
+		broker, err := chat.NewRedisBroker(*chatBroker)
+		if err != nil {
+			return config, err
+		}
+		config.Broker = broker
+	default:
+		return config, fmt.Errorf("unknown chat broker %q", *chatBroker)
+	}
+
+	config.Fanout = chat.Fanout{Shards: *chatShards, BatchSize: *chatBatch, QueueSize: *chatQueue, Policy: chat.Backpressure(*chatPressure), RosterLimit: *chatRoster}
+	switch config.Fanout.Policy {
+	case chat.BackpressureDisconnect, chat.BackpressureDropNewest, chat.BackpressureDropOldest:
+	default:
+		return config, fmt.Errorf("unknown chat backpressure policy %q", *chatPressure)
+	}
+
+	if urls := splitList(*chatWebhooks); len(urls) > 0 || *chatHookSecret != "" {
+		config.Webhooks = &chat.Webhooks{
+			URLs:     urls,
+			Secret:   *chatHookSecret,
+			Attempts: *chatHookTries,
+			Backoff:  *chatHookDelay,
+		}
+	}
+	return config, nil
+}
+
+// chatFilterFactory builds the function creating the filters of each room from the command line flags
+func chatFilterFactory() (func(room string) []chat.Filter, error) {
+	names := splitList(*chatFilters)
+	for _, name := range names {
+		switch name {
+		case "length", "profanity", "links", "pii":
+		default:
+			return nil, fmt.Errorf("unknown chat filter %q", name)
+		}
+	}
+
+	return func(room string) []chat.Filter {
+		var filters []chat.Filter
+		for _, name := range names {
+			switch name {
+			case "length":
+				filters = append(filters, &chat.LengthFilter{Max: *chatMaxLength})
+			case "profanity":
+				filters = append(filters, chat.NewProfanityFilter(splitList(*chatProfanity)))
+			case "links":
+				filters = append(filters, &chat.LinkFilter{Allowed: splitList(*chatLinkHosts)})
+			case "pii":
+				filters = append(filters, &chat.PIIFilter{})
+			}
+		}
+		return filters
+	}, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
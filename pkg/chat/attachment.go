@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxAttachmentsPerMessage = 10  // Attachments a single chat message may reference
+	maxAttachmentNameLength  = 128 // Longest file name kept for an attachment
+)
+
+// Errors returned when uploading or downloading attachments
+var (
+	ErrAttachmentsDisabled = errors.New("chat: attachments are disabled")
+	ErrAttachmentTooLarge  = errors.New("chat: attachment is too large")
+	ErrAttachmentType      = errors.New("chat: attachment type is not allowed")
+	ErrAttachmentNotFound  = errors.New("chat: attachment not found")
+)
+
+// Attachment describes a file uploaded to a room
+type Attachment struct {
+	ID       string    `json:"id"`       // Unique id of the attachment
+	Room     string    `json:"room"`     // Room the attachment was uploaded to
+	Name     string    `json:"name"`     // Original file name
+	Type     string    `json:"type"`     // Detected media type
+	Size     int64     `json:"size"`     // Size in bytes
+	Uploader string    `json:"uploader"` // Id of the participant who uploaded it
+	Created  time.Time `json:"created"`  // Time of the upload
+}
+
+// AttachmentStore keeps the files uploaded to rooms
+type AttachmentStore interface {
+	// Save stores the content of an attachment whose metadata is already filled in
+	Save(a *Attachment, content io.Reader) error
+	// Stat returns the metadata of an attachment
+	Stat(room, id string) (*Attachment, error)
+	// Open returns the metadata and the content of an attachment
+	Open(room, id string) (*Attachment, io.ReadCloser, error)
+	// RemoveRoom deletes every attachment of a room
+	RemoveRoom(room string) error
+}
+
+// AttachmentLimits restricts what can be uploaded to a room
+type AttachmentLimits struct {
+	MaxSize int64    // Largest accepted file in bytes
+	Types   []string // Accepted media types, as detected from the content
+}
+
+// DefaultAttachmentTypes are the media types accepted unless configured otherwise
+var DefaultAttachmentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"application/pdf",
+	"text/plain",
+	"application/zip",
+}
+
+// Upload checks and stores a file uploaded by a participant of the room
+func (h *Hub) Upload(uploader, name string, content io.Reader) (*Attachment, error) {
+	store := h.config.Attachments
+	if store == nil {
+		return nil, ErrAttachmentsDisabled
+	}
+	limits := h.config.AttachmentLimits
+
+	// Read one byte more than allowed to detect oversized files
+	data, err := io.ReadAll(io.LimitReader(content, limits.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.MaxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+
+	// Trust the content, not the name or the type claimed by the browser
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil || !allowedType(mediaType, limits.Types) {
+		return nil, ErrAttachmentType
+	}
+
+	a := &Attachment{
+		ID:       uuid.New().String(),
+		Room:     h.Room,
+		Name:     cleanFileName(name),
+		Type:     mediaType,
+		Size:     int64(len(data)),
+		Uploader: uploader,
+		Created:  time.Now().UTC(),
+	}
+	if err := store.Save(a, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Download opens an attachment of the room
+func (h *Hub) Download(id string) (*Attachment, io.ReadCloser, error) {
+	if h.config.Attachments == nil {
+		return nil, nil, ErrAttachmentsDisabled
+	}
+	return h.config.Attachments.Open(h.Room, id)
+}
+
+// RemoveAttachments deletes every attachment uploaded to the room
+func (h *Hub) RemoveAttachments() error {
+	if h.config.Attachments == nil {
+		return nil
+	}
+	return h.config.Attachments.RemoveRoom(h.Room)
+}
+
+// resolveAttachments replaces the attachment ids sent by a client by their metadata.
+// It returns false if one of them does not belong to the room.
+func (h *Hub) resolveAttachments(m *Message) bool {
+	if len(m.Attachments) == 0 {
+		return true
+	}
+	if h.config.Attachments == nil || len(m.Attachments) > maxAttachmentsPerMessage {
+		return false
+	}
+
+	resolved := make([]Attachment, 0, len(m.Attachments))
+	for _, a := range m.Attachments {
+		stored, err := h.config.Attachments.Stat(h.Room, a.ID)
+		if err != nil {
+			return false
+		}
+		resolved = append(resolved, *stored)
+	}
+	m.Attachments = resolved
+	return true
+}
+
+// allowedType reports whether a media type is in the list of accepted types
+func allowedType(mediaType string, types []string) bool {
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanFileName keeps the base name of an uploaded file without control characters
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) > maxAttachmentNameLength {
+		// Keep the end, where the extension is, starting on a whole character
+		name = name[len(name)-maxAttachmentNameLength:]
+		for len(name) > 0 && !utf8.RuneStart(name[0]) {
+			name = name[1:]
+		}
+	}
+	if name == "" || name == "." || name == ".." || name == "/" {
+		name = "attachment"
+	}
+	return name
+}
@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// DiskAttachmentStore keeps attachments on the local disk, one directory per room.
+// Each attachment is stored as a content file next to a JSON metadata file.
+type DiskAttachmentStore struct {
+	Dir string // Root directory of the store
+}
+
+// NewDiskAttachmentStore creates a store rooted at dir
+func NewDiskAttachmentStore(dir string) (*DiskAttachmentStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskAttachmentStore{Dir: dir}, nil
+}
+
+// Save writes the content and the metadata of an attachment
+func (s *DiskAttachmentStore) Save(a *Attachment, content io.Reader) error {
+	dir := filepath.Join(s.Dir, safeName(a.Room))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, a.ID+".bin"))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, a.ID+".json"), meta, 0o644)
+}
+
+// Stat reads the metadata of an attachment
+func (s *DiskAttachmentStore) Stat(room, id string) (*Attachment, error) {
+	// Only accept ids we generated so they cannot point outside the room directory
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrAttachmentNotFound
+	}
+
+	meta, err := os.ReadFile(filepath.Join(s.Dir, safeName(room), id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Attachment{}
+	if err := json.Unmarshal(meta, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Open returns the metadata and the content of an attachment
+func (s *DiskAttachmentStore) Open(room, id string) (*Attachment, io.ReadCloser, error) {
+	a, err := s.Stat(room, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(filepath.Join(s.Dir, safeName(room), id+".bin"))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, f, nil
+}
+
+// RemoveRoom deletes the directory of a room
+func (s *DiskAttachmentStore) RemoveRoom(room string) error {
+	return os.RemoveAll(filepath.Join(s.Dir, safeName(room)))
+}
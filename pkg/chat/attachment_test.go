@@ -0,0 +1,45 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanFileName(t *testing.T) {
+	long := strings.Repeat("a", 200) + ".png"
+	accented := strings.Repeat("é", 100) + ".png" // 204 bytes, the cut falls inside an é
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "cat.png", "cat.png"},
+		{"unix path", "/home/alice/cat.png", "cat.png"},
+		{"windows path", `C:\Users\alice\cat.png`, "cat.png"},
+		{"traversal", "../../etc/passwd", "passwd"},
+		{"control characters", "ca\x00t\r\n.png", "cat.png"},
+		{"quotes", `say "cheese".png`, "say cheese.png"},
+		{"unicode kept", "chat 🐈.png", "chat 🐈.png"},
+		{"empty", "", "attachment"},
+		{"dot", ".", "attachment"},
+		{"dot dot", "..", "attachment"},
+		{"trailing slash", "dir/", "dir"},
+		{"root", "/", "attachment"},
+		{"only control characters", "\x01\x02", "attachment"},
+		{"long keeps the extension", long, long[len(long)-maxAttachmentNameLength:]},
+		{"long cut on a whole character", accented, strings.Repeat("é", 62) + ".png"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := cleanFileName(test.in)
+			if got != test.want {
+				t.Errorf("cleanFileName(%q) = %q, want %q", test.in, got, test.want)
+			}
+			if len(got) > maxAttachmentNameLength || !utf8.ValidString(got) {
+				t.Errorf("cleanFileName(%q) = %q is too long or not valid UTF-8", test.in, got)
+			}
+		})
+	}
+}
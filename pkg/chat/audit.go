@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// auditLogSize is the number of audit entries kept per hub
+const auditLogSize = 1000
+
+// AuditAction names an enforcement action taken against a client
+type AuditAction string
+
+// Actions recorded in the audit log
+const (
+	AuditWarn       AuditAction = "warn"       // Client was warned
+	AuditMute       AuditAction = "mute"       // Client was muted
+	AuditDisconnect AuditAction = "disconnect" // Client was disconnected
+	AuditUnmute     AuditAction = "unmute"     // Client was unmuted by a host
+	AuditKick       AuditAction = "kick"       // Client was kicked by a host
+	AuditBan        AuditAction = "ban"        // Client was banned by a host
+	AuditBanIP      AuditAction = "ban_ip"     // Client and its IP address were banned by a host
+	AuditUnban      AuditAction = "unban"      // Client was unbanned by a host
+	AuditDelete     AuditAction = "delete"     // Message of the client was deleted by a host
+)
+
+// AuditEntry records one enforcement action
+type AuditEntry struct {
+	Time     time.Time   `json:"time"`      // When the action was taken
+	Action   AuditAction `json:"action"`    // What was done
+	ClientID string      `json:"client_id"` // Id of the affected client
+	Name     string      `json:"name"`      // Display name of the affected client
+	IP       string      `json:"ip"`        // Remote address of the affected client
+	Reason   string      `json:"reason"`    // Why the action was taken
+	By       string      `json:"by"`        // Id of the host who took the action, empty for automatic actions
+}
+
+// auditLog is a bounded, concurrency safe list of audit entries
+type auditLog struct {
+	lock    sync.Mutex   // Mutex for the entries
+	entries []AuditEntry // Entries, oldest first
+}
+
+// add appends an entry, dropping the oldest one when the log is full
+func (l *auditLog) add(e AuditEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.entries) == auditLogSize {
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, e)
+}
+
+// AuditLog returns a copy of the enforcement actions taken in the hub, oldest first
+func (h *Hub) AuditLog() []AuditEntry {
+	h.auditLog.lock.Lock()
+	defer h.auditLog.lock.Unlock()
+
+	entries := make([]AuditEntry, len(h.auditLog.entries))
+	copy(entries, h.auditLog.entries)
+	return entries
+}
+
+// audit records an action taken against a participant in the hub's audit log
+func (h *Hub) audit(action AuditAction, id, name, ip, by, reason string) {
+	log.Printf("chat %s: %s %s (%s, %s) by %q: %s", h.Room, action, id, name, ip, by, reason)
+	h.auditLog.add(AuditEntry{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		ClientID: id,
+		Name:     name,
+		IP:       ip,
+		Reason:   reason,
+		By:       by,
+	})
+}
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"sync"
+)
+
+// Broker carries the messages of a room between the hubs of several server replicas
+type Broker interface {
+	// Publish sends data to every subscriber of the topic, including those of this replica
+	Publish(topic string, data []byte) error
+	// Subscribe calls fn with the data published on the topic until unsubscribe is called
+	Subscribe(topic string, fn func(data []byte)) (unsubscribe func(), err error)
+	// Close releases the connections held by the broker
+	Close() error
+}
+
+// MemoryBroker delivers published messages to the subscribers of the same process
+type MemoryBroker struct {
+	lock   sync.RWMutex                          // Mutex for subs
+	subs   map[string]map[*memorySubscriber]bool // Subscribers by topic
+	closed bool                                  // Whether Close has been called
+}
+
+// memorySubscriber is a subscription to a MemoryBroker topic
+type memorySubscriber struct {
+	fn func(data []byte) // Callback of the subscription
+}
+
+// NewMemoryBroker creates an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[string]map[*memorySubscriber]bool)}
+}
+
+// Publish calls the subscribers of the topic synchronously
+func (b *MemoryBroker) Publish(topic string, data []byte) error {
+	b.lock.RLock()
+	subs := make([]*memorySubscriber, 0, len(b.subs[topic]))
+	for sub := range b.subs[topic] {
+		subs = append(subs, sub)
+	}
+	b.lock.RUnlock()
+
+	for _, sub := range subs {
+		sub.fn(data)
+	}
+	return nil
+}
+
+// Subscribe registers fn for the topic
+func (b *MemoryBroker) Subscribe(topic string, fn func(data []byte)) (func(), error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	sub := &memorySubscriber{fn: fn}
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[*memorySubscriber]bool)
+	}
+	b.subs[topic][sub] = true
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		delete(b.subs[topic], sub)
+		if len(b.subs[topic]) == 0 {
+			delete(b.subs, topic)
+		}
+	}, nil
+}
+
+// Close drops every subscription
+func (b *MemoryBroker) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.subs = make(map[string]map[*memorySubscriber]bool)
+	return nil
+}
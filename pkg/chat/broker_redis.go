@@ -0,0 +1,340 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timeouts of the connections to a Redis server
+const (
+	redisDialTimeout  = 5 * time.Second
+	redisWriteTimeout = 5 * time.Second
+	redisMaxBackoff   = 30 * time.Second
+)
+
+// redisReadTimeout is the longest wait for the reply to a command. Pushes to the subscriber
+// connection are waited for as long as it takes.
+var redisReadTimeout = 5 * time.Second
+
+// ErrBrokerClosed is returned when a closed broker is used
+var ErrBrokerClosed = errors.New("chat: broker closed")
+
+// RedisBroker relays chat messages through a server speaking the Redis protocol (RESP),
+// such as Redis, Valkey or KeyDB. It keeps one connection for publishing and one for
+// subscriptions, and resubscribes after reconnecting when the server goes away.
+type RedisBroker struct {
+	addr     string // Address of the server
+	password string // Password sent with AUTH, empty if the server has none
+
+	pubLock sync.Mutex // Mutex for pub
+	pub     *respConn  // Connection used for PUBLISH, dialed on demand
+
+	subLock sync.Mutex                           // Mutex for sub, subs and closed
+	sub     *respConn                            // Connection in subscriber mode
+	subs    map[string]map[*redisSubscriber]bool // Subscribers by topic
+	closed  bool                                 // Whether Close has been called
+}
+
+// redisSubscriber is a subscription to a RedisBroker topic
+type redisSubscriber struct {
+	fn func(data []byte) // Callback of the subscription
+}
+
+// NewRedisBroker connects to the server at a redis://[:password@]host:port address
+func NewRedisBroker(rawURL string) (*RedisBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("chat: invalid redis address %q", rawURL)
+	}
+	password, _ := u.User.Password()
+
+	b := &RedisBroker{addr: u.Host, password: password, subs: make(map[string]map[*redisSubscriber]bool)}
+	if b.sub, err = dialRESP(b.addr, b.password); err != nil {
+		return nil, err
+	}
+	go b.listen()
+	return b, nil
+}
+
+// Publish sends data to the subscribers of the topic, reconnecting once if the connection broke
+func (b *RedisBroker) Publish(topic string, data []byte) error {
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = dialRESP(b.addr, b.password); err != nil {
+				return err
+			}
+		}
+		if _, err = b.pub.do("PUBLISH", topic, string(data)); err == nil {
+			return nil
+		}
+		b.pub.conn.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+// Subscribe registers fn for the topic, the server is subscribed for the first subscriber
+func (b *RedisBroker) Subscribe(topic string, fn func(data []byte)) (func(), error) {
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	sub := &redisSubscriber{fn: fn}
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[*redisSubscriber]bool)
+		if b.sub != nil {
+			// Failures are repaired by the resubscription that follows a reconnect
+			if err := b.sub.send("SUBSCRIBE", topic); err != nil {
+				log.Printf("error subscribing to %s: %v", topic, err)
+			}
+		}
+	}
+	b.subs[topic][sub] = true
+
+	return func() {
+		b.subLock.Lock()
+		defer b.subLock.Unlock()
+		delete(b.subs[topic], sub)
+		if len(b.subs[topic]) > 0 {
+			return
+		}
+		delete(b.subs, topic)
+		if b.sub != nil && !b.closed {
+			if err := b.sub.send("UNSUBSCRIBE", topic); err != nil {
+				log.Printf("error unsubscribing from %s: %v", topic, err)
+			}
+		}
+	}, nil
+}
+
+// Close closes both connections, subscriptions end
+func (b *RedisBroker) Close() error {
+	b.subLock.Lock()
+	b.closed = true
+	if b.sub != nil {
+		b.sub.conn.Close()
+	}
+	b.subLock.Unlock()
+
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+	if b.pub != nil {
+		b.pub.conn.Close()
+		b.pub = nil
+	}
+	return nil
+}
+
+// listen dispatches the messages pushed on the subscriber connection and reconnects when it breaks
+func (b *RedisBroker) listen() {
+	backoff := time.Second
+	for {
+		b.subLock.Lock()
+		conn, closed := b.sub, b.closed
+		b.subLock.Unlock()
+		if closed {
+			return
+		}
+
+		if conn != nil {
+			err := b.dispatch(conn)
+			conn.conn.Close()
+			if b.isClosed() {
+				return
+			}
+			log.Printf("lost connection to redis at %s: %v", b.addr, err)
+			backoff = time.Second
+		}
+
+		// Reconnect and subscribe to every topic again
+		time.Sleep(backoff)
+		conn, err := dialRESP(b.addr, b.password)
+		if err != nil {
+			log.Printf("error reconnecting to redis at %s: %v", b.addr, err)
+			if backoff *= 2; backoff > redisMaxBackoff {
+				backoff = redisMaxBackoff
+			}
+			b.subLock.Lock()
+			b.sub = nil
+			b.subLock.Unlock()
+			continue
+		}
+		b.subLock.Lock()
+		if b.closed {
+			b.subLock.Unlock()
+			conn.conn.Close()
+			return
+		}
+		b.sub = conn
+		for topic := range b.subs {
+			if err := conn.send("SUBSCRIBE", topic); err != nil {
+				log.Printf("error subscribing to %s: %v", topic, err)
+			}
+		}
+		b.subLock.Unlock()
+	}
+}
+
+// dispatch reads pushed messages until the connection fails
+func (b *RedisBroker) dispatch(conn *respConn) error {
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		// Pushes are arrays, only "message" carries data, subscription confirmations are ignored
+		push, ok := reply.([]interface{})
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].([]byte)
+		topic, _ := push[1].([]byte)
+		data, _ := push[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		b.subLock.Lock()
+		subs := make([]*redisSubscriber, 0, len(b.subs[string(topic)]))
+		for sub := range b.subs[string(topic)] {
+			subs = append(subs, sub)
+		}
+		b.subLock.Unlock()
+		for _, sub := range subs {
+			sub.fn(data)
+		}
+	}
+}
+
+// isClosed reports whether Close has been called
+func (b *RedisBroker) isClosed() bool {
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	return b.closed
+}
+
+// respConn is a connection speaking RESP, the protocol of Redis
+type respConn struct {
+	conn net.Conn      // Network connection
+	r    *bufio.Reader // Buffered reader for replies
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// dialRESP connects to a server and authenticates if a password is given
+func dialRESP(addr, password string) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply
+func (c *respConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(redisReadTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	reply, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// send writes a command as an array of bulk strings
+func (c *respConn) send(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(redisWriteTimeout))
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// read parses one reply: simple strings and bulk strings as []byte, integers as int64,
+// errors as redisError, arrays as []interface{} and null values as nil
+func (c *respConn) read() (interface{}, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return append([]byte(nil), payload...), nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(string(payload), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(payload))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(payload))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
@@ -0,0 +1,360 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRESPRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+		fails bool
+	}{
+		{"simple string", "+OK\r\n", []byte("OK"), false},
+		{"error", "-ERR unknown command\r\n", redisError("ERR unknown command"), false},
+		{"integer", ":42\r\n", int64(42), false},
+		{"negative integer", ":-3\r\n", int64(-3), false},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello"), false},
+		{"bulk string with CRLF", "$4\r\na\r\nb\r\n", []byte("a\r\nb"), false},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, false},
+		{"null bulk string", "$-1\r\n", nil, false},
+		{"array", "*3\r\n$7\r\nmessage\r\n$1\r\nt\r\n:1\r\n", []interface{}{[]byte("message"), []byte("t"), int64(1)}, false},
+		{"nested array", "*2\r\n*1\r\n+a\r\n$-1\r\n", []interface{}{[]interface{}{[]byte("a")}, nil}, false},
+		{"empty array", "*0\r\n", []interface{}{}, false},
+		{"missing CR", "+OK\n", nil, true},
+		{"unknown type", "?x\r\n", nil, true},
+		{"bad integer", ":x\r\n", nil, true},
+		{"truncated bulk string", "$5\r\nhel", nil, true},
+		{"truncated array", "*2\r\n+a\r\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &respConn{r: bufio.NewReader(strings.NewReader(test.input))}
+			got, err := c.read()
+			if test.fails {
+				if err == nil {
+					t.Errorf("read() = %#v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read(): %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("read() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRESPSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go (&respConn{conn: client}).send("PUBLISH", "chat:room", "a b")
+
+	want := "*3\r\n$7\r\nPUBLISH\r\n$9\r\nchat:room\r\n$3\r\na b\r\n"
+	got := make([]byte, len(want))
+	if _, err := server.Read(got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("send wrote %q, want %q", got, want)
+	}
+}
+
+// fakeRedis is a server speaking enough RESP for RedisBroker: AUTH, PUBLISH, SUBSCRIBE and UNSUBSCRIBE
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	lock       sync.Mutex
+	conns      map[net.Conn]bool
+	subs       map[string]map[net.Conn]bool
+	subscribes int  // SUBSCRIBE commands received
+	stalled    bool // Whether PUBLISH commands are left unanswered
+}
+
+// newFakeRedis serves RESP on a loopback port until the test ends
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{listener: listener, password: password, conns: make(map[net.Conn]bool), subs: make(map[string]map[net.Conn]bool)}
+	go s.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		s.kick()
+	})
+	return s
+}
+
+// url returns the address brokers connect to
+func (s *fakeRedis) url(password string) string {
+	if password != "" {
+		return "redis://:" + password + "@" + s.listener.Addr().String()
+	}
+	return "redis://" + s.listener.Addr().String()
+}
+
+// serve accepts connections until the listener is closed
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// handle answers the commands of one connection
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer s.drop(conn)
+	c := &respConn{conn: conn, r: bufio.NewReader(conn)}
+	authed := s.password == ""
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		s.lock.Lock()
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if authed = len(args) == 2 && args[1] == s.password; authed {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd == "PUBLISH" && s.stalled:
+		case cmd == "PUBLISH" && len(args) == 3:
+			for sub := range s.subs[args[1]] {
+				fmt.Fprintf(sub, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(args[2]), args[2])
+			}
+			fmt.Fprintf(conn, ":%d\r\n", len(s.subs[args[1]]))
+		case cmd == "SUBSCRIBE" || cmd == "UNSUBSCRIBE":
+			for _, topic := range args[1:] {
+				if cmd == "SUBSCRIBE" {
+					s.subscribes++
+					if s.subs[topic] == nil {
+						s.subs[topic] = make(map[net.Conn]bool)
+					}
+					s.subs[topic][conn] = true
+				} else {
+					delete(s.subs[topic], conn)
+				}
+				fmt.Fprintf(conn, "*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:1\r\n", len(cmd), strings.ToLower(cmd), len(topic), topic)
+			}
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+		s.lock.Unlock()
+	}
+}
+
+// drop forgets a closed connection and its subscriptions
+func (s *fakeRedis) drop(conn net.Conn) {
+	conn.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+	for _, subs := range s.subs {
+		delete(subs, conn)
+	}
+}
+
+// kick closes every connection, as a restarting server would
+func (s *fakeRedis) kick() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// subscribers returns the number of connections subscribed to a topic
+func (s *fakeRedis) subscribers(topic string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.subs[topic])
+}
+
+// subscribed returns the number of SUBSCRIBE commands received
+func (s *fakeRedis) subscribed() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.subscribes
+}
+
+// waitFor polls a condition until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// collect subscribes to a topic and returns the channel the published data arrives on
+func collect(t *testing.T, b *RedisBroker, topic string) (<-chan string, func()) {
+	t.Helper()
+	received := make(chan string, 16)
+	unsubscribe, err := b.Subscribe(topic, func(data []byte) { received <- string(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received, unsubscribe
+}
+
+// expect waits for the next data published on a subscription
+func expect(t *testing.T, received <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		if got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestRedisBrokerPublishSubscribe(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	a, err := NewRedisBroker(server.url("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewRedisBroker(server.url("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	received, unsubscribe := collect(t, b, "chat:room")
+	waitFor(t, "the subscription", func() bool { return server.subscribers("chat:room") == 1 })
+	other, _ := collect(t, b, "chat:other")
+	waitFor(t, "the other subscription", func() bool { return server.subscribers("chat:other") == 1 })
+
+	if err := a.Publish("chat:room", []byte("hello\r\nworld")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, received, "hello\r\nworld")
+	if err := a.Publish("chat:other", []byte("elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, other, "elsewhere")
+	if len(received) != 0 {
+		t.Errorf("message of another topic delivered to chat:room")
+	}
+
+	unsubscribe()
+	waitFor(t, "the unsubscription", func() bool { return server.subscribers("chat:room") == 0 })
+}
+
+func TestRedisBrokerResubscribes(t *testing.T) {
+	server := newFakeRedis(t, "")
+	b, err := NewRedisBroker(server.url(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	received, _ := collect(t, b, "chat:room")
+	waitFor(t, "the subscription", func() bool { return server.subscribers("chat:room") == 1 })
+
+	// Both connections break, the broker reconnects and subscribes again
+	server.kick()
+	waitFor(t, "the resubscription", func() bool { return server.subscribed() == 2 && server.subscribers("chat:room") == 1 })
+	if err := b.Publish("chat:room", []byte("after restart")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, received, "after restart")
+}
+
+func TestRedisBrokerErrors(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"wrong password", server.url("wrong")},
+		{"not redis", "http://" + server.listener.Addr().String()},
+		{"no host", "redis://"},
+		{"nobody listening", "redis://127.0.0.1:1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if b, err := NewRedisBroker(test.url); err == nil {
+				b.Close()
+				t.Errorf("NewRedisBroker(%q) succeeded", test.url)
+			}
+		})
+	}
+
+	b, err := NewRedisBroker(server.url("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if _, err := b.Subscribe("chat:room", func([]byte) {}); err != ErrBrokerClosed {
+		t.Errorf("Subscribe after Close = %v, want %v", err, ErrBrokerClosed)
+	}
+}
+
+func TestRedisBrokerPublishTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { redisReadTimeout = timeout }(redisReadTimeout)
+	redisReadTimeout = 100 * time.Millisecond
+
+	server := newFakeRedis(t, "")
+	b, err := NewRedisBroker(server.url(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	server.lock.Lock()
+	server.stalled = true
+	server.lock.Unlock()
+	start := time.Now()
+	if err := b.Publish("chat:room", []byte("hi")); err == nil {
+		t.Error("Publish to a stalled server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Publish to a stalled server took %s", elapsed)
+	}
+
+	// The broker works again once the server answers
+	server.lock.Lock()
+	server.stalled = false
+	server.lock.Unlock()
+	if err := b.Publish("chat:room", []byte("hi")); err != nil {
+		t.Errorf("Publish after the stall = %v", err)
+	}
+}
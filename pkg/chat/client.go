@@ -1,11 +1,16 @@
 package chat
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fasthttp/websocket"
+	"github.com/google/uuid"
 )
 
 const (
@@ -13,6 +18,7 @@ const (
 	pongWait       = 60 * time.Second    // 60s
 	pingPeriod     = (pongWait * 9) / 10 // 54s
 	maxMessageSize = 512
+	maxNameLength  = 32
 )
 
 // Byte slices used for message processing
@@ -27,18 +33,142 @@ var (
 // 	WriteBufferSize: 1024,
 // }
 
+// ClientInfo describes the participant behind a chat connection
+type ClientInfo struct {
+	ID           string // Public participant id derived with ClientID, empty for anonymous clients
+	Role         Role   // Role the participant joins with, hosts are recognised by the hub
+	Name         string // Requested display name, may be empty
+	Version      int    // Protocol version requested by the client, 0 for legacy plain text
+	Cursor       string // Id of the last message the client has seen, empty for a fresh join
+	DirectCursor string // Id of the last private message the client has seen
+	IP           string // Remote address of the client, used for per-IP rate limiting
+}
+
 // Client represents a chat client connected to the hub
 type Client struct {
-	Hub  *Hub            // Reference to the hub this client is connected to
-	Conn *websocket.Conn // WebSocket connection of the client
-	Send chan []byte     // Channel for sending messages to the client
+	Hub          *Hub            // Reference to the hub this client is connected to
+	Conn         *websocket.Conn // WebSocket connection of the client, nil for clients on another transport
+	transport    Transport       // Connection of clients that are not on a websocket
+	leaveOnce    sync.Once       // Makes Leave idempotent
+	send         chan *frame     // Frames queued for the client, closed when the hub lets it go
+	shard        *shard          // Shard delivering the room's messages to the client, set by the hub goroutine
+	ID           string          // Public id of the participant, stable for a given token
+	Name         string          // Display name shown to other participants, guarded by lock once registered
+	Role         Role            // Role of the participant in the room
+	Version      int             // Protocol version spoken by the client, 0 for legacy plain text
+	IP           string          // Remote address of the client
+	cursor       string          // Id of the last message the client saw before connecting
+	directCursor string          // Id of the last private message the client saw before connecting
+	flood        floodState      // Flood protection state, only used by readPump
+
+	lock        sync.Mutex // Mutex guarding send against use after close, and Name
+	closed      bool       // Whether send has been closed
+	closeCode   int        // Close code sent to the client when send is closed
+	closeReason string     // Close reason sent to the client when send is closed
+}
+
+// ClientID derives the public participant id from a client token.
+// An empty token yields a random id, so anonymous clients never collide.
+func ClientID(token string) string {
+	if token == "" {
+		return strings.ReplaceAll(uuid.New().String(), "-", "")[:16]
+	}
+	h := sha256.New()
+	h.Write([]byte(token))
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+// cleanName trims a requested display name and falls back to a guest name
+func cleanName(name, id string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	for utf8.RuneCountInString(name) > maxNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" {
+		name = "Guest-" + id[:4]
+	}
+	return name
+}
+
+// encode serializes a message in the protocol version spoken by the client.
+// The revisions of edited messages are only shown to hosts.
+func (c *Client) encode(m *Message) []byte {
+	if len(m.Revisions) > 0 && c.Role != RoleHost {
+		stripped := *m
+		stripped.Revisions = nil
+		m = &stripped
+	}
+	if c.Version == 0 {
+		return encodeLegacy(m)
+	}
+	return encodeJSON(m)
+}
+
+// deliver queues data for the client without blocking.
+// It reports false if the client is gone or its buffer is full.
+func (c *Client) deliver(data []byte) bool {
+	if data == nil {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- newFrame(data):
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the send channel once, writePump then closes the connection with the given code.
+// A zero code closes the connection without a close frame.
+func (c *Client) close(code int, reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
+
+// notify sends a notice to this client only
+func (c *Client) notify(kind Kind, body string) {
+	c.deliver(c.encode(&Message{
+		Version:   ProtocolVersion,
+		Room:      c.Hub.Room,
+		Timestamp: time.Now().UTC(),
+		Kind:      kind,
+		Body:      body,
+	}))
+}
+
+// disconnect sends a close frame to the client, readPump then tears the connection down.
+// Clients on another transport have it closed right away, Receive then lets the hub know.
+func (c *Client) disconnect(code int, reason string) {
+	if c.Conn == nil {
+		c.transport.Close(code, reason)
+		return
+	}
+	c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
 }
 
 // readPump listens for messages from the WebSocket connection and sends them to the hub
 func (c *Client) readPump() {
 	defer func() {
-		c.Hub.unregister <- c // Unregister client from the hub when done
-		c.Conn.Close()        // Close the WebSocket connection
+		// Unregister client from the hub when done, a closed hub has already let it go
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.done:
+		}
+		c.Conn.Close() // Close the WebSocket connection
 	}()
 	c.Conn.SetReadLimit(maxMessageSize)              // Set maximum message size
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait)) // Set read deadline
@@ -47,7 +177,7 @@ func (c *Client) readPump() {
 		return nil
 	})
 	for {
-		_, message, err := c.Conn.ReadMessage() // Read message from WebSocket connection
+		_, raw, err := c.Conn.ReadMessage() // Read message from WebSocket connection
 		if err != nil {
 			// Handle WebSocket read errors
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
@@ -56,12 +186,73 @@ func (c *Client) readPump() {
 			log.Printf("other error: %v", err)
 			break
 		}
-		// Trim leading and trailing whitespace, replace newlines with spaces
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.Hub.broadcast <- message // Send message to the hub for broadcasting
+		if !c.receive(raw) {
+			break
+		}
+	}
+}
+
+// receive runs a frame read from the client through the pipeline in front of the hub.
+// It reports false once the client has been disconnected.
+func (c *Client) receive(raw []byte) bool {
+	// Decode the frame, wrapping legacy plain text in an envelope
+	message := decodeMessage(raw)
+	if message.Kind.ephemeral() {
+		// Typing and read events are throttled on their own and never reach the flood protection
+		if c.allowEphemeral(time.Now()) {
+			c.submit(message)
+		}
+		return true
+	}
+	if message.Body == "" && len(message.Attachments) == 0 && message.Kind == KindText {
+		return true
+	}
+	// Apply the flood protection before the message reaches the hub
+	forward, closed := c.enforceFlood(c.checkFlood(time.Now()))
+	if closed {
+		return false
+	}
+	if !forward {
+		return true
+	}
+	// Slash commands are handled here instead of being broadcast
+	if message.Kind == KindText && c.runCommand(message.Body) {
+		return true
+	}
+	// Content policies may rewrite the message or send it back with a reason
+	if reject := c.Hub.applyFilters(message); reject != nil {
+		c.notify(KindRejected, reject.Reason)
+		return true
+	}
+	c.submit(message) // Send message to the hub for broadcasting
+	return true
+}
+
+// submit sends a message to the hub on behalf of the client
+func (c *Client) submit(m *Message) {
+	m.SenderID = c.ID
+	m.DisplayName = c.displayName()
+	m.from = c
+	select {
+	case c.Hub.broadcast <- m:
+	case <-c.Hub.done:
 	}
 }
 
+// displayName returns the current display name of the client
+func (c *Client) displayName() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Name
+}
+
+// setName changes the display name of the client
+func (c *Client) setName(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Name = name
+}
+
 // writePump listens for messages from the hub and writes them to the WebSocket connection
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod) // Create ticker for sending ping messages
@@ -71,28 +262,26 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.Send: // Receive message from the client's send channel
+		case f, ok := <-c.send: // Receive a frame from the client's send channel
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait)) // Set write deadline
-			if !ok {
-				return
-			}
-
-			w, err := c.Conn.NextWriter(websocket.TextMessage) // Get writer for writing message
-			if err != nil {
-				return
-			}
-			w.Write(message) // Write message to the WebSocket connection
-
-			// Write any buffered messages to the WebSocket connection
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.Send)
-			}
-
-			// Close the writer
-			if err := w.Close(); err != nil {
-				return
+			// Write what was already queued along with it, so a burst costs a single wakeup
+		burst:
+			for queued := len(c.send); ; queued-- {
+				if !ok {
+					c.writeClose()
+					return
+				}
+				if err := c.write(f); err != nil {
+					return
+				}
+				if queued <= 0 {
+					break
+				}
+				select {
+				case f, ok = <-c.send:
+				default:
+					break burst // Frames dropped by the backpressure policy in the meantime
+				}
 			}
 		case <-ticker.C: // Periodically send ping messages to the client
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -103,14 +292,75 @@ func (c *Client) writePump() {
 	}
 }
 
+// write sends a frame to the WebSocket connection.
+// Every message is written as its own websocket frame so that clients can parse frames independently.
+func (c *Client) write(f *frame) error {
+	prepared, err := f.message()
+	if err != nil {
+		return c.Conn.WriteMessage(websocket.TextMessage, f.data)
+	}
+	return c.Conn.WritePreparedMessage(prepared)
+}
+
+// writeClose tells the client why the hub closed its send channel, if there is a reason
+func (c *Client) writeClose() {
+	c.lock.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.lock.Unlock()
+	if code != 0 {
+		c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	}
+}
+
 // PeerChatConn creates a new client and manages its lifecycle
-func PeerChatConn(c *websocket.Conn, hub *Hub) {
-	// Create a new client instance
-	client := &Client{Hub: hub, Conn: c, Send: make(chan []byte, 256)}
-	// Register the client with the hub
-	client.Hub.register <- client
+func PeerChatConn(c *websocket.Conn, hub *Hub, info ClientInfo) {
+	client := newClient(hub, info)
+	client.Conn = c
+
+	// Register the client with the hub, unless it has been closed in the meantime
+	if !client.join() {
+		client.disconnect(websocket.CloseGoingAway, "room closed")
+		c.Close()
+		return
+	}
 
 	// Start the client's write and read pumps concurrently
 	go client.writePump()
 	client.readPump()
 }
+
+// newClient creates a client for a participant, its connection is set by the caller
+func newClient(hub *Hub, info ClientInfo) *Client {
+	id := info.ID
+	if id == "" {
+		id = ClientID("")
+	}
+	client := &Client{
+		Hub:          hub,
+		send:         make(chan *frame, hub.config.Fanout.QueueSize),
+		ID:           id,
+		Name:         cleanName(info.Name, id),
+		Role:         info.Role,
+		Version:      info.Version,
+		IP:           info.IP,
+		cursor:       info.Cursor,
+		directCursor: info.DirectCursor,
+	}
+	if hub.IsHost(id) {
+		client.Role = RoleHost
+	}
+	if client.Version > ProtocolVersion {
+		client.Version = ProtocolVersion
+	}
+	return client
+}
+
+// join registers the client with the hub, it reports false if the hub has been closed
+func (c *Client) join() bool {
+	select {
+	case c.Hub.register <- c:
+		return true
+	case <-c.Hub.done:
+		return false
+	}
+}
@@ -0,0 +1,331 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command is a slash command handled on the server instead of being broadcast as text
+type Command struct {
+	Name    string                          // Name typed after the slash, e.g. "nick"
+	Usage   string                          // Short usage line shown by /help
+	Help    string                          // One sentence describing the command
+	Allowed func(c *Client) bool            // Permission check, nil allows everyone
+	Run     func(ctx *CommandContext) error // Executes the command, a returned error is sent back to the client
+}
+
+// CommandContext is passed to a command when a client runs it
+type CommandContext struct {
+	Client *Client // Client that issued the command
+	Hub    *Hub    // Hub the client is connected to
+	Args   string  // Text after the command name, trimmed
+}
+
+// Reply sends a private message to the client that issued the command
+func (ctx *CommandContext) Reply(text string) {
+	ctx.Client.notify(KindSystem, text)
+}
+
+// Submit sends a message to the hub as if the client had sent it.
+// The filters of the room apply like they do to typed messages, a rejection is returned.
+func (ctx *CommandContext) Submit(m *Message) error {
+	if reject := ctx.Hub.applyFilters(m); reject != nil {
+		return reject
+	}
+	ctx.Client.submit(m)
+	return nil
+}
+
+// Registry of slash commands shared by every hub
+var (
+	commandsLock sync.RWMutex
+	commands     = map[string]*Command{}
+)
+
+// RegisterCommand adds a slash command, other packages may use it to extend the chat
+func RegisterCommand(cmd *Command) error {
+	name := strings.ToLower(cmd.Name)
+	if name == "" || strings.ContainsAny(name, " /") || cmd.Run == nil {
+		return fmt.Errorf("chat: invalid command %q", cmd.Name)
+	}
+
+	commandsLock.Lock()
+	defer commandsLock.Unlock()
+	if _, ok := commands[name]; ok {
+		return fmt.Errorf("chat: command /%s is already registered", name)
+	}
+	commands[name] = cmd
+	return nil
+}
+
+// Commands returns the registered commands sorted by name
+func Commands() []*Command {
+	commandsLock.RLock()
+	defer commandsLock.RUnlock()
+
+	list := make([]*Command, 0, len(commands))
+	for _, cmd := range commands {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// HostOnly is a permission check that only lets room hosts run a command
+func HostOnly(c *Client) bool {
+	return c.Hub.IsHost(c.ID)
+}
+
+// runCommand handles a slash command typed by the client and reports whether the text was one.
+// A doubled slash escapes a message that really starts with a slash.
+func (c *Client) runCommand(text string) bool {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return false
+	}
+
+	name, args, _ := strings.Cut(text[1:], " ")
+	commandsLock.RLock()
+	cmd := commands[strings.ToLower(name)]
+	commandsLock.RUnlock()
+
+	ctx := &CommandContext{Client: c, Hub: c.Hub, Args: strings.TrimSpace(args)}
+	switch {
+	case cmd == nil:
+		ctx.Reply("Unknown command /" + name + ", type /help for a list of commands.")
+	case cmd.Allowed != nil && !cmd.Allowed(c):
+		ctx.Reply("You are not allowed to use /" + cmd.Name + ".")
+	default:
+		var reject *RejectError
+		if err := cmd.Run(ctx); errors.As(err, &reject) {
+			c.notify(KindRejected, reject.Reason)
+		} else if err != nil {
+			ctx.Reply(err.Error())
+		}
+	}
+	return true
+}
+
+// init registers the built-in commands
+func init() {
+	for _, cmd := range []*Command{
+		{Name: "help", Usage: "/help", Help: "List the available commands.", Run: helpCommand},
+		{Name: "nick", Usage: "/nick <name>", Help: "Change your display name.", Run: nickCommand},
+		{Name: "me", Usage: "/me <action>", Help: "Describe what you are doing.", Run: meCommand},
+		{Name: "topic", Usage: "/topic [topic]", Help: "Show the room topic, hosts can change it.", Run: topicCommand},
+		{Name: "pin", Usage: "/pin <message id>", Help: "Pin a message for everyone.", Allowed: HostOnly, Run: pinCommand(KindPin)},
+		{Name: "unpin", Usage: "/unpin <message id>", Help: "Unpin a message.", Allowed: HostOnly, Run: pinCommand(KindUnpin)},
+		{Name: "poll", Usage: "/poll [multi] [anon] [duration] <question> | <option> | <option>...", Help: "Start a poll, for example /poll anon 5m Lunch? | Pizza | Sushi.", Run: pollCommand},
+		{Name: "vote", Usage: "/vote <poll id> [option number]...", Help: "Vote in a poll, without options your vote is withdrawn.", Run: voteCommand},
+		{Name: "endpoll", Usage: "/endpoll <poll id>", Help: "Close a poll you started, hosts can close any poll.", Run: endPollCommand},
+		{Name: "qa", Usage: "/qa open|close", Help: "Open or close the Q&A.", Allowed: HostOnly, Run: qaCommand},
+		{Name: "ask", Usage: "/ask <question>", Help: "Ask a question in the Q&A.", Run: askCommand},
+		{Name: "slow", Usage: "/slow <interval>|off", Help: "Set the time participants wait between messages, for example /slow 30s.", Allowed: HostOnly, Run: slowCommand},
+		{Name: "followers", Usage: "/followers [age]|off", Help: "Only let participants who have been in the room for age, 10 minutes by default, post.", Allowed: HostOnly, Run: followersCommand},
+		{Name: "emoteonly", Usage: "/emoteonly on|off", Help: "Only allow messages made of emoji.", Allowed: HostOnly, Run: policyCommand("emoteonly", func(p *Policy, on bool) { p.EmoteOnly = on })},
+		{Name: "mute", Usage: "/mute <name> [duration]", Help: "Mute a participant, for example /mute Bob 10m.", Allowed: HostOnly, Run: moderationCommand(KindMute)},
+		{Name: "unmute", Usage: "/unmute <name>", Help: "Lift a mute.", Allowed: HostOnly, Run: moderationCommand(KindUnmute)},
+		{Name: "kick", Usage: "/kick <name>", Help: "Disconnect a participant.", Allowed: HostOnly, Run: moderationCommand(KindKick)},
+		{Name: "ban", Usage: "/ban <name>", Help: "Ban a participant from the room.", Allowed: HostOnly, Run: moderationCommand(KindBan)},
+		{Name: "banip", Usage: "/banip <name>", Help: "Ban a participant and everyone sharing its network address.", Allowed: HostOnly, Run: moderationCommand(KindBanIP)},
+		{Name: "unban", Usage: "/unban <name>", Help: "Lift a ban.", Allowed: HostOnly, Run: moderationCommand(KindUnban)},
+	} {
+		if err := RegisterCommand(cmd); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// helpCommand lists the commands the client may use
+func helpCommand(ctx *CommandContext) error {
+	lines := []string{"Available commands:"}
+	for _, cmd := range Commands() {
+		if cmd.Allowed == nil || cmd.Allowed(ctx.Client) {
+			lines = append(lines, cmd.Usage+" - "+cmd.Help)
+		}
+	}
+	ctx.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+// nickCommand asks the hub to rename the client
+func nickCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		return errors.New("Usage: /nick <name>")
+	}
+	return ctx.Submit(&Message{Kind: KindRename, Body: ctx.Args})
+}
+
+// meCommand sends an action message
+func meCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		return errors.New("Usage: /me <action>")
+	}
+	return ctx.Submit(&Message{Kind: KindAction, Body: ctx.Args})
+}
+
+// topicCommand shows the room topic or asks the hub to change it
+func topicCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		if topic := ctx.Hub.Topic(); topic != "" {
+			ctx.Reply("Topic: " + topic)
+		} else {
+			ctx.Reply("No topic is set.")
+		}
+		return nil
+	}
+	if !HostOnly(ctx.Client) {
+		return errors.New("Only hosts can change the topic.")
+	}
+	return ctx.Submit(&Message{Kind: KindTopic, Body: ctx.Args})
+}
+
+// pinCommand builds a command that pins or unpins a message by id
+func pinCommand(kind Kind) func(ctx *CommandContext) error {
+	return func(ctx *CommandContext) error {
+		if ctx.Args == "" {
+			return fmt.Errorf("Usage: /%s <message id>", kind)
+		}
+		return ctx.Submit(&Message{Kind: kind, Ref: ctx.Args})
+	}
+}
+
+// pollCommand starts a poll, options before the question choose multiple choice, anonymous voting and a close time
+func pollCommand(ctx *CommandContext) error {
+	parts := strings.Split(ctx.Args, "|")
+	if len(parts) < 3 {
+		return errors.New("Usage: /poll [multi] [anon] [duration] <question> | <option> | <option>...")
+	}
+
+	poll := &Poll{}
+	m := &Message{Kind: KindPoll, Poll: poll}
+	words := strings.Fields(parts[0])
+	for len(words) > 0 {
+		if words[0] == "multi" {
+			poll.Multiple = true
+		} else if words[0] == "anon" {
+			poll.Anonymous = true
+		} else if d, err := time.ParseDuration(words[0]); err == nil && d > 0 {
+			m.Duration = int(d / time.Second)
+		} else {
+			break
+		}
+		words = words[1:]
+	}
+	m.Body = strings.Join(words, " ")
+	for _, option := range parts[1:] {
+		poll.Options = append(poll.Options, PollOption{Text: strings.TrimSpace(option)})
+	}
+	return ctx.Submit(m)
+}
+
+// voteCommand votes for options of a poll, numbered from 1 like they are shown
+func voteCommand(ctx *CommandContext) error {
+	args := strings.Fields(ctx.Args)
+	if len(args) == 0 {
+		return errors.New("Usage: /vote <poll id> [option number]...")
+	}
+
+	choices := []int{}
+	for _, arg := range args[1:] {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Unknown poll option %s.", arg)
+		}
+		choices = append(choices, n-1)
+	}
+	return ctx.Submit(&Message{Kind: KindVote, Ref: args[0], Choices: choices})
+}
+
+// endPollCommand closes a poll early
+func endPollCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		return errors.New("Usage: /endpoll <poll id>")
+	}
+	return ctx.Submit(&Message{Kind: KindPollClose, Ref: ctx.Args})
+}
+
+// qaCommand opens or closes the Q&A
+func qaCommand(ctx *CommandContext) error {
+	if ctx.Args != "open" && ctx.Args != "close" {
+		return errors.New("Usage: /qa open|close")
+	}
+	return ctx.Submit(&Message{Kind: KindQA, Body: ctx.Args})
+}
+
+// askCommand sends a question to the Q&A queue instead of the chat
+func askCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		return errors.New("Usage: /ask <question>")
+	}
+	return ctx.Submit(&Message{Kind: KindQuestion, Body: ctx.Args})
+}
+
+// slowCommand switches slow mode on with the given interval, or off
+func slowCommand(ctx *CommandContext) error {
+	policy := ctx.Hub.Policy()
+	if ctx.Args == "off" {
+		policy.SlowMode = 0
+	} else if d, err := time.ParseDuration(ctx.Args); err == nil && d >= time.Second {
+		policy.SlowMode = int(d / time.Second)
+	} else {
+		return errors.New("Usage: /slow <interval>|off, for example /slow 30s")
+	}
+	return ctx.Submit(&Message{Kind: KindPolicy, Policy: &policy})
+}
+
+// followersCommand switches followers-only mode on with an optional minimum age, or off
+func followersCommand(ctx *CommandContext) error {
+	policy := ctx.Hub.Policy()
+	switch ctx.Args {
+	case "off":
+		policy.FollowersOnly, policy.FollowerAge = false, 0
+	case "":
+		policy.FollowersOnly, policy.FollowerAge = true, int(defaultFollowerAge/time.Second)
+	default:
+		d, err := time.ParseDuration(ctx.Args)
+		if err != nil || d < time.Second {
+			return errors.New("Usage: /followers [age]|off, for example /followers 10m")
+		}
+		policy.FollowersOnly, policy.FollowerAge = true, int(d/time.Second)
+	}
+	return ctx.Submit(&Message{Kind: KindPolicy, Policy: &policy})
+}
+
+// policyCommand builds a command switching one of the posting rules on or off
+func policyCommand(name string, set func(p *Policy, on bool)) func(ctx *CommandContext) error {
+	return func(ctx *CommandContext) error {
+		if ctx.Args != "on" && ctx.Args != "off" {
+			return fmt.Errorf("Usage: /%s on|off", name)
+		}
+		policy := ctx.Hub.Policy()
+		set(&policy, ctx.Args == "on")
+		return ctx.Submit(&Message{Kind: KindPolicy, Policy: &policy})
+	}
+}
+
+// moderationCommand builds a command that sends a moderation request aimed at a participant by name.
+// A trailing duration such as 10m is used as the length of a mute.
+func moderationCommand(kind Kind) func(ctx *CommandContext) error {
+	return func(ctx *CommandContext) error {
+		name := ctx.Args
+		var duration time.Duration
+		if kind == KindMute {
+			if i := strings.LastIndex(name, " "); i > 0 {
+				if d, err := time.ParseDuration(name[i+1:]); err == nil {
+					name, duration = strings.TrimSpace(name[:i]), d
+				}
+			}
+		}
+
+		id := ctx.Hub.findMember(name)
+		if id == "" {
+			return fmt.Errorf("Nobody called %q is in this room.", name)
+		}
+		return ctx.Submit(&Message{Kind: kind, Target: id, Duration: int(duration.Seconds())})
+	}
+}
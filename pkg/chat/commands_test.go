@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// newTestHub creates a hub that is not running, messages submitted to it wait in its broadcast channel
+func newTestHub(t *testing.T, config Config) *Hub {
+	t.Helper()
+	config.History = nil
+	return NewHub("test", config)
+}
+
+// received decodes the frames waiting in the send channel of a client
+func received(t *testing.T, c *Client) []*Message {
+	t.Helper()
+	var messages []*Message
+	for {
+		select {
+		case f := <-c.send:
+			m := &Message{}
+			if err := json.Unmarshal(f.data, m); err != nil {
+				t.Fatalf("decoding frame %s: %v", f.data, err)
+			}
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestCommandsApplyFilters(t *testing.T) {
+	config := DefaultConfig()
+	config.Filters = func(room string) []Filter {
+		return []Filter{&LengthFilter{Max: 40}, NewProfanityFilter([]string{"darn"})}
+	}
+
+	tests := []struct {
+		name     string
+		command  string
+		kind     Kind   // Kind of the message submitted, empty if none should be
+		body     string // Body of the submitted message after the filters
+		rejected bool   // Whether the sender is told the message was rejected
+	}{
+		{"action masked", "/me says darn it", KindAction, "says **** it", false},
+		{"rename masked", "/nick Darn", KindRename, "****", false},
+		{"question masked", "/ask why darn?", KindQuestion, "why ****?", false},
+		{"action too long", "/me " + strings.Repeat("a", 50), "", "", true},
+		{"question too long", "/ask " + strings.Repeat("a", 50), "", "", true},
+		{"clean action", "/me waves", KindAction, "waves", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHub(t, config)
+			c := newClient(h, ClientInfo{ID: "alice", Name: "alice", Version: ProtocolVersion})
+			if !c.runCommand(test.command) {
+				t.Fatalf("%q was not run as a command", test.command)
+			}
+
+			select {
+			case m := <-h.broadcast:
+				if m.Kind != test.kind || m.Body != test.body {
+					t.Errorf("submitted %s %q, want %s %q", m.Kind, m.Body, test.kind, test.body)
+				}
+			default:
+				if test.kind != "" {
+					t.Errorf("nothing submitted, want %s %q", test.kind, test.body)
+				}
+			}
+
+			rejected := false
+			for _, m := range received(t, c) {
+				rejected = rejected || m.Kind == KindRejected
+			}
+			if rejected != test.rejected {
+				t.Errorf("rejected = %v, want %v", rejected, test.rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package chat
+
+import "time"
+
+// Config holds the settings applied to every hub created by the server
+type Config struct {
+	History     func(room string) (History, error) // Opens the history store of a room, nil disables history
+	ReplayLimit int                                // Number of recent messages replayed to a joining client
+	RateLimit   *RateLimit                         // Flood protection, nil disables it
+	Filters     func(room string) []Filter         // Builds the content filters of a room, nil applies none
+
+	Attachments      AttachmentStore  // Storage of uploaded files, nil disables attachments
+	AttachmentLimits AttachmentLimits // Size and type limits of uploaded files
+	Broker           Broker           // Shares the rooms with other server replicas, nil keeps them in this process
+	Webhooks         *Webhooks        // Outgoing and incoming webhooks, nil disables both
+	Fanout           Fanout           // Delivery of messages to the clients of a hub
+}
+
+// DefaultConfig returns the settings used when the server is not configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		History: func(room string) (History, error) {
+			return NewMemoryHistory(500), nil
+		},
+		ReplayLimit: 50,
+		RateLimit: &RateLimit{
+			Rate:            1,
+			Burst:           5,
+			IPRate:          5,
+			IPBurst:         20,
+			IPConnections:   50,
+			MuteAfter:       3,
+			MuteFor:         30 * time.Second,
+			DisconnectAfter: 10,
+			Forgive:         time.Minute, // Zero would keep violations for the life of the room
+		},
+		AttachmentLimits: AttachmentLimits{
+			MaxSize: 10 << 20,
+			Types:   DefaultAttachmentTypes,
+		},
+		Fanout: DefaultFanout(),
+	}
+}
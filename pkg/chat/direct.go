@@ -0,0 +1,61 @@
+package chat
+
+import "log"
+
+const (
+	maxRecipients       = 20   // Maximum number of recipients of a private message
+	privateReplayWindow = 1000 // Number of recent private messages scanned when a client joins
+)
+
+// sendDirect delivers a private message to its recipients and to the sender's other connections
+func (h *Hub) sendDirect(m *Message) {
+	// Keep each known recipient once, ignoring the sender itself
+	seen := map[string]bool{m.SenderID: true}
+	var to []string
+	for _, id := range m.To {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if h.members[id] == nil {
+			m.from.notify(KindWarning, "Unknown recipient "+id+".")
+			return
+		}
+		to = append(to, id)
+	}
+	if len(to) == 0 {
+		m.from.notify(KindWarning, "A private message needs at least one recipient.")
+		return
+	}
+	if len(to) > maxRecipients {
+		m.from.notify(KindWarning, "Too many recipients for a private message.")
+		return
+	}
+	m.To = to
+
+	h.stamp(m)
+	if h.direct != nil {
+		if err := h.direct.Append(m); err != nil {
+			log.Printf("error storing private chat message in room %s: %v", h.Room, err)
+		}
+	}
+
+	// Deliver to every connection of the sender and of each recipient
+	h.deliverTo(m, append([]string{m.SenderID}, to...))
+}
+
+// deliverTo sends a message to every connection of the given participants, on every replica
+func (h *Hub) deliverTo(m *Message, ids []string) {
+	h.deliverLocal(m, ids)
+	h.publish(m, ids)
+}
+
+// deliverLocal sends a message to the connections of some participants on this hub
+func (h *Hub) deliverLocal(m *Message, ids []string) {
+	for _, id := range ids {
+		for client := range h.byID[id] {
+			// Queued behind the messages sent to the whole room before
+			h.unicast(client, client.encode(m))
+		}
+	}
+}
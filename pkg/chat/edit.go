@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// lookup finds a stored message in the public or the private history
+func (h *Hub) lookup(id string) (History, *Message) {
+	for _, store := range []History{h.history, h.direct} {
+		if store == nil {
+			continue
+		}
+		if m, err := store.Get(id); err == nil {
+			return store, m
+		} else if err != ErrMessageNotFound {
+			log.Printf("error reading chat history of room %s: %v", h.Room, err)
+		}
+	}
+	return nil, nil
+}
+
+// changeMessage edits or deletes a stored message on behalf of its author, or deletes it on behalf of a host.
+// Private messages can only be changed by the people they were sent between.
+// The previous text is kept in the message's revisions so moderators can see what was changed.
+func (h *Hub) changeMessage(m *Message) {
+	store, original := h.lookup(m.Ref)
+	if original == nil || original.Deleted || (original.Kind != KindText && original.Kind != KindAction && original.Kind != KindDirect) ||
+		!original.visibleTo(m.SenderID) {
+		m.from.notify(KindWarning, "Unknown message "+m.Ref+".")
+		return
+	}
+	if original.SenderID != m.SenderID {
+		// Hosts moderate other people's messages by removing them, they never put words in someone's mouth
+		if !h.IsHost(m.SenderID) {
+			m.from.notify(KindWarning, "You can only change your own messages.")
+			return
+		}
+		if m.Kind == KindEdit {
+			m.from.notify(KindWarning, "You can only edit your own messages, hosts can delete the messages of others.")
+			return
+		}
+	}
+	if m.Kind == KindEdit && m.Body == "" {
+		m.from.notify(KindWarning, "An edit needs a new text, delete the message instead.")
+		return
+	}
+
+	now := time.Now().UTC()
+	if m.Kind == KindEdit {
+		h.render(m)
+	}
+	updated, err := store.Update(m.Ref, func(stored *Message) {
+		stored.Revisions = append(stored.Revisions, Revision{Body: stored.Body, Time: now, By: m.SenderID})
+		if m.Kind == KindDelete {
+			stored.Deleted = true
+			stored.Body = ""
+			stored.HTML = ""
+			stored.Mentions = nil
+			return
+		}
+		stored.Body = m.Body
+		stored.HTML = m.HTML
+		stored.Mentions = m.Mentions
+		stored.EditedAt = &now
+	})
+	if err != nil {
+		log.Printf("error changing chat message %s in room %s: %v", m.Ref, h.Room, err)
+		m.from.notify(KindWarning, "The message could not be changed.")
+		return
+	}
+
+	// Tell the clients that can see the message about the new version or the tombstone
+	event := h.event(&Message{
+		Kind:        m.Kind,
+		Ref:         m.Ref,
+		Body:        updated.Body,
+		HTML:        updated.HTML,
+		Mentions:    updated.Mentions,
+		SenderID:    m.SenderID,
+		DisplayName: m.DisplayName,
+		EditedAt:    updated.EditedAt,
+		To:          updated.To,
+	})
+	if len(updated.To) > 0 {
+		h.deliverTo(event, append([]string{updated.SenderID}, updated.To...))
+	} else {
+		h.fanout(event)
+	}
+
+	// Pinned messages are shown from the room state, which follows their changes
+	if h.isPinned(m.Ref) {
+		if m.Kind == KindDelete {
+			h.unpinDeleted(m.Ref)
+		}
+		h.fanoutLocal(h.roomState(), "") // The other replicas refresh their own when they apply the change
+	}
+
+	// Hosts deleting other people's messages is a moderation action
+	if original.SenderID != m.SenderID {
+		h.audit(AuditDelete, original.SenderID, original.DisplayName, "", m.SenderID, "message "+m.Ref)
+		if len(updated.To) == 0 {
+			h.announce(fmt.Sprintf("A message by %s was deleted by %s.", original.DisplayName, m.DisplayName))
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package chat
+
+import "testing"
+
+func TestChangeMessagePermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		by      string // Who asks for the change, "host" is a host of the room
+		kind    Kind
+		ref     string // "public" by alice, or "direct" from alice to bob
+		changed bool
+	}{
+		{"author edits", "alice", KindEdit, "public", true},
+		{"author deletes", "alice", KindDelete, "public", true},
+		{"other edits", "bob", KindEdit, "public", false},
+		{"other deletes", "bob", KindDelete, "public", false},
+		{"host edits", "host", KindEdit, "public", false},
+		{"host deletes", "host", KindDelete, "public", true},
+		{"author edits direct", "alice", KindEdit, "direct", true},
+		{"recipient edits direct", "bob", KindEdit, "direct", false},
+		{"host edits direct", "host", KindEdit, "direct", false},
+		{"host deletes direct", "host", KindDelete, "direct", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHub(t, DefaultConfig())
+			h.history = NewMemoryHistory(10)
+			h.direct = NewMemoryHistory(10)
+			h.mod.hosts["host"] = true
+			h.history.Append(&Message{ID: "public", Kind: KindText, Body: "hello", SenderID: "alice", DisplayName: "alice"})
+			h.direct.Append(&Message{ID: "direct", Kind: KindDirect, Body: "psst", SenderID: "alice", DisplayName: "alice", To: []string{"bob"}})
+
+			c := newClient(h, ClientInfo{ID: test.by, Name: test.by, Version: ProtocolVersion})
+			h.changeMessage(&Message{Kind: test.kind, Ref: test.ref, Body: "changed", SenderID: c.ID, DisplayName: c.Name, from: c})
+
+			_, stored := h.lookup(test.ref)
+			if stored == nil {
+				t.Fatalf("message %s is gone", test.ref)
+			}
+			if changed := len(stored.Revisions) > 0; changed != test.changed {
+				t.Errorf("changed = %v, want %v", changed, test.changed)
+			}
+			if !test.changed {
+				for _, m := range received(t, c) {
+					if m.Kind != KindWarning {
+						t.Errorf("got %s %q, want only a warning", m.Kind, m.Body)
+					}
+				}
+			}
+		})
+	}
+}
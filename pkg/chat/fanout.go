@@ -0,0 +1,354 @@
+package chat
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Backpressure is what the hub does when a client cannot keep up with the room
+type Backpressure string
+
+// Backpressure policies
+const (
+	BackpressureDisconnect Backpressure = "disconnect"  // Disconnect the client, it catches up from history when it reconnects
+	BackpressureDropNewest Backpressure = "drop-newest" // Keep the queued frames and drop the new one
+	BackpressureDropOldest Backpressure = "drop-oldest" // Drop the oldest queued frame to make room for the new one
+)
+
+// Fanout configures how the hub delivers messages to its clients
+type Fanout struct {
+	Shards    int          // Goroutines delivering messages, each to its own share of the clients
+	BatchSize int          // Most messages handed to the shards at once during a burst
+	QueueSize int          // Frames buffered per client
+	Policy    Backpressure // What happens when the buffer of a client is full
+
+	// Most participants listed in the roster. Beyond it viewers are only counted, and their
+	// arrivals and departures are not announced, so a large audience does not flood the room.
+	RosterLimit int
+}
+
+// DefaultFanout returns the fanout settings used when the server is not configured otherwise
+func DefaultFanout() Fanout {
+	return Fanout{
+		Shards:    runtime.NumCPU(),
+		BatchSize: 64,
+		QueueSize: 256,
+		Policy:    BackpressureDisconnect,
+
+		RosterLimit: 200,
+	}
+}
+
+// FanoutStats counts the work of a hub's fanout since it started
+type FanoutStats struct {
+	Clients   int    `json:"clients"`   // Open connections
+	Shards    int    `json:"shards"`    // Goroutines delivering messages
+	Messages  uint64 `json:"messages"`  // Messages sent to the whole room
+	Batches   uint64 `json:"batches"`   // Hand-offs of messages to the shards
+	Delivered uint64 `json:"delivered"` // Frames queued for clients
+	Dropped   uint64 `json:"dropped"`   // Frames dropped by the backpressure policy
+	Evicted   uint64 `json:"evicted"`   // Clients disconnected for being too slow
+}
+
+// fanoutStats are the counters behind FanoutStats, updated atomically
+type fanoutStats struct {
+	messages  uint64
+	batches   uint64
+	delivered uint64
+	dropped   uint64
+	evicted   uint64
+}
+
+// frame is an encoded message shared by every client it is delivered to
+type frame struct {
+	data     []byte                     // Encoded message
+	once     sync.Once                  // Prepares the websocket message once
+	prepared *websocket.PreparedMessage // Websocket framing of data, built by the first connection writing it
+	err      error                      // Why the websocket message could not be prepared
+}
+
+// newFrame wraps encoded data, nil data gives a nil frame
+func newFrame(data []byte) *frame {
+	if data == nil {
+		return nil
+	}
+	return &frame{data: data}
+}
+
+// message returns the frame as a prepared websocket message, so every connection writing it
+// shares a single framing of the data instead of building its own
+func (f *frame) message() (*websocket.PreparedMessage, error) {
+	f.once.Do(func() {
+		f.prepared, f.err = websocket.NewPreparedMessage(websocket.TextMessage, f.data)
+	})
+	return f.prepared, f.err
+}
+
+// broadcastFrames is a message sent to the whole room, encoded once per protocol version
+type broadcastFrames struct {
+	json   *frame // Frame of clients speaking the versioned protocol
+	legacy *frame // Frame of plain text clients, nil if they cannot show the message
+	except string // Participant whose connections skip the message, empty for none
+}
+
+// shardQueue is the number of work items a shard may fall behind the hub before the hub waits for it
+const shardQueue = 1024
+
+// shard delivers the messages of the room to its share of the clients. With several shards
+// everything concerning its clients goes through its queue, so they get their frames in the
+// order the hub sent them without the hub waiting for the shard.
+type shard struct {
+	hub     *Hub             // Hub the shard belongs to
+	clients map[*Client]bool // Clients of the shard, only used by the shard
+	size    int              // Number of clients of the shard, only used by the hub goroutine
+	work    chan shardWork   // Work to do in order, closed when the hub stops
+	frames  []*frame         // Scratch space for the frames of one client
+}
+
+// shardWork is an item of a shard's queue, only one of its fields is set
+type shardWork struct {
+	batch []*broadcastFrames // Messages for every client of the shard
+	join  *Client            // Client joining the shard
+	leave *Client            // Client leaving the shard
+	to    *Client            // Client receiving frame on its own
+	frame *frame             // Frame for to
+}
+
+// startFanout creates the shards of the hub, with more than one they run on their own goroutines
+func (h *Hub) startFanout() {
+	config := h.config.Fanout
+	if config.Shards < 1 {
+		config.Shards = 1
+	}
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	if config.QueueSize < 1 {
+		config.QueueSize = DefaultFanout().QueueSize
+	}
+	if config.Policy == "" {
+		config.Policy = BackpressureDisconnect
+	}
+	if config.RosterLimit < 1 {
+		config.RosterLimit = DefaultFanout().RosterLimit
+	}
+	h.config.Fanout = config
+
+	h.shards = make([]*shard, config.Shards)
+	for i := range h.shards {
+		h.shards[i] = &shard{hub: h, clients: make(map[*Client]bool)}
+		if config.Shards > 1 {
+			h.shards[i].work = make(chan shardWork, shardQueue)
+			h.shardsRunning.Add(1)
+			go h.shards[i].run(h.shards[i].work)
+		}
+	}
+}
+
+// stopFanout delivers what is pending and waits for the shards to finish, so the clients
+// get everything sent to them before they are disconnected
+func (h *Hub) stopFanout() {
+	h.flush()
+	for _, s := range h.shards {
+		if s.work != nil {
+			close(s.work)
+			s.work = nil
+		}
+	}
+	h.shardsRunning.Wait()
+}
+
+// joinShard adds a client to the least loaded shard
+func (h *Hub) joinShard(client *Client) {
+	best := h.shards[0]
+	for _, s := range h.shards[1:] {
+		if s.size < best.size {
+			best = s
+		}
+	}
+	best.size++
+	client.shard = best
+	best.do(shardWork{join: client})
+}
+
+// leaveShard removes a client from its shard
+func (h *Hub) leaveShard(client *Client) {
+	if client.shard != nil {
+		client.shard.size--
+		client.shard.do(shardWork{leave: client})
+		client.shard = nil
+	}
+}
+
+// unicast sends a frame to one client after the messages for the whole room sent before it.
+// The shard of the client applies the backpressure policy like it does for the room.
+func (h *Hub) unicast(client *Client, data []byte) {
+	if data == nil {
+		return
+	}
+	h.flush()
+	if client.shard == nil {
+		client.deliver(data)
+		return
+	}
+	client.shard.do(shardWork{to: client, frame: newFrame(data)})
+}
+
+// queue adds a message for the whole room to the pending batch, the hub flushes it once the burst is over
+func (h *Hub) queue(m *Message, except string) {
+	f := &broadcastFrames{json: newFrame(encodeJSON(m)), legacy: newFrame(encodeLegacy(m)), except: except}
+	h.pending = append(h.pending, f)
+	atomic.AddUint64(&h.stats.messages, 1)
+	if len(h.pending) >= h.config.Fanout.BatchSize {
+		h.flush()
+	}
+}
+
+// flush hands the pending batch to the shards. A single shard delivers it right away,
+// several shards get it queued and deliver it on their own goroutines.
+func (h *Hub) flush() {
+	if len(h.pending) == 0 {
+		return
+	}
+	batch := h.pending
+	h.pending = nil
+	atomic.AddUint64(&h.stats.batches, 1)
+	for _, s := range h.shards {
+		s.do(shardWork{batch: batch})
+	}
+}
+
+// do carries out a work item, on the shard goroutine if the shard has one
+func (s *shard) do(w shardWork) {
+	if s.work == nil {
+		s.apply(w)
+		return
+	}
+	s.work <- w
+}
+
+// run carries out the queued work until the hub stops, stopFanout then clears s.work
+func (s *shard) run(work <-chan shardWork) {
+	defer s.hub.shardsRunning.Done()
+	for w := range work {
+		s.apply(w)
+	}
+}
+
+// apply carries out a work item
+func (s *shard) apply(w shardWork) {
+	switch {
+	case w.batch != nil:
+		s.deliver(w.batch)
+	case w.join != nil:
+		s.clients[w.join] = true
+	case w.leave != nil:
+		delete(s.clients, w.leave)
+	case w.to != nil:
+		s.frames = append(s.frames[:0], w.frame)
+		s.count(s.offer(w.to))
+	}
+}
+
+// deliver queues the frames of a batch for every client of the shard, applying the backpressure policy
+func (s *shard) deliver(batch []*broadcastFrames) {
+	var delivered, dropped, evicted uint64
+	for client := range s.clients {
+		s.frames = s.frames[:0]
+		for _, b := range batch {
+			if client.ID == b.except {
+				continue
+			}
+			f := b.json
+			if client.Version == 0 {
+				f = b.legacy
+			}
+			if f != nil {
+				s.frames = append(s.frames, f)
+			}
+		}
+		if len(s.frames) > 0 {
+			n, lost, slow := s.offer(client)
+			delivered += n
+			dropped += lost
+			evicted += slow
+		}
+	}
+	s.count(delivered, dropped, evicted)
+}
+
+// offer queues the frames gathered in s.frames for a client, applying the backpressure policy.
+// It returns how many frames were queued and dropped, and 1 if the client was disconnected.
+func (s *shard) offer(client *Client) (delivered, dropped, evicted uint64) {
+	n, lost, slow := client.offer(s.frames, s.hub.config.Fanout.Policy)
+	if slow {
+		// The client unregisters once its connection is closed, like after any other disconnect
+		evicted = 1
+		log.Printf("disconnecting chat client %s of room %s: too slow, %d frames queued", client.ID, s.hub.Room, len(client.send))
+		client.close(websocket.CloseTryAgainLater, "too slow")
+	}
+	return uint64(n), uint64(lost), evicted
+}
+
+// count adds to the fanout counters of the hub
+func (s *shard) count(delivered, dropped, evicted uint64) {
+	atomic.AddUint64(&s.hub.stats.delivered, delivered)
+	atomic.AddUint64(&s.hub.stats.dropped, dropped)
+	atomic.AddUint64(&s.hub.stats.evicted, evicted)
+}
+
+// offer queues frames for the client under a single lock, applying the backpressure policy once
+// its buffer is full. It returns how many frames were queued and dropped, and whether the client
+// is too slow and has to be disconnected.
+func (c *Client) offer(frames []*frame, policy Backpressure) (delivered, dropped int, slow bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, 0, false
+	}
+	for _, f := range frames {
+		select {
+		case c.send <- f:
+			delivered++
+			continue
+		default:
+		}
+
+		switch policy {
+		case BackpressureDropNewest:
+			dropped++
+		case BackpressureDropOldest:
+			select {
+			case <-c.send:
+				dropped++
+			default:
+			}
+			select {
+			case c.send <- f:
+				delivered++
+			default:
+				dropped++
+			}
+		default:
+			return delivered, dropped, true
+		}
+	}
+	return delivered, dropped, false
+}
+
+// FanoutStats returns the fanout counters of the hub
+func (h *Hub) FanoutStats() FanoutStats {
+	return FanoutStats{
+		Clients:   h.ClientCount(),
+		Shards:    h.config.Fanout.Shards,
+		Messages:  atomic.LoadUint64(&h.stats.messages),
+		Batches:   atomic.LoadUint64(&h.stats.batches),
+		Delivered: atomic.LoadUint64(&h.stats.delivered),
+		Dropped:   atomic.LoadUint64(&h.stats.dropped),
+		Evicted:   atomic.LoadUint64(&h.stats.evicted),
+	}
+}
@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Size of the room and of the burst in the fanout benchmarks
+const (
+	benchClients = 10000
+	benchBurst   = 100
+)
+
+// newBenchHub creates a hub that is not running with a room full of viewers without connections,
+// the benchmark plays the hub goroutine
+func newBenchHub(b *testing.B, fanout Fanout) *Hub {
+	config := DefaultConfig()
+	config.History = nil
+	config.Fanout = fanout
+	h := NewHub("bench", config)
+	for i := 0; i < benchClients; i++ {
+		// Joined without h.add, so their queues are not filled with the presence of the others
+		client := newClient(h, ClientInfo{ID: fmt.Sprintf("%032x", i), Name: fmt.Sprintf("viewer%d", i), Role: RoleViewer, Version: ProtocolVersion})
+		h.clients[client] = true
+		h.joinShard(client)
+	}
+	b.Cleanup(h.stopFanout)
+	return h
+}
+
+// drain empties the send channels of every client
+func drain(h *Hub) {
+	for client := range h.clients {
+		for len(client.send) > 0 {
+			<-client.send
+		}
+	}
+}
+
+// oldFanout is how the hub delivered a message before the shards: encoded once per protocol
+// version and queued for every client in turn on the hub goroutine
+func oldFanout(h *Hub, m *Message) {
+	encoded := encodeJSON(m)
+	legacy := encodeLegacy(m)
+	for client := range h.clients {
+		data := encoded
+		if client.Version == 0 {
+			data = legacy
+		}
+		client.deliver(data)
+	}
+}
+
+// BenchmarkFanout measures a burst of messages reaching the queues of a room of 10k viewers,
+// with one shard per -cpu. hub-ns/op is the time the hub goroutine is busy, the rest of ns/op
+// is spent by the shards while the hub is free to handle the next messages.
+func BenchmarkFanout(b *testing.B) {
+	burst := make([]*Message, benchBurst)
+	for i := range burst {
+		burst[i] = &Message{Version: ProtocolVersion, ID: fmt.Sprintf("m%d", i), Kind: KindText, Body: fmt.Sprintf("message %d", i), SenderID: "host", DisplayName: "Host"}
+	}
+
+	b.Run("old one client at a time", func(b *testing.B) {
+		h := newBenchHub(b, Fanout{Shards: 1, BatchSize: 1, QueueSize: benchBurst, Policy: BackpressureDisconnect})
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, m := range burst {
+				oldFanout(h, m)
+			}
+			b.StopTimer()
+			drain(h)
+			b.StartTimer()
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N), "hub-ns/op")
+	})
+
+	b.Run("sharded and batched", func(b *testing.B) {
+		h := newBenchHub(b, Fanout{Shards: runtime.GOMAXPROCS(0), BatchSize: 64, QueueSize: benchBurst, Policy: BackpressureDisconnect})
+		var busy time.Duration
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			target := atomic.LoadUint64(&h.stats.delivered) + benchClients*benchBurst
+			start := time.Now()
+			for _, m := range burst {
+				h.queue(m, "")
+			}
+			h.flush()
+			busy += time.Since(start)
+			for atomic.LoadUint64(&h.stats.delivered) < target {
+				runtime.Gosched()
+			}
+			b.StopTimer()
+			drain(h)
+			b.StartTimer()
+		}
+		b.ReportMetric(float64(busy.Nanoseconds())/float64(b.N), "hub-ns/op")
+	})
+}
+
+func TestFlushKeepsOrder(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			config := DefaultConfig()
+			config.Fanout = Fanout{Shards: shards, BatchSize: 2, QueueSize: 64, Policy: BackpressureDisconnect}
+			h := newTestHub(t, config)
+			clients := make([]*Client, 8)
+			for i := range clients {
+				clients[i] = newClient(h, ClientInfo{ID: fmt.Sprintf("%032x", i), Name: fmt.Sprintf("c%d", i), Version: ProtocolVersion})
+				h.add(clients[i])
+			}
+
+			// Messages for the room and for single clients interleaved, every client gets them in order
+			for i := 0; i < 10; i++ {
+				h.queue(h.event(&Message{Kind: KindSystem, Body: fmt.Sprint(i)}), "")
+				if i%3 == 0 {
+					for _, c := range clients {
+						h.unicast(c, c.encode(&Message{Kind: KindWarning, Body: fmt.Sprintf("%d'", i)}))
+					}
+				}
+			}
+			h.stopFanout()
+
+			want := []string{"0", "0'", "1", "2", "3", "3'", "4", "5", "6", "6'", "7", "8", "9", "9'"}
+			for _, c := range clients {
+				var messages []*Message
+				for _, m := range received(t, c) {
+					if m.Kind == KindSystem || m.Kind == KindWarning {
+						messages = append(messages, m) // Skip the presence of the others joining
+					}
+				}
+				if len(messages) != len(want) {
+					t.Fatalf("client %s got %d messages, want %d", c.Name, len(messages), len(want))
+				}
+				for i, m := range messages {
+					if m.Body != want[i] {
+						t.Fatalf("client %s got %q as message %d, want %q", c.Name, m.Body, i, want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDirectBackpressure(t *testing.T) {
+	tests := []struct {
+		policy Backpressure
+		want   []string // Bodies left in the queue of the slow client, nil if it is disconnected
+	}{
+		{BackpressureDisconnect, nil},
+		{BackpressureDropNewest, []string{"0", "1"}},
+		{BackpressureDropOldest, []string{"1", "psst"}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			config := DefaultConfig()
+			config.Fanout = Fanout{Shards: 1, BatchSize: 1, QueueSize: 2, Policy: test.policy}
+			h := newTestHub(t, config)
+			slow := newClient(h, ClientInfo{ID: "slow", Name: "slow", Version: ProtocolVersion})
+			h.clients[slow] = true
+			h.joinShard(slow)
+			h.byID["slow"] = map[*Client]bool{slow: true}
+			for i := 0; i < 2; i++ {
+				slow.deliver(slow.encode(&Message{Kind: KindSystem, Body: fmt.Sprint(i)}))
+			}
+
+			h.deliverLocal(&Message{Kind: KindDirect, Body: "psst", SenderID: "alice"}, []string{"slow"})
+			slow.lock.Lock()
+			closed := slow.closed
+			slow.lock.Unlock()
+			if closed != (test.want == nil) {
+				t.Fatalf("closed = %v, want %v", closed, test.want == nil)
+			}
+			if closed {
+				return
+			}
+			var bodies []string
+			for _, m := range received(t, slow) {
+				bodies = append(bodies, m.Body)
+			}
+			if fmt.Sprint(bodies) != fmt.Sprint(test.want) {
+				t.Errorf("queued %v, want %v", bodies, test.want)
+			}
+		})
+	}
+}
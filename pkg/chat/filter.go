@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Filter is a content policy applied to every message a client sends before it reaches the hub.
+// A filter passes a message by returning nil, rewrites it by changing its Body,
+// or rejects it by returning an error created with Reject.
+// Filters run on the goroutines of the sending clients and must be safe for concurrent use.
+type Filter interface {
+	Name() string            // Short name used to toggle the filter
+	Filter(m *Message) error // Applies the policy to a message
+}
+
+// RejectError is returned by a filter that rejects a message
+type RejectError struct {
+	Filter string // Name of the filter that rejected the message
+	Reason string // Explanation sent back to the sender
+}
+
+// Error returns the reason of the rejection
+func (e *RejectError) Error() string {
+	return e.Reason
+}
+
+// Reject creates the error a filter returns to reject a message
+func Reject(filter, reason string) error {
+	return &RejectError{Filter: filter, Reason: reason}
+}
+
+// filterChain holds the filters of a hub and which of them are switched off
+type filterChain struct {
+	lock     sync.RWMutex    // Mutex for the fields below
+	filters  []Filter        // Filters in the order they are applied
+	disabled map[string]bool // Names of filters switched off by a host
+}
+
+// filtered reports whether messages of a kind carry text that goes through the filters
+func (k Kind) filtered() bool {
+	switch k {
+	case KindText, KindAction, KindDirect, KindEdit, KindPoll, KindQuestion, KindTopic, KindRename:
+		return true
+	}
+	return false
+}
+
+// SetFilters replaces the filters applied to the messages of the room
+func (h *Hub) SetFilters(filters []Filter) {
+	h.filters.lock.Lock()
+	defer h.filters.lock.Unlock()
+	h.filters.filters = filters
+}
+
+// EnableFilter switches a filter of the room on or off and reports whether the room has it
+func (h *Hub) EnableFilter(name string, enabled bool) bool {
+	h.filters.lock.Lock()
+	defer h.filters.lock.Unlock()
+
+	for _, f := range h.filters.filters {
+		if f.Name() == name {
+			if enabled {
+				delete(h.filters.disabled, name)
+			} else {
+				h.filters.disabled[name] = true
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// FilterStatus returns the names of the room's filters and whether each is switched on
+func (h *Hub) FilterStatus() map[string]bool {
+	h.filters.lock.RLock()
+	defer h.filters.lock.RUnlock()
+
+	status := make(map[string]bool, len(h.filters.filters))
+	for _, f := range h.filters.filters {
+		status[f.Name()] = !h.filters.disabled[f.Name()]
+	}
+	return status
+}
+
+// applyFilters runs a message through the enabled filters of the room.
+// It returns the rejection of the first filter that refuses the message.
+func (h *Hub) applyFilters(m *Message) *RejectError {
+	if !m.Kind.filtered() {
+		return nil
+	}
+
+	h.filters.lock.RLock()
+	defer h.filters.lock.RUnlock()
+
+	if reject := h.runFilters(m); reject != nil {
+		return reject
+	}
+	// Poll options are shown like the question, each of them goes through the filters on its own
+	if m.Kind == KindPoll && m.Poll != nil {
+		for i := range m.Poll.Options {
+			option := &Message{Kind: m.Kind, Body: m.Poll.Options[i].Text, SenderID: m.SenderID}
+			if reject := h.runFilters(option); reject != nil {
+				return reject
+			}
+			m.Poll.Options[i].Text = option.Body
+		}
+	}
+	return nil
+}
+
+// runFilters runs the body of a message through the enabled filters, the caller holds the filters lock
+func (h *Hub) runFilters(m *Message) *RejectError {
+	for _, f := range h.filters.filters {
+		if h.filters.disabled[f.Name()] {
+			continue
+		}
+		if err := f.Filter(m); err != nil {
+			var reject *RejectError
+			if !errors.As(err, &reject) {
+				reject = &RejectError{Filter: f.Name(), Reason: "Your message could not be checked."}
+			}
+			return reject
+		}
+	}
+	return nil
+}
+
+// init registers the command hosts use to toggle the filters of their room
+func init() {
+	if err := RegisterCommand(&Command{
+		Name:    "filter",
+		Usage:   "/filter [name on|off]",
+		Help:    "Show the message filters of the room or switch one on or off.",
+		Allowed: HostOnly,
+		Run:     filterCommand,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// filterCommand lists the filters of the room or toggles one of them
+func filterCommand(ctx *CommandContext) error {
+	fields := strings.Fields(ctx.Args)
+	if len(fields) == 0 {
+		status := ctx.Hub.FilterStatus()
+		if len(status) == 0 {
+			ctx.Reply("This room has no message filters.")
+			return nil
+		}
+		names := make([]string, 0, len(status))
+		for name, on := range status {
+			state := "off"
+			if on {
+				state = "on"
+			}
+			names = append(names, name+": "+state)
+		}
+		sort.Strings(names)
+		ctx.Reply("Message filters: " + strings.Join(names, ", "))
+		return nil
+	}
+	if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+		return errors.New("Usage: /filter [name on|off]")
+	}
+	if !ctx.Hub.EnableFilter(fields[0], fields[1] == "on") {
+		return errors.New("This room has no filter called " + fields[0] + ".")
+	}
+	ctx.Reply("Filter " + fields[0] + " is now " + fields[1] + ".")
+	return nil
+}
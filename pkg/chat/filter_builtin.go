@@ -0,0 +1,157 @@
+package chat
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// LengthFilter rejects messages longer than a number of characters
+type LengthFilter struct {
+	Max int // Longest accepted message in characters
+}
+
+// Name returns the name of the filter
+func (f *LengthFilter) Name() string { return "length" }
+
+// Filter rejects messages that are too long
+func (f *LengthFilter) Filter(m *Message) error {
+	if utf8.RuneCountInString(m.Body) > f.Max {
+		return Reject(f.Name(), fmt.Sprintf("Messages can be at most %d characters long.", f.Max))
+	}
+	return nil
+}
+
+// ProfanityFilter masks listed words with asterisks
+type ProfanityFilter struct {
+	pattern *regexp.Regexp // Matches any of the listed words as a whole word
+}
+
+// NewProfanityFilter creates a filter masking the given words, matched case-insensitively
+func NewProfanityFilter(words []string) *ProfanityFilter {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return &ProfanityFilter{}
+	}
+	return &ProfanityFilter{pattern: regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)}
+}
+
+// Name returns the name of the filter
+func (f *ProfanityFilter) Name() string { return "profanity" }
+
+// Filter rewrites the message with the listed words masked
+func (f *ProfanityFilter) Filter(m *Message) error {
+	if f.pattern == nil {
+		return nil
+	}
+	m.Body = f.pattern.ReplaceAllStringFunc(m.Body, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+	return nil
+}
+
+// linkPattern matches web links with or without a scheme
+var linkPattern = regexp.MustCompile(`(?i)\b((?:https?://|www\.)[^\s<>"]+)`)
+
+// LinkFilter rejects messages linking to hosts that are not allowed
+type LinkFilter struct {
+	Allowed []string // Hosts links may point to, including their subdomains, empty blocks every link
+}
+
+// Name returns the name of the filter
+func (f *LinkFilter) Name() string { return "links" }
+
+// Filter rejects messages containing links to hosts that are not allowed
+func (f *LinkFilter) Filter(m *Message) error {
+	for _, link := range linkPattern.FindAllString(m.Body, -1) {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		u, err := url.Parse(link)
+		if err != nil || !f.allowed(strings.ToLower(u.Hostname())) {
+			return Reject(f.Name(), "Links to other sites are not allowed in this room.")
+		}
+	}
+	return nil
+}
+
+// allowed reports whether a host or one of its parents is in the allow list
+func (f *LinkFilter) allowed(host string) bool {
+	for _, a := range f.Allowed {
+		a = strings.ToLower(a)
+		if host == a || strings.HasSuffix(host, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Patterns of personal data redacted by PIIFilter
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	cardPattern  = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{2,4}\)[ .-]?)?\d{3,4}[ .-]?\d{3,4}(?:[ .-]?\d{2,4})?`)
+)
+
+// PIIFilter redacts e-mail addresses, payment card numbers and phone numbers
+type PIIFilter struct{}
+
+// Name returns the name of the filter
+func (f *PIIFilter) Name() string { return "pii" }
+
+// Filter rewrites the message with personal data replaced by placeholders
+func (f *PIIFilter) Filter(m *Message) error {
+	body := emailPattern.ReplaceAllString(m.Body, "[email]")
+	body = cardPattern.ReplaceAllStringFunc(body, func(number string) string {
+		if luhn(number) {
+			return "[card]"
+		}
+		return number
+	})
+	body = phonePattern.ReplaceAllStringFunc(body, func(number string) string {
+		// Require enough digits so that times, dates and short numbers survive
+		if digits(number) >= 9 {
+			return "[phone]"
+		}
+		return number
+	})
+	m.Body = body
+	return nil
+}
+
+// digits counts the digits in a string
+func digits(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// luhn reports whether the digits of a string pass the Luhn checksum used by payment cards
+func luhn(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyFilters(t *testing.T) {
+	config := DefaultConfig()
+	config.Filters = func(room string) []Filter {
+		return []Filter{&LengthFilter{Max: 30}, NewProfanityFilter([]string{"darn", " heck "}), &LinkFilter{Allowed: []string{"example.com"}}, &PIIFilter{}}
+	}
+	poll := func(options ...string) *Poll {
+		p := &Poll{}
+		for _, o := range options {
+			p.Options = append(p.Options, PollOption{Text: o})
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		message *Message
+		body    string   // Body after the filters
+		options []string // Poll options after the filters
+		filter  string   // Filter rejecting the message, empty if it passes
+	}{
+		{"clean", &Message{Kind: KindText, Body: "hello"}, "hello", nil, ""},
+		{"masked whole words only", &Message{Kind: KindText, Body: "Darn, darnation HECK"}, "****, darnation ****", nil, ""},
+		{"too long", &Message{Kind: KindText, Body: strings.Repeat("é", 31)}, "", nil, "length"},
+		{"allowed link", &Message{Kind: KindText, Body: "see docs.example.com/x"}, "see docs.example.com/x", nil, ""},
+		{"other link", &Message{Kind: KindText, Body: "see https://evil.test"}, "", nil, "links"},
+		{"lookalike host", &Message{Kind: KindText, Body: "www.notexample.com"}, "", nil, "links"},
+		{"email redacted", &Message{Kind: KindText, Body: "mail me at a.b@c.org"}, "mail me at [email]", nil, ""},
+		{"card redacted", &Message{Kind: KindText, Body: "4111 1111 1111 1111"}, "[card]", nil, ""},
+		{"short number kept", &Message{Kind: KindText, Body: "order 1234 5678"}, "order 1234 5678", nil, ""},
+		{"phone redacted", &Message{Kind: KindText, Body: "call +1 555 123 4567"}, "call [phone]", nil, ""},
+		{"time kept", &Message{Kind: KindText, Body: "at 10:30 on 2024-05-01"}, "at 10:30 on 2024-05-01", nil, ""},
+		{"topic filtered", &Message{Kind: KindTopic, Body: "darn topic"}, "**** topic", nil, ""},
+		{"votes not filtered", &Message{Kind: KindVote, Body: "darn"}, "darn", nil, ""},
+		{"poll options masked", &Message{Kind: KindPoll, Body: "best?", Poll: poll("darn", "fine")}, "best?", []string{"****", "fine"}, ""},
+		{"poll option with a link", &Message{Kind: KindPoll, Body: "best?", Poll: poll("a", "evil.test www.evil.test")}, "", nil, "links"},
+		{"poll option too long", &Message{Kind: KindPoll, Body: "best?", Poll: poll("a", strings.Repeat("b", 31))}, "", nil, "length"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHub(t, config)
+			reject := h.applyFilters(test.message)
+			if test.filter != "" {
+				if reject == nil || reject.Filter != test.filter {
+					t.Fatalf("applyFilters() = %v, want a rejection by %s", reject, test.filter)
+				}
+				return
+			}
+			if reject != nil {
+				t.Fatalf("applyFilters() rejected the message: %v", reject)
+			}
+			if test.message.Body != test.body {
+				t.Errorf("body %q, want %q", test.message.Body, test.body)
+			}
+			for i, want := range test.options {
+				if got := test.message.Poll.Options[i].Text; got != want {
+					t.Errorf("option %d %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDisabledFilter(t *testing.T) {
+	config := DefaultConfig()
+	config.Filters = func(room string) []Filter { return []Filter{NewProfanityFilter([]string{"darn"})} }
+	h := newTestHub(t, config)
+	if !h.EnableFilter("profanity", false) {
+		t.Fatal("the room has no profanity filter")
+	}
+	m := &Message{Kind: KindText, Body: "darn"}
+	if reject := h.applyFilters(m); reject != nil || m.Body != "darn" {
+		t.Errorf("disabled filter changed the message to %q, %v", m.Body, reject)
+	}
+	if h.EnableFilter("unknown", true) {
+		t.Error("enabled a filter the room does not have")
+	}
+}
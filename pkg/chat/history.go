@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"errors"
+	"sync"
+)
+
+// Errors returned by history stores
+var (
+	ErrUnknownCursor   = errors.New("chat: unknown history cursor")
+	ErrMessageNotFound = errors.New("chat: message not found")
+)
+
+// History stores the messages of a room so they can be replayed to clients that join later
+type History interface {
+	// Append stores a new message at the end of the history
+	Append(m *Message) error
+	// Recent returns up to n of the most recent messages, oldest first
+	Recent(n int) ([]*Message, error)
+	// All returns every stored message, oldest first
+	All() ([]*Message, error)
+	// After returns every message stored after the message with the given id, oldest first
+	After(id string) ([]*Message, error)
+	// Get returns the message with the given id
+	Get(id string) (*Message, error)
+	// Update replaces a stored message by a copy modified by fn and returns the new version
+	Update(id string, fn func(m *Message)) (*Message, error)
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// MemoryHistory keeps the last messages of a room in a fixed size ring buffer
+type MemoryHistory struct {
+	lock     sync.RWMutex // Mutex for the ring buffer
+	messages []*Message   // Ring buffer of messages
+	start    int          // Index of the oldest message
+	count    int          // Number of messages stored
+}
+
+// NewMemoryHistory creates a ring buffer holding up to size messages
+func NewMemoryHistory(size int) *MemoryHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &MemoryHistory{messages: make([]*Message, size)}
+}
+
+// Append stores a message, overwriting the oldest one when the buffer is full
+func (h *MemoryHistory) Append(m *Message) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.count < len(h.messages) {
+		h.messages[(h.start+h.count)%len(h.messages)] = m
+		h.count++
+		return nil
+	}
+	h.messages[h.start] = m
+	h.start = (h.start + 1) % len(h.messages)
+	return nil
+}
+
+// Recent returns up to n of the most recent messages
+func (h *MemoryHistory) Recent(n int) ([]*Message, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if n > h.count {
+		n = h.count
+	}
+	return h.slice(h.count-n, h.count), nil
+}
+
+// All returns every message in the buffer
+func (h *MemoryHistory) All() ([]*Message, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.slice(0, h.count), nil
+}
+
+// After returns the messages stored after the message with the given id
+func (h *MemoryHistory) After(id string) ([]*Message, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for i := h.count - 1; i >= 0; i-- {
+		if h.at(i).ID == id {
+			return h.slice(i+1, h.count), nil
+		}
+	}
+	return nil, ErrUnknownCursor
+}
+
+// Get returns the message with the given id
+func (h *MemoryHistory) Get(id string) (*Message, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for i := h.count - 1; i >= 0; i-- {
+		if m := h.at(i); m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+// Update replaces a message by a modified copy, readers holding the old version are unaffected
+func (h *MemoryHistory) Update(id string, fn func(m *Message)) (*Message, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := h.count - 1; i >= 0; i-- {
+		index := (h.start + i) % len(h.messages)
+		if h.messages[index].ID == id {
+			updated := *h.messages[index]
+			fn(&updated)
+			h.messages[index] = &updated
+			return &updated, nil
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+// Close does nothing for the in-memory store
+func (h *MemoryHistory) Close() error {
+	return nil
+}
+
+// at returns the i-th oldest message, the caller must hold the lock
+func (h *MemoryHistory) at(i int) *Message {
+	return h.messages[(h.start+i)%len(h.messages)]
+}
+
+// slice copies the messages in [from, to) in age order, the caller must hold the lock
+func (h *MemoryHistory) slice(from, to int) []*Message {
+	messages := make([]*Message, 0, to-from)
+	for i := from; i < to; i++ {
+		messages = append(messages, h.at(i))
+	}
+	return messages
+}
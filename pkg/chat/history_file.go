@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// safeFileName matches room ids that can be used as file names unchanged
+var safeFileName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// FileHistory persists the messages of a room to an append-only JSON lines file.
+// Updates append a new version of the message, the last version of each id wins when reading.
+// The most recent messages are also kept in memory so that joins do not read the file.
+type FileHistory struct {
+	lock   sync.Mutex     // Mutex for the file
+	path   string         // Path of the JSON lines file
+	file   *os.File       // File opened for appending
+	recent *MemoryHistory // Cache of the most recent messages
+}
+
+// NewFileHistory opens or creates the history file of a room inside dir.
+// cache is the number of recent messages kept in memory.
+func NewFileHistory(dir, room string, cache int) (*FileHistory, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	h := &FileHistory{
+		path:   filepath.Join(dir, safeName(room)+".jsonl"),
+		recent: NewMemoryHistory(cache),
+	}
+
+	// Warm the cache with the messages already on disk
+	messages, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > cache {
+		messages = messages[len(messages)-cache:]
+	}
+	for _, m := range messages {
+		h.recent.Append(m)
+	}
+
+	h.file, err = os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// safeName maps a room id to a file name that cannot escape the directory it is used in
+func safeName(room string) string {
+	if !safeFileName.MatchString(room) {
+		room = fmt.Sprintf("%x", sha256.Sum256([]byte(room)))
+	}
+	return room
+}
+
+// Append writes a message to the end of the file
+func (h *FileHistory) Append(m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, err := h.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return h.recent.Append(m)
+}
+
+// Recent returns up to n of the most recent messages
+func (h *FileHistory) Recent(n int) ([]*Message, error) {
+	if n <= len(h.recent.messages) {
+		return h.recent.Recent(n)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	messages, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > n {
+		messages = messages[len(messages)-n:]
+	}
+	return messages, nil
+}
+
+// All reads every message from the file
+func (h *FileHistory) All() ([]*Message, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.load()
+}
+
+// After returns the messages stored after the message with the given id.
+// Cursors older than the in-memory cache are resolved by reading the file.
+func (h *FileHistory) After(id string) ([]*Message, error) {
+	if messages, err := h.recent.After(id); err == nil {
+		return messages, nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	messages, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].ID == id {
+			return messages[i+1:], nil
+		}
+	}
+	return nil, ErrUnknownCursor
+}
+
+// Get returns the message with the given id, reading the file if it is older than the cache
+func (h *FileHistory) Get(id string) (*Message, error) {
+	if m, err := h.recent.Get(id); err == nil {
+		return m, nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	messages, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+// Update appends a modified copy of a message to the file
+func (h *FileHistory) Update(id string, fn func(m *Message)) (*Message, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	updated, err := h.recent.Update(id, fn)
+	if err == ErrMessageNotFound {
+		// The message is older than the cache, look it up on disk
+		messages, err := h.load()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range messages {
+			if m.ID == id {
+				updated = m
+				fn(updated)
+				break
+			}
+		}
+		if updated == nil {
+			return nil, ErrMessageNotFound
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.file.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// Close closes the underlying file
+func (h *FileHistory) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.file.Close()
+}
+
+// load reads every message from the file, skipping lines that cannot be decoded.
+// Later versions of a message replace earlier ones while keeping the original position.
+func (h *FileHistory) load() ([]*Message, error) {
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var messages []*Message
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := &Message{}
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			log.Printf("skipping corrupt history line in %s: %v", h.path, err)
+			continue
+		}
+		if i, ok := index[m.ID]; ok {
+			messages[i] = m
+			continue
+		}
+		index[m.ID] = len(messages)
+		messages = append(messages, m)
+	}
+	return messages, scanner.Err()
+}
@@ -1,48 +1,431 @@
 package chat
 
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
 // Hub represents a chat hub that manages clients
 type Hub struct {
-	clients    map[*Client]bool   // Map to store connected clients
-	broadcast  chan []byte        // Channel to broadcast messages to clients
-	register   chan *Client       // Channel to register new clients
-	unregister chan *Client       // Channel to unregister clients
+	Room          string                      // Id of the room the hub belongs to
+	config        Config                      // Settings the hub was created with
+	history       History                     // Store of past messages, nil if history is disabled
+	direct        History                     // Store of private messages, kept apart from the public history
+	clients       map[*Client]bool            // Map to store connected clients
+	byID          map[string]map[*Client]bool // Connected clients by participant id
+	members       map[string]*member          // Every participant seen in the hub, written by Run only
+	membersLock   sync.RWMutex                // Mutex for members, needed by readers outside Run
+	broadcast     chan *Message               // Channel to broadcast messages to clients
+	register      chan *Client                // Channel to register new clients
+	unregister    chan *Client                // Channel to unregister clients
+	ips           ipLimiter                   // Rate limits shared by clients behind the same IP
+	floods        floodTracker                // Flood escalation by participant, kept across reconnects
+	ipConns       map[string]int              // Connections by IP, written by Run only
+	auditLog      auditLog                    // Enforcement actions taken in the hub
+	mod           moderation                  // Hosts, mutes and bans of the room
+	typing        map[string]bool             // Participants currently typing
+	lastRead      map[string]string           // Id of the last message read by each participant
+	pollTimers    map[string]*time.Timer      // Close timers of the polls with a time limit, written by Run only
+	state         roomState                   // Topic of the room
+	qa            qaState                     // Q&A mode and question queue, kept apart from the chat history
+	policy        policyState                 // Posting rules of the room, such as slow mode
+	filters       filterChain                 // Content policies applied to messages before they reach the hub
+	clientCount   int32                       // Number of open connections, read outside Run
+	quit          chan struct{}               // Closed by Close to stop Run
+	done          chan struct{}               // Closed once Run has stopped
+	closeOnce     sync.Once                   // Makes Close idempotent
+	closeReason   string                      // Why the hub was closed, written before quit is closed
+	present       map[string]*presence        // Roster of the room by participant id
+	watchers      map[*PresenceWatch]bool     // Signaling connections following the roster
+	presence      chan presenceChange         // Channel to add and remove signaling connections
+	origin        string                      // Unique id of this hub among the replicas sharing the room
+	relay         chan *relayed               // Messages published by the other replicas of the room
+	relayDropped  int64                       // Messages from other replicas dropped since the last resync
+	outbox        chan []byte                 // Messages waiting to be published to the other replicas
+	outboxDropped int64                       // Messages that did not fit in the outbox since the last report
+	unsubscribe   func()                      // Ends the broker subscription, nil without a broker
+	webhooks      *webhookSender              // Delivers events to the outgoing webhooks, nil without any
+	replays       WebhookReplays              // Signatures of the incoming webhook requests accepted recently
+	shards        []*shard                    // Deliver the room's messages, each to its share of the clients
+	shardsRunning sync.WaitGroup              // Shard goroutines that have not stopped yet
+	pending       []*broadcastFrames          // Messages for the whole room not handed to the shards yet
+	stats         fanoutStats                 // Counters of the fanout
+}
+
+// member is what the hub remembers about a participant after it disconnects
+type member struct {
+	name  string    // Last display name of the participant
+	ip    string    // Last remote address of the participant
+	since time.Time // When the participant first joined the room
 }
 
-// NewHub creates a new instance of Hub
-func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),  // Buffered channel for broadcasting messages
-		register:   make(chan *Client), // Channel for registering new clients
-		unregister: make(chan *Client), // Channel for unregistering clients
-		clients:    make(map[*Client]bool), // Map to store connected clients
+// NewHub creates a new instance of Hub for the given room
+func NewHub(room string, config Config) *Hub {
+	var history, direct History
+	if config.History != nil {
+		var err error
+		if history, err = config.History(room); err != nil {
+			log.Printf("error opening chat history for room %s: %v", room, err)
+		}
+		if direct, err = config.History(room + "-direct"); err != nil {
+			log.Printf("error opening private chat history for room %s: %v", room, err)
+		}
+	}
+
+	h := &Hub{
+		Room:       room,
+		config:     config,
+		history:    history,
+		direct:     direct,
+		broadcast:  make(chan *Message, 256), // Buffered so a busy room does not stall every reader
+		register:   make(chan *Client),       // Channel for registering new clients
+		unregister: make(chan *Client),       // Channel for unregistering clients
+		clients:    make(map[*Client]bool),   // Map to store connected clients
+		byID:       make(map[string]map[*Client]bool),
+		members:    make(map[string]*member),
+		ips:        ipLimiter{buckets: make(map[string]*tokenBucket)},
+		ipConns:    make(map[string]int),
+		floods:     floodTracker{records: make(map[string]*floodRecord)},
+		filters:    filterChain{disabled: make(map[string]bool)},
+		policy:     policyState{lastPost: make(map[string]time.Time)},
+		typing:     make(map[string]bool),
+		lastRead:   make(map[string]string),
+		pollTimers: make(map[string]*time.Timer),
+		quit:       make(chan struct{}),
+		present:    make(map[string]*presence),
+		watchers:   make(map[*PresenceWatch]bool),
+		presence:   make(chan presenceChange),
+		origin:     uuid.New().String(),
+		relay:      make(chan *relayed, relayBuffer),
+		outbox:     make(chan []byte, publishBuffer),
+		done:       make(chan struct{}),
+		mod: moderation{
+			hosts:     make(map[string]bool),
+			muted:     make(map[string]time.Time),
+			banned:    make(map[string]string),
+			bannedIPs: make(map[string]string),
+		},
+	}
+	if config.Filters != nil {
+		h.filters.filters = config.Filters(room)
+	}
+	h.startFanout()
+	if config.Broker != nil {
+		h.subscribe()
+		go h.publishing()
+	}
+	if config.Webhooks != nil && len(config.Webhooks.URLs) > 0 {
+		h.webhooks = newWebhookSender(*config.Webhooks)
 	}
+	return h
 }
 
-// Run starts the chat hub to manage clients
+// Run starts the chat hub to manage clients, it returns once the hub is closed
 func (h *Hub) Run() {
+	defer close(h.done)
 	for {
 		select {
 		case client := <-h.register:
-			// Register new client
-			h.clients[client] = true
+			// Register new client and catch it up with what it missed, after everything sent before it joined
+			if !h.admitFlooder(client) {
+				continue
+			}
+			h.flush()
+			h.add(client)
+			h.welcome(client)
+			client.deliver(client.encode(h.roomState()))
+			client.deliver(client.encode(h.qaState(client.ID, client.Role == RoleHost)))
+			client.deliver(client.encode(h.roster()))
+			h.replay(client)
+			h.sendReadState(client)
+			h.remindFloodMute(client)
 		case client := <-h.unregister:
 			// Unregister client
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.Send)
-			}
+			h.remove(client, 0, "")
 		case message := <-h.broadcast:
-			// Broadcast message to all clients
-			for client := range h.clients {
-				select {
-				case client.Send <- message:
-					// Send message to client
-				default:
-					// If unable to send, close connection and unregister client
-					close(client.Send)
-					delete(h.clients, client)
-				}
-			}
+			h.handle(message)
+		case change := <-h.presence:
+			h.changePresence(change)
+		case r := <-h.relay:
+			h.receive(r)
+		case <-h.quit:
+			h.shutdown()
+			return
+		}
+
+		// Hand the messages of a burst to the shards together once it is over
+		if len(h.broadcast) == 0 && len(h.relay) == 0 {
+			h.resync()
+			h.flush()
+		}
+	}
+}
+
+// add registers a client and indexes it by participant id
+func (h *Hub) add(client *Client) {
+	h.clients[client] = true
+	if client.IP != "" {
+		h.ipConns[client.IP]++
+	}
+	h.joinShard(client)
+	atomic.AddInt32(&h.clientCount, 1)
+	if h.byID[client.ID] == nil {
+		h.byID[client.ID] = make(map[*Client]bool)
+	}
+	h.byID[client.ID][client] = true
+	h.membersLock.Lock()
+	since := time.Now()
+	if known := h.members[client.ID]; known != nil {
+		since = known.since
+	}
+	h.members[client.ID] = &member{name: client.displayName(), ip: client.IP, since: since}
+	h.membersLock.Unlock()
+	h.updatePresence(client.ID, client.displayName(), client.Role, 1, 0)
+}
+
+// IsMember reports whether a participant has joined the room's chat
+func (h *Hub) IsMember(id string) bool {
+	h.membersLock.RLock()
+	defer h.membersLock.RUnlock()
+	return h.members[id] != nil
+}
+
+// memberSince returns when a participant first joined the room, zero if it never did
+func (h *Hub) memberSince(id string) time.Time {
+	h.membersLock.RLock()
+	defer h.membersLock.RUnlock()
+	if m := h.members[id]; m != nil {
+		return m.since
+	}
+	return time.Time{}
+}
+
+// findMember returns the id of the participant with the given name or id, empty if there is none
+func (h *Hub) findMember(name string) string {
+	h.membersLock.RLock()
+	defer h.membersLock.RUnlock()
+
+	if h.members[name] != nil {
+		return name
+	}
+	for id, m := range h.members {
+		if strings.EqualFold(m.name, name) {
+			return id
 		}
 	}
+	return ""
+}
+
+// rename changes the display name of every connection of a participant and announces it
+func (h *Hub) rename(m *Message) {
+	name := cleanName(m.Body, m.SenderID)
+	if other := h.findMember(name); other != "" && other != m.SenderID {
+		m.from.notify(KindWarning, "The name "+name+" is already taken.")
+		return
+	}
+
+	for client := range h.byID[m.SenderID] {
+		client.setName(name)
+	}
+	h.membersLock.Lock()
+	h.members[m.SenderID].name = name
+	h.membersLock.Unlock()
+	h.updatePresence(m.SenderID, name, "", 0, 0)
+	h.announce(fmt.Sprintf("%s is now known as %s.", m.DisplayName, name))
+}
+
+// welcome tells a newly registered client who it is in the room
+func (h *Hub) welcome(client *Client) {
+	client.deliver(client.encode(h.event(&Message{
+		Kind:        KindWelcome,
+		SenderID:    client.ID,
+		DisplayName: client.displayName(),
+		Role:        client.Role,
+	})))
+}
+
+// remove unregisters a client and closes its connection with the given code
+func (h *Hub) remove(client *Client, code int, reason string) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	if client.IP != "" {
+		if h.ipConns[client.IP]--; h.ipConns[client.IP] <= 0 {
+			delete(h.ipConns, client.IP)
+		}
+	}
+	h.leaveShard(client)
+	atomic.AddInt32(&h.clientCount, -1)
+	delete(h.byID[client.ID], client)
+	client.close(code, reason)
+	h.updatePresence(client.ID, "", "", -1, 0)
+	if len(h.byID[client.ID]) == 0 {
+		delete(h.byID, client.ID)
+		h.stopTyping(client.ID)
+	}
+}
+
+// handle processes a message sent by a client according to its kind
+func (h *Hub) handle(m *Message) {
+	switch m.Kind {
+	case KindText, KindAction, KindDirect:
+		if m.from == nil {
+			// Only incoming webhooks post messages without a client
+			h.postWebhook(m)
+			return
+		}
+		if muted := h.mutedFor(m.SenderID); muted > 0 {
+			m.from.notify(KindWarning, fmt.Sprintf("You are muted for another %s.", muted.Round(time.Second)))
+			return
+		}
+		if !h.resolveAttachments(m) {
+			m.from.notify(KindWarning, "Unknown attachment.")
+			return
+		}
+		root, ok := h.resolveParent(m)
+		if !ok {
+			m.from.notify(KindWarning, "Unknown message to reply to.")
+			return
+		}
+		if m.Kind != KindDirect && !h.allowPost(m) {
+			return
+		}
+		h.render(m)
+		if m.Kind == KindDirect {
+			h.sendDirect(m)
+			return
+		}
+		h.stamp(m)
+		h.store(m)
+		if root != nil {
+			h.countReply(root)
+		}
+		h.fanout(m)
+	case KindEdit, KindDelete:
+		h.changeMessage(m)
+	case KindMute, KindUnmute, KindKick, KindBan, KindBanIP, KindUnban:
+		h.moderate(m)
+	case KindReact, KindUnreact:
+		h.react(m)
+	case KindRename:
+		h.rename(m)
+	case KindTopic:
+		h.setTopic(m)
+	case KindPin, KindUnpin:
+		h.pin(m)
+	case KindPoll:
+		h.createPoll(m)
+	case KindVote:
+		h.vote(m)
+	case KindPollClose:
+		h.closePoll(m)
+	case KindPolicy:
+		h.setPolicy(m)
+	case KindQA:
+		h.setQA(m)
+	case KindQuestion:
+		h.ask(m)
+	case KindUpvote, KindUnvote, KindApprove, KindAnswer, KindDismiss:
+		h.updateQuestion(m)
+	case KindTyping, KindTypingStop:
+		h.setTyping(m)
+	case KindRead:
+		h.markRead(m)
+	case KindThread:
+		h.sendThread(m)
+	}
+}
+
+// stamp fills in the fields of a message that only the hub may set
+func (h *Hub) stamp(m *Message) {
+	m.Version = ProtocolVersion
+	m.ID = uuid.New().String()
+	m.Room = h.Room
+	m.Timestamp = time.Now().UTC()
+}
+
+// event stamps a message that is fanned out but never stored, so it carries no id
+func (h *Hub) event(m *Message) *Message {
+	h.stamp(m)
+	m.ID = ""
+	return m
+}
+
+// store appends a message to the history, if the hub keeps one
+func (h *Hub) store(m *Message) {
+	if h.history == nil {
+		return
+	}
+	if err := h.history.Append(m); err != nil {
+		log.Printf("error storing chat message in room %s: %v", h.Room, err)
+	}
+}
+
+// replay sends a newly registered client the public and private messages it has not seen yet
+func (h *Hub) replay(client *Client) {
+	if !h.replayFrom(client, h.history, client.cursor, h.config.ReplayLimit, nil) {
+		return
+	}
+	h.replayFrom(client, h.direct, client.directCursor, privateReplayWindow, func(m *Message) bool {
+		return m.visibleTo(client.ID)
+	})
+}
+
+// replayFrom sends a client the messages of a store that it may see and has not seen yet.
+// Clients resuming from a cursor get everything after it, others get the most recent messages.
+// It reports false if the client's buffer filled up.
+func (h *Hub) replayFrom(client *Client, store History, cursor string, limit int, visible func(*Message) bool) bool {
+	if store == nil {
+		return true
+	}
+
+	var messages []*Message
+	var err error
+	if cursor != "" {
+		messages, err = store.After(cursor)
+	}
+	if cursor == "" || err == ErrUnknownCursor {
+		messages, err = store.Recent(limit)
+	}
+	if err != nil {
+		log.Printf("error reading chat history of room %s: %v", h.Room, err)
+		return true
+	}
+
+	for _, m := range messages {
+		if visible != nil && !visible(m) {
+			continue
+		}
+		if !client.deliver(client.encode(m)) {
+			// Stop replaying once the client's buffer is full, it can resume from the last id it got
+			return false
+		}
+	}
+	return true
+}
+
+// fanout sends a message to all clients, encoding it once per protocol version
+func (h *Hub) fanout(m *Message) {
+	h.fanoutOthers(m, "")
+}
+
+// fanoutOthers sends a message to all clients except the connections of one participant,
+// to the other replicas of the room and to the outgoing webhooks
+func (h *Hub) fanoutOthers(m *Message, except string) {
+	h.fanoutLocal(m, except)
+	h.publish(m, nil)
+	h.hook(m)
+}
+
+// fanoutLocal sends a message to the clients of this hub except the connections of one participant.
+// The message is encoded once per protocol version and delivered by the shards with the rest of its batch.
+func (h *Hub) fanoutLocal(m *Message, except string) {
+	h.queue(m, except)
 }
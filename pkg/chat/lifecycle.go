@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+
+	"github.com/fasthttp/websocket"
+)
+
+// ErrHubClosed is returned when a message is posted to a hub that has been closed
+var ErrHubClosed = errors.New("chat: hub closed")
+
+// Close shuts the hub down, connected clients are told the reason before they are disconnected.
+// Closing a hub twice has no effect.
+func (h *Hub) Close(reason string) {
+	h.closeOnce.Do(func() {
+		h.closeReason = reason
+		close(h.quit)
+	})
+}
+
+// Done returns a channel that is closed once the hub has stopped
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// ClientCount returns the number of open chat connections
+func (h *Hub) ClientCount() int {
+	return int(atomic.LoadInt32(&h.clientCount))
+}
+
+// shutdown disconnects every client and releases the stores of the hub, it runs on the hub goroutine
+func (h *Hub) shutdown() {
+	notice := h.event(&Message{Kind: KindSystem, Body: "The room was closed: " + h.closeReason + "."})
+	h.fanoutLocal(notice, "")
+	h.stopFanout()
+	for id := range h.pollTimers {
+		h.stopPollTimer(id)
+	}
+	h.hook(notice)
+	if h.webhooks != nil {
+		h.webhooks.close()
+	}
+	if h.unsubscribe != nil {
+		h.unsubscribe()
+	}
+	for client := range h.clients {
+		h.remove(client, websocket.CloseGoingAway, h.closeReason)
+	}
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.Events)
+	}
+
+	for _, store := range []History{h.history, h.direct} {
+		if store == nil {
+			continue
+		}
+		if err := store.Close(); err != nil {
+			log.Printf("error closing chat history of room %s: %v", h.Room, err)
+		}
+	}
+	if err := h.RemoveAttachments(); err != nil {
+		log.Printf("error removing chat attachments of room %s: %v", h.Room, err)
+	}
+	log.Printf("chat hub of room %s closed: %s", h.Room, h.closeReason)
+}
@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"html"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxMarkupDepth limits how deeply bold and italic text may be nested
+const maxMarkupDepth = 4
+
+// spanKind is the type of a piece of formatted text
+type spanKind int
+
+// Kinds of formatted text understood by the chat
+const (
+	spanText    spanKind = iota // Plain text
+	spanBold                    // **bold**
+	spanItalic                  // *italic* or _italic_
+	spanCode                    // `code`, never formatted further
+	spanLink                    // [text](url) or a bare http(s) URL
+	spanMention                 // @name of a participant of the room
+)
+
+// span is a piece of a message parsed from the Markdown subset the chat supports
+type span struct {
+	kind     spanKind
+	text     string // Text of plain, code and mention spans
+	url      string // Target of a link, always http, https or mailto
+	id       string // Participant id of a mention
+	children []span // Content of bold, italic and link spans
+}
+
+// markup parses the Markdown subset of chat messages: bold, italics, code, links and mentions.
+// Anything else is kept as text, so every renderer escapes it.
+type markup struct {
+	resolve  func(name string) string // Returns the id of a participant by name, empty if there is none
+	mentions []string                 // Ids of the mentioned participants, in order of appearance
+}
+
+// render parses a message body and sets its safe HTML form and mentions
+func (h *Hub) render(m *Message) {
+	if m.Deleted || m.Body == "" {
+		m.HTML = ""
+		m.Mentions = nil
+		return
+	}
+	p := &markup{resolve: h.findMember}
+	m.HTML = spansHTML(p.parse(m.Body, 0, true))
+	m.Mentions = p.mentions
+}
+
+// parse splits text into spans, links may not contain other links
+func (p *markup) parse(s string, depth int, links bool) []span {
+	var spans []span
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, span{kind: spanText, text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		if sp, n := p.token(s, i, depth, links); n > 0 {
+			flush()
+			spans = append(spans, sp)
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		text.WriteRune(r)
+		i += size
+	}
+	flush()
+	return spans
+}
+
+// token parses the formatted span starting at s[i], it returns its length or 0 if there is none
+func (p *markup) token(s string, i, depth int, links bool) (span, int) {
+	rest := s[i:]
+	switch {
+	case rest[0] == '`':
+		if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+			return span{kind: spanCode, text: rest[1 : end+1]}, end + 2
+		}
+	case strings.HasPrefix(rest, "**") && depth < maxMarkupDepth:
+		if end := strings.Index(rest[2:], "**"); end > 0 {
+			return span{kind: spanBold, children: p.parse(rest[2:end+2], depth+1, links)}, end + 4
+		}
+	case (rest[0] == '*' || rest[0] == '_') && depth < maxMarkupDepth && wordStart(s, i):
+		if end := closingEmphasis(rest, rest[0]); end > 1 {
+			return span{kind: spanItalic, children: p.parse(rest[1:end], depth+1, links)}, end + 1
+		}
+	case rest[0] == '[' && links:
+		if sp, n := p.link(rest, depth); n > 0 {
+			return sp, n
+		}
+	case (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) && links && wordStart(s, i):
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		raw := strings.TrimRight(rest[:end], ".,;:!?)'\"")
+		if target, ok := safeURL(raw); ok {
+			return span{kind: spanLink, url: target, children: []span{{kind: spanText, text: raw}}}, len(raw)
+		}
+	case rest[0] == '@' && wordStart(s, i):
+		end := 1
+		for end < len(rest) {
+			r, size := utf8.DecodeRuneInString(rest[end:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+				break
+			}
+			end += size
+		}
+		name := strings.TrimRight(rest[1:end], ".-")
+		if name == "" || p.resolve == nil {
+			break
+		}
+		if id := p.resolve(name); id != "" {
+			p.mentions = appendUnique(p.mentions, id)
+			return span{kind: spanMention, text: "@" + name, id: id}, len(name) + 1
+		}
+	}
+	return span{}, 0
+}
+
+// link parses [text](url), links to unsafe targets are left as text
+func (p *markup) link(rest string, depth int) (span, int) {
+	mid := strings.Index(rest, "](")
+	if mid < 1 {
+		return span{}, 0
+	}
+	end := strings.IndexByte(rest[mid+2:], ')')
+	if end < 1 {
+		return span{}, 0
+	}
+	target, ok := safeURL(rest[mid+2 : mid+2+end])
+	if !ok {
+		return span{}, 0
+	}
+	return span{kind: spanLink, url: target, children: p.parse(rest[1:mid], depth+1, false)}, mid + end + 3
+}
+
+// closingEmphasis returns the index of the delimiter closing an italic span, skipping bold delimiters
+func closingEmphasis(s string, delim byte) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] != delim {
+			continue
+		}
+		if delim == '*' && i+1 < len(s) && s[i+1] == '*' {
+			i++
+			continue
+		}
+		// Underscores inside words, as in snake_case, do not close
+		if delim == '_' && i+1 < len(s) && isWordByte(s[i+1]) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// wordStart reports whether s[i] starts a word, so that a_b or mail@host are left alone
+func wordStart(s string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// isWordByte reports whether an ASCII byte belongs to a word
+func isWordByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// safeURL returns the normalized form of a link target if its scheme is allowed
+func safeURL(raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return "", false
+		}
+	case "mailto":
+	default:
+		return "", false
+	}
+	return u.String(), true
+}
+
+// appendUnique appends id to ids unless it is already there
+func appendUnique(ids []string, id string) []string {
+	for _, other := range ids {
+		if other == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// spansHTML renders spans as HTML, every piece of text is escaped
+func spansHTML(spans []span) string {
+	var b strings.Builder
+	for _, sp := range spans {
+		switch sp.kind {
+		case spanText:
+			b.WriteString(html.EscapeString(sp.text))
+		case spanBold:
+			b.WriteString("<strong>" + spansHTML(sp.children) + "</strong>")
+		case spanItalic:
+			b.WriteString("<em>" + spansHTML(sp.children) + "</em>")
+		case spanCode:
+			b.WriteString("<code>" + html.EscapeString(sp.text) + "</code>")
+		case spanLink:
+			b.WriteString(`<a href="` + html.EscapeString(sp.url) + `" rel="nofollow noopener noreferrer" target="_blank">` + spansHTML(sp.children) + "</a>")
+		case spanMention:
+			b.WriteString(`<span class="mention" data-id="` + html.EscapeString(sp.id) + `">` + html.EscapeString(sp.text) + "</span>")
+		}
+	}
+	return b.String()
+}
+
+// codeEscaper keeps the text of a code span on its line, so that it cannot start a block such as
+// a heading or a table
+var codeEscaper = strings.NewReplacer("`", "'", "\r\n", " ", "\n", " ", "\r", " ")
+
+// spansMarkdown renders spans as Markdown, text outside the supported subset is escaped
+func spansMarkdown(spans []span) string {
+	var b strings.Builder
+	for _, sp := range spans {
+		switch sp.kind {
+		case spanText:
+			b.WriteString(escapeMarkdown(sp.text))
+		case spanBold:
+			b.WriteString("**" + spansMarkdown(sp.children) + "**")
+		case spanItalic:
+			b.WriteString("*" + spansMarkdown(sp.children) + "*")
+		case spanCode:
+			b.WriteString("`" + codeEscaper.Replace(sp.text) + "`")
+		case spanLink:
+			b.WriteString("[" + spansMarkdown(sp.children) + "](<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(sp.url) + ">)")
+		case spanMention:
+			b.WriteString("**" + escapeMarkdown(sp.text) + "**")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package chat
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMembers resolves the names of the participants mentioned in the tests
+func testMembers(name string) string {
+	return map[string]string{"bob": "u2", "Bob": "u2", "carol": "u3"}[name]
+}
+
+func TestMarkupHTML(t *testing.T) {
+	const a = `" rel="nofollow noopener noreferrer" target="_blank">`
+	tests := []struct {
+		name     string
+		body     string
+		html     string
+		mentions []string
+	}{
+		{"plain", "hello", "hello", nil},
+		{"escaped", `a < b & "c" 'd'`, "a &lt; b &amp; &#34;c&#34; &#39;d&#39;", nil},
+		{"tag", "<img src=x onerror=alert(1)>", "&lt;img src=x onerror=alert(1)&gt;", nil},
+		{"bold and italic", "**bold** and *it*", "<strong>bold</strong> and <em>it</em>", nil},
+		{"underscore italic", "_under_", "<em>under</em>", nil},
+		{"snake case", "snake_case_name", "snake_case_name", nil},
+		{"unclosed", "**bold", "**bold", nil},
+		{"bold escapes", "**<script>**", "<strong>&lt;script&gt;</strong>", nil},
+		{"nested", "**a *b* c**", "<strong>a <em>b</em> c</strong>", nil},
+		{"code is not formatted", "`<b>**x**</b>`", "<code>&lt;b&gt;**x**&lt;/b&gt;</code>", nil},
+		{"link", "[site](https://example.com/a?b=1&c=2)", `<a href="https://example.com/a?b=1&amp;c=2` + a + "site</a>", nil},
+		{"formatted link", "[**b**](http://a.io)", `<a href="http://a.io` + a + "<strong>b</strong></a>", nil},
+		{"javascript link", "[x](javascript:alert(1))", "[x](javascript:alert(1))", nil},
+		{"links do not nest", "[[x](http://a.io)](http://b.io)",
+			`<a href="http://a.io` + a + `[x</a>](<a href="http://b.io` + a + "http://b.io</a>)", nil},
+		{"bare url", "see https://example.com/x.", `see <a href="https://example.com/x` + a + "https://example.com/x</a>.", nil},
+		{"bare url in a word", "xhttps://example.com", "xhttps://example.com", nil},
+		{"quote in a link", `[x](https://a.io/"onclick=x)`, `<a href="https://a.io/%22onclick=x` + a + "x</a>", nil},
+		{"mention", "hi @Bob!", `hi <span class="mention" data-id="u2">@Bob</span>!`, []string{"u2"}},
+		{"mentions once", "@bob, @carol and @bob.", `<span class="mention" data-id="u2">@bob</span>, <span class="mention" data-id="u3">@carol</span> and <span class="mention" data-id="u2">@bob</span>.`, []string{"u2", "u3"}},
+		{"unknown mention", "@nobody", "@nobody", nil},
+		{"email is no mention", "mail@bob", "mail@bob", nil},
+		{"depth is limited", strings.Repeat("*", 20) + "x" + strings.Repeat("*", 20), "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &markup{resolve: testMembers}
+			got := spansHTML(p.parse(test.body, 0, true))
+			if test.html != "" && got != test.html {
+				t.Errorf("html of %q = %s, want %s", test.body, got, test.html)
+			}
+			if strings.Count(got, "<strong>") > maxMarkupDepth+1 || strings.Contains(got, "<script") {
+				t.Errorf("html of %q = %s is not limited", test.body, got)
+			}
+			if !reflect.DeepEqual(p.mentions, test.mentions) {
+				t.Errorf("mentions of %q = %v, want %v", test.body, p.mentions, test.mentions)
+			}
+		})
+	}
+}
+
+func TestMarkupMarkdown(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"plain", "plain"},
+		{"# not a heading | or a table", `\# not a heading \| or a table`},
+		{"<b>raw</b>", `\<b\>raw\</b\>`},
+		{"**bold** _it_", "**bold** *it*"},
+		{"`a*b`", "`a*b`"},
+		{"snake_case", `snake\_case`},
+		{"[x](https://a.io/)", "[x](<https://a.io/>)"},
+		{"[x](javascript:alert(1))", `\[x\](javascript:alert(1))`},
+		{"hi @bob", "hi **@bob**"},
+		{"line\nbreak", "line break"},
+		{"`a\n# b\r\n| c`", "`a # b | c`"},
+	}
+	for _, test := range tests {
+		got := spansMarkdown((&markup{resolve: testMembers}).parse(test.body, 0, true))
+		if got != test.want {
+			t.Errorf("markdown of %q = %s, want %s", test.body, got, test.want)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string // Empty if the target is refused
+	}{
+		{"https://example.com/a", "https://example.com/a"},
+		{"  http://example.com  ", "http://example.com"},
+		{"HTTPS://example.com", "https://example.com"},
+		{"mailto:bob@example.com", "mailto:bob@example.com"},
+		{"https://example.com/a b", "https://example.com/a%20b"},
+		{"javascript:alert(1)", ""},
+		{"JaVaScRiPt:alert(1)", ""},
+		{"data:text/html,<script>alert(1)</script>", ""},
+		{"vbscript:msgbox", ""},
+		{"http:///no-host", ""},
+		{"//example.com", ""},
+		{"/relative", ""},
+		{"https://exa mple.com", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, ok := safeURL(test.raw)
+		if ok != (test.want != "") || got != test.want {
+			t.Errorf("safeURL(%q) = %q, %v, want %q", test.raw, got, ok, test.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	h := newTestHub(t, DefaultConfig())
+	h.add(newClient(h, ClientInfo{ID: "u2", Name: "Bob", Version: ProtocolVersion}))
+
+	m := &Message{Body: "**hi** @bob"}
+	h.render(m)
+	if want := `<strong>hi</strong> <span class="mention" data-id="u2">@bob</span>`; m.HTML != want {
+		t.Errorf("html = %s, want %s", m.HTML, want)
+	}
+	if !reflect.DeepEqual(m.Mentions, []string{"u2"}) {
+		t.Errorf("mentions = %v, want [u2]", m.Mentions)
+	}
+
+	m.Deleted = true
+	h.render(m)
+	if m.HTML != "" || m.Mentions != nil {
+		t.Errorf("deleted message kept html %q and mentions %v", m.HTML, m.Mentions)
+	}
+}
@@ -0,0 +1,224 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ProtocolVersion is the version of the JSON wire format spoken by the hub.
+// Clients that connect without asking for a version get the legacy plain text format.
+const ProtocolVersion = 1
+
+// Kind identifies the type of a chat message
+type Kind string
+
+// Message kinds exchanged between clients and the hub
+const (
+	KindText           Kind = "text"            // Ordinary chat message written by a participant
+	KindAction         Kind = "action"          // Chat message describing what the sender does, sent with /me
+	KindRename         Kind = "rename"          // Request to change the sender's display name, sent with /nick
+	KindTopic          Kind = "topic"           // Host request to change the room topic, sent with /topic
+	KindSystem         Kind = "system"          // Notice generated by the server
+	KindRejected       Kind = "rejected"        // Message of the client refused by a filter, Body holds the reason
+	KindWarning        Kind = "warning"         // Notice sent to a single client about its own behaviour
+	KindDirect         Kind = "direct"          // Private message to some participants of the room
+	KindWelcome        Kind = "welcome"         // Identity of a client, sent to it when it registers
+	KindEdit           Kind = "edit"            // Correction of the message Ref by its author
+	KindDelete         Kind = "delete"          // Removal of the message Ref by its author or a host, fanned out as a tombstone
+	KindMute           Kind = "mute"            // Host request to mute a participant for Duration seconds
+	KindUnmute         Kind = "unmute"          // Host request to lift a mute
+	KindKick           Kind = "kick"            // Host request to disconnect a participant
+	KindBan            Kind = "ban"             // Host request to ban a participant from the room
+	KindBanIP          Kind = "ban_ip"          // Host request to ban a participant and everyone behind its IP address
+	KindUnban          Kind = "unban"           // Host request to lift a ban
+	KindReact          Kind = "react"           // Participant added the emoji Body to the message Ref
+	KindUnreact        Kind = "unreact"         // Participant removed the emoji Body from the message Ref
+	KindTyping         Kind = "typing"          // Participant started typing, never stored
+	KindTypingStop     Kind = "typing_stop"     // Participant stopped typing, never stored
+	KindRead           Kind = "read"            // Participant read up to the message Ref, never stored
+	KindReadState      Kind = "read_state"      // Last read message and unread Count, sent to a joining client
+	KindPresence       Kind = "presence"        // Snapshot of the roster in Participants, sent to a joining client
+	KindJoin           Kind = "join"            // Participant arrived in the room
+	KindLeave          Kind = "leave"           // Participant left the room
+	KindPresenceUpdate Kind = "presence_update" // Name, role or connections of a participant changed
+	KindThread         Kind = "thread"          // Request for the root and the replies of the thread Ref
+	KindPin            Kind = "pin"             // Host request to pin the message Ref
+	KindUnpin          Kind = "unpin"           // Host request to unpin the message Ref
+	KindRoomState      Kind = "room_state"      // Topic in Body, Pinned messages and Policy, sent on join and after every change
+	KindPoll           Kind = "poll"            // Poll asking the question in Body, open for Duration seconds when set
+	KindVote           Kind = "vote"            // Vote for the Choices of the poll Ref, an empty vote withdraws it
+	KindPollClose      Kind = "poll_close"      // Request of the author or a host to close the poll Ref
+	KindPollUpdate     Kind = "poll_update"     // Live tally of the poll Ref
+	KindPollClosed     Kind = "poll_closed"     // Final results of the poll Ref
+	KindPolicy         Kind = "policy"          // Host request to replace the posting rules with Policy
+	KindQA             Kind = "qa"              // Host request to open the Q&A when Body is "open", or to close it
+	KindQuestion       Kind = "question"        // Question for the Q&A queue in Body
+	KindUpvote         Kind = "upvote"          // Upvote of the question Ref
+	KindUnvote         Kind = "unvote"          // Withdrawal of an upvote of the question Ref
+	KindApprove        Kind = "approve"         // Host decision to put the question Ref in the public queue
+	KindAnswer         Kind = "answer"          // Host decision to mark the question Ref answered
+	KindDismiss        Kind = "dismiss"         // Host decision to take the question Ref off the queue
+	KindQAState        Kind = "qa_state"        // Q&A queue in Questions, Body is "open" while questions are taken
+	KindHostClaim      Kind = "host_claim"      // Claim of SenderID to host the room since Timestamp, only exchanged between replicas
+)
+
+// Message is the envelope for everything sent over a chat connection
+type Message struct {
+	Version      int                 `json:"v"`                      // Wire format version
+	ID           string              `json:"id,omitempty"`           // Unique id assigned by the hub
+	Room         string              `json:"room,omitempty"`         // Room the message belongs to
+	SenderID     string              `json:"sender_id,omitempty"`    // Id of the sending client, empty for system messages
+	DisplayName  string              `json:"display_name,omitempty"` // Display name of the sender at the time of sending
+	Timestamp    time.Time           `json:"ts"`                     // Time the hub accepted the message
+	Kind         Kind                `json:"kind"`                   // Type of the message
+	Body         string              `json:"body,omitempty"`         // Text content
+	To           []string            `json:"to,omitempty"`           // Recipients of a private message
+	Ref          string              `json:"ref,omitempty"`          // Id of the message an event refers to
+	Target       string              `json:"target,omitempty"`       // Id of the participant a moderation request is aimed at
+	Duration     int                 `json:"duration,omitempty"`     // Duration of a mute or a poll in seconds
+	Deleted      bool                `json:"deleted,omitempty"`      // Whether the message has been deleted
+	Reactions    map[string][]string `json:"reactions,omitempty"`    // Ids of the participants who reacted, by emoji
+	Count        int                 `json:"count,omitempty"`        // Unread messages in a read state, participants using an emoji in a reaction event, participants of a crowded room
+	EditedAt     *time.Time          `json:"edited_at,omitempty"`    // Time of the last edit
+	Attachments  []Attachment        `json:"attachments,omitempty"`  // Files referenced by the message, clients only send their ids
+	Role         Role                `json:"role,omitempty"`         // Role of the participant in a welcome
+	Revisions    []Revision          `json:"revisions,omitempty"`    // Earlier texts of an edited or deleted message, only shown to hosts
+	HTML         string              `json:"html,omitempty"`         // Safe HTML rendering of the Markdown subset in Body, set by the hub
+	Mentions     []string            `json:"mentions,omitempty"`     // Ids of the participants mentioned in Body
+	Parent       string              `json:"parent,omitempty"`       // Id of the root of the thread a reply belongs to
+	Replies      int                 `json:"replies,omitempty"`      // Number of replies to the root of a thread
+	Poll         *Poll               `json:"poll,omitempty"`         // Options and tallies of a poll
+	Choices      []int               `json:"choices,omitempty"`      // Options picked in a vote
+	Policy       *Policy             `json:"policy,omitempty"`       // Posting rules of the room
+	Questions    []*Question         `json:"questions,omitempty"`    // Q&A queue, in the order it is shown
+	Pinned       []*Message          `json:"pinned,omitempty"`       // Pinned messages in a room state
+	Participants []Participant       `json:"participants,omitempty"` // Roster in a presence snapshot, the participant concerned by a presence event
+
+	from *Client // Client that sent the message, nil for messages created by the server
+}
+
+// Revision is an earlier text of a message, kept as an audit trail for moderators
+type Revision struct {
+	Body string    `json:"body"` // Text of the message before the change
+	Time time.Time `json:"time"` // When the change was made
+	By   string    `json:"by"`   // Id of the participant who made the change
+}
+
+// visibleTo reports whether a participant may see a message
+func (m *Message) visibleTo(id string) bool {
+	if len(m.To) == 0 || m.SenderID == id {
+		return true
+	}
+	for _, to := range m.To {
+		if to == id {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeMessage turns a raw frame read from a client into a message.
+// Frames that are not a versioned JSON envelope are treated as legacy plain text.
+// Only the fields a client may set are kept, everything else is owned by the hub.
+func decodeMessage(raw []byte) *Message {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '{' {
+		m := &Message{}
+		if err := json.Unmarshal(raw, m); err == nil && m.Version > 0 {
+			if m.Kind == "" {
+				m.Kind = KindText
+			}
+			attachments := make([]Attachment, 0, len(m.Attachments))
+			for _, a := range m.Attachments {
+				attachments = append(attachments, Attachment{ID: a.ID})
+			}
+			return &Message{
+				Kind:        m.Kind,
+				Body:        string(bytes.TrimSpace([]byte(m.Body))),
+				To:          m.To,
+				Ref:         m.Ref,
+				Target:      m.Target,
+				Duration:    m.Duration,
+				Parent:      m.Parent,
+				Choices:     m.Choices,
+				Poll:        decodePoll(m.Poll),
+				Policy:      m.Policy,
+				Attachments: attachments,
+			}
+		}
+	}
+
+	// Wrap legacy plain text, replacing newlines with spaces
+	return &Message{
+		Kind: KindText,
+		Body: string(bytes.TrimSpace(bytes.Replace(raw, newline, space, -1))),
+	}
+}
+
+// decodePoll keeps the parts of a poll a client may set
+func decodePoll(p *Poll) *Poll {
+	if p == nil {
+		return nil
+	}
+	options := make([]PollOption, 0, len(p.Options))
+	for _, option := range p.Options {
+		options = append(options, PollOption{Text: option.Text})
+	}
+	return &Poll{Options: options, Multiple: p.Multiple, Anonymous: p.Anonymous}
+}
+
+// encodeJSON serializes a message for clients speaking the versioned protocol
+func encodeJSON(m *Message) []byte {
+	data, err := json.Marshal(publicPolls(m))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// encodeLegacy renders a message as a single line for plain text clients.
+// It returns nil for kinds that legacy clients cannot display.
+func encodeLegacy(m *Message) []byte {
+	switch m.Kind {
+	case KindText:
+		if m.Deleted {
+			return []byte(m.DisplayName + ": (deleted)")
+		}
+		return []byte(legacyReply(m) + m.DisplayName + ": " + m.Body + legacyAttachments(m))
+	case KindAction:
+		return []byte(legacyReply(m) + "* " + m.DisplayName + " " + m.Body)
+	case KindDirect:
+		return []byte("(private) " + m.DisplayName + ": " + m.Body)
+	case KindSystem, KindWarning, KindRejected:
+		return []byte("* " + m.Body)
+	case KindPoll:
+		if m.Deleted {
+			return nil
+		}
+		text := "Poll by " + m.DisplayName + ": " + m.Body
+		for i, option := range m.Poll.Options {
+			text += fmt.Sprintf(" [%d] %s", i+1, option.Text)
+		}
+		return []byte(text)
+	}
+	return nil
+}
+
+// legacyAttachments lists the names of a message's attachments for plain text clients
+func legacyAttachments(m *Message) string {
+	text := ""
+	for _, a := range m.Attachments {
+		text += " [" + a.Name + "]"
+	}
+	return text
+}
+
+// legacyReply marks replies for plain text clients, which cannot show threads
+func legacyReply(m *Message) string {
+	if m.Parent != "" {
+		return "(reply) "
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	none := []Attachment{}
+	tests := []struct {
+		name string
+		raw  string
+		want *Message
+	}{
+		{"legacy text", "  hello there \n", &Message{Kind: KindText, Body: "hello there"}},
+		{"legacy newlines", "one\ntwo\r\nthree", &Message{Kind: KindText, Body: "one two\r three"}},
+		{"empty", "", &Message{Kind: KindText}},
+		{"json without version", `{"kind":"direct","body":"hi"}`, &Message{Kind: KindText, Body: `{"kind":"direct","body":"hi"}`}},
+		{"invalid json", `{"v":1,"body":`, &Message{Kind: KindText, Body: `{"v":1,"body":`}},
+		{"default kind", `{"v":1,"body":" hi "}`, &Message{Kind: KindText, Body: "hi", Attachments: none}},
+		{"direct", `{"v":1,"kind":"direct","body":"psst","to":["bob"]}`, &Message{Kind: KindDirect, Body: "psst", To: []string{"bob"}, Attachments: none}},
+		{"hub fields dropped",
+			`{"v":1,"id":"m1","sender_id":"host","display_name":"Host","ts":"2020-01-01T00:00:00Z","kind":"text","body":"hi","deleted":true,"revisions":[{"body":"x"}]}`,
+			&Message{Kind: KindText, Body: "hi", Attachments: none}},
+		{"edit", `{"v":1,"kind":"edit","ref":"m1","body":"fixed"}`, &Message{Kind: KindEdit, Ref: "m1", Body: "fixed", Attachments: none}},
+		{"mute", `{"v":1,"kind":"mute","target":"bob","duration":30}`, &Message{Kind: KindMute, Target: "bob", Duration: 30, Attachments: none}},
+		{"attachments keep only the id",
+			`{"v":1,"body":"look","attachments":[{"id":"a1","name":"x.png","size":5,"uploader":"host"}]}`,
+			&Message{Kind: KindText, Body: "look", Attachments: []Attachment{{ID: "a1"}}}},
+		{"poll keeps only the options",
+			`{"v":1,"kind":"poll","body":"lunch?","poll":{"options":[{"text":"yes","count":9,"voters":["x"]},{"text":"no"}],"multiple":true,"closed":true,"votes":{"x":[0]}}}`,
+			&Message{Kind: KindPoll, Body: "lunch?", Poll: &Poll{Options: []PollOption{{Text: "yes"}, {Text: "no"}}, Multiple: true}, Attachments: none}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := decodeMessage([]byte(test.raw)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("decodeMessage(%q) = %+v, want %+v", test.raw, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+const (
+	defaultMuteDuration = 5 * time.Minute // Mute duration used when the host does not give one
+	maxMuteDuration     = 24 * time.Hour  // Longest mute a host can hand out
+)
+
+// Role is the part a participant plays in a room
+type Role string
+
+// Roles of chat participants
+const (
+	RoleHost        Role = "host"        // Owner of the room, allowed to moderate
+	RoleParticipant Role = "participant" // Member of the video call
+	RoleViewer      Role = "viewer"      // Viewer of the room's stream
+)
+
+// moderation holds the moderation state of a hub, it is read by handlers outside the hub goroutine
+type moderation struct {
+	lock      sync.RWMutex         // Mutex for the maps below
+	hosts     map[string]bool      // Participant ids allowed to moderate
+	hostSince time.Time            // When the host claimed the room, the earliest claim wins across replicas
+	muted     map[string]time.Time // End of the mute of each muted participant
+	banned    map[string]string    // Reasons of banned participant ids
+	bannedIPs map[string]string    // Ids of the banned participants whose ban covers each IP address
+}
+
+// ClaimHost makes a participant the host of the room if it has none yet.
+// It reports whether the participant is a host afterwards. Other replicas of the room may have
+// a host already, the claim is published so that every replica settles on the earliest one.
+func (h *Hub) ClaimHost(id string) bool {
+	h.mod.lock.Lock()
+	claimed := len(h.mod.hosts) == 0
+	if claimed {
+		h.mod.hosts[id] = true
+		h.mod.hostSince = time.Now().UTC()
+	}
+	host, since := h.mod.hosts[id], h.mod.hostSince
+	h.mod.lock.Unlock()
+
+	if claimed {
+		h.publishHostClaim(id, since)
+	}
+	return host
+}
+
+// publishHostClaim tells the other replicas of the room who hosts it on this one
+func (h *Hub) publishHostClaim(id string, since time.Time) {
+	h.publish(&Message{Version: ProtocolVersion, Kind: KindHostClaim, Room: h.Room, SenderID: id, Timestamp: since}, nil)
+}
+
+// applyHostClaim settles the host of the room with a claim published by another replica.
+// The earliest claim wins, ties go to the lower id. A replica that holds an earlier claim answers
+// with it, so that replicas that started later learn about it. Local connections of participants
+// whose role changed are closed, they reconnect with their new role.
+func (h *Hub) applyHostClaim(m *Message) {
+	h.mod.lock.Lock()
+	var current string
+	for id := range h.mod.hosts {
+		current = id
+	}
+	since := h.mod.hostSince
+	wins := current == "" || m.Timestamp.Before(since) || (m.Timestamp.Equal(since) && m.SenderID < current)
+	if wins {
+		h.mod.hosts = map[string]bool{m.SenderID: true}
+		h.mod.hostSince = m.Timestamp
+	}
+	h.mod.lock.Unlock()
+
+	if !wins {
+		if current != m.SenderID {
+			h.publishHostClaim(current, since)
+		}
+		return
+	}
+	if current != "" && current != m.SenderID {
+		log.Printf("chat room %s is hosted by %s, who claimed it before %s", h.Room, m.SenderID, current)
+		for _, id := range []string{current, m.SenderID} {
+			for client := range h.byID[id] {
+				h.remove(client, websocket.CloseTryAgainLater, "host changed")
+			}
+		}
+	}
+}
+
+// IsHost reports whether a participant may moderate the room
+func (h *Hub) IsHost(id string) bool {
+	h.mod.lock.RLock()
+	defer h.mod.lock.RUnlock()
+	return h.mod.hosts[id]
+}
+
+// Banned reports whether a participant or address has been banned from the room
+func (h *Hub) Banned(id, ip string) bool {
+	h.mod.lock.RLock()
+	defer h.mod.lock.RUnlock()
+
+	if h.mod.hosts[id] {
+		return false
+	}
+	_, idBanned := h.mod.banned[id]
+	_, ipBanned := h.mod.bannedIPs[ip]
+	return idBanned || (ip != "" && ipBanned)
+}
+
+// mutedFor returns how long a participant stays muted, zero if it is not muted
+func (h *Hub) mutedFor(id string) time.Duration {
+	h.mod.lock.RLock()
+	defer h.mod.lock.RUnlock()
+	return time.Until(h.mod.muted[id])
+}
+
+// pruneMutes forgets the mutes that are over. The caller holds the lock.
+func (m *moderation) pruneMutes(now time.Time) {
+	for id, until := range m.muted {
+		if !now.Before(until) {
+			delete(m.muted, id)
+		}
+	}
+}
+
+// moderate carries out a moderation request sent by a host
+func (h *Hub) moderate(m *Message) {
+	if !h.IsHost(m.SenderID) {
+		m.from.notify(KindWarning, "Only hosts can moderate the chat.")
+		return
+	}
+
+	target := h.members[m.Target]
+	if target == nil {
+		m.from.notify(KindWarning, "Unknown participant "+m.Target+".")
+		return
+	}
+	if h.IsHost(m.Target) {
+		m.from.notify(KindWarning, "Hosts cannot be moderated.")
+		return
+	}
+
+	if m.Kind == KindMute {
+		duration := time.Duration(m.Duration) * time.Second
+		if duration <= 0 {
+			duration = defaultMuteDuration
+		}
+		if duration > maxMuteDuration {
+			duration = maxMuteDuration
+		}
+		m.Duration = int(duration / time.Second)
+	}
+	h.enforce(m)
+
+	switch m.Kind {
+	case KindMute:
+		h.announce(fmt.Sprintf("%s was muted by %s for %s.", target.name, m.DisplayName, time.Duration(m.Duration)*time.Second))
+	case KindUnmute:
+		h.announce(fmt.Sprintf("%s was unmuted by %s.", target.name, m.DisplayName))
+	case KindKick:
+		h.announce(fmt.Sprintf("%s was kicked by %s.", target.name, m.DisplayName))
+	case KindBan, KindBanIP:
+		h.announce(fmt.Sprintf("%s was banned by %s.", target.name, m.DisplayName))
+	case KindUnban:
+		h.announce(fmt.Sprintf("%s was unbanned by %s.", target.name, m.DisplayName))
+	}
+
+	// The other replicas enforce the decision on the connections they hold
+	h.publish(h.event(&Message{
+		Kind:        m.Kind,
+		Target:      m.Target,
+		Duration:    m.Duration,
+		Body:        m.Body,
+		SenderID:    m.SenderID,
+		DisplayName: m.DisplayName,
+	}), nil)
+}
+
+// enforce applies a moderation decision of a host to the moderation state and to the connections
+// of the target on this hub. Decisions published by other replicas are ignored unless their sender
+// is a host here as well.
+func (h *Hub) enforce(m *Message) {
+	if !h.IsHost(m.SenderID) || h.IsHost(m.Target) {
+		log.Printf("ignoring chat moderation of %s in room %s by %q, who is not a host", m.Target, h.Room, m.SenderID)
+		return
+	}
+	var name, ip string
+	h.membersLock.RLock()
+	if target := h.members[m.Target]; target != nil {
+		name, ip = target.name, target.ip
+	}
+	h.membersLock.RUnlock()
+
+	switch m.Kind {
+	case KindMute:
+		now := time.Now()
+		h.mod.lock.Lock()
+		h.mod.pruneMutes(now)
+		h.mod.muted[m.Target] = now.Add(time.Duration(m.Duration) * time.Second)
+		h.mod.lock.Unlock()
+		h.audit(AuditMute, m.Target, name, ip, m.SenderID, m.Body)
+	case KindUnmute:
+		h.mod.lock.Lock()
+		delete(h.mod.muted, m.Target)
+		h.mod.lock.Unlock()
+		h.audit(AuditUnmute, m.Target, name, ip, m.SenderID, m.Body)
+	case KindKick:
+		h.audit(AuditKick, m.Target, name, ip, m.SenderID, m.Body)
+		h.disconnectMember(m.Target, "kicked by host")
+	case KindBan, KindBanIP:
+		// Banning the address also turns away everyone else behind it, so it is only done on request
+		action := AuditBan
+		h.mod.lock.Lock()
+		h.mod.banned[m.Target] = m.Body
+		if m.Kind == KindBanIP && ip != "" {
+			h.mod.bannedIPs[ip] = m.Target
+			action = AuditBanIP
+		}
+		h.mod.lock.Unlock()
+		h.audit(action, m.Target, name, ip, m.SenderID, m.Body)
+		h.disconnectMember(m.Target, "banned by host")
+	case KindUnban:
+		h.mod.lock.Lock()
+		delete(h.mod.banned, m.Target)
+		for bannedIP, id := range h.mod.bannedIPs {
+			if id == m.Target {
+				delete(h.mod.bannedIPs, bannedIP)
+			}
+		}
+		h.mod.lock.Unlock()
+		h.audit(AuditUnban, m.Target, name, ip, m.SenderID, m.Body)
+	}
+}
+
+// disconnectMember closes every connection of a participant
+func (h *Hub) disconnectMember(id, reason string) {
+	for client := range h.byID[id] {
+		h.remove(client, websocket.ClosePolicyViolation, reason)
+	}
+}
+
+// announce sends a system message to the whole room and keeps it in the history
+func (h *Hub) announce(body string) {
+	m := &Message{Kind: KindSystem, Body: body}
+	h.stamp(m)
+	h.store(m)
+	h.fanout(m)
+}
@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBan(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     Kind
+		neighbor bool // Whether someone else behind the same address is turned away
+	}{
+		{"ban", KindBan, false},
+		{"ban with the address", KindBanIP, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHub(t, DefaultConfig())
+			h.mod.hosts["host"] = true
+			h.members["alice"] = &member{name: "alice", ip: "10.0.0.1"}
+
+			h.enforce(&Message{Kind: test.kind, Target: "alice", SenderID: "host"})
+			if !h.Banned("alice", "10.0.0.2") {
+				t.Error("alice is not banned")
+			}
+			if banned := h.Banned("bob", "10.0.0.1"); banned != test.neighbor {
+				t.Errorf("bob banned = %v, want %v", banned, test.neighbor)
+			}
+
+			h.enforce(&Message{Kind: KindUnban, Target: "alice", SenderID: "host"})
+			if h.Banned("alice", "10.0.0.1") || h.Banned("bob", "10.0.0.1") {
+				t.Error("ban was not lifted")
+			}
+		})
+	}
+}
+
+func TestUnbanKeepsOtherAddressBans(t *testing.T) {
+	h := newTestHub(t, DefaultConfig())
+	h.mod.hosts["host"] = true
+	h.members["alice"] = &member{name: "alice", ip: "10.0.0.1"}
+	h.members["bob"] = &member{name: "bob", ip: "10.0.0.1"}
+
+	h.enforce(&Message{Kind: KindBanIP, Target: "alice", SenderID: "host"})
+	h.enforce(&Message{Kind: KindBan, Target: "bob", SenderID: "host"})
+	h.enforce(&Message{Kind: KindUnban, Target: "bob", SenderID: "host"})
+	if !h.Banned("carol", "10.0.0.1") {
+		t.Error("lifting the ban of bob lifted the address ban of alice")
+	}
+}
+
+func TestMutesArePruned(t *testing.T) {
+	h := newTestHub(t, DefaultConfig())
+	h.mod.hosts["host"] = true
+	h.mod.muted["gone"] = time.Now().Add(-time.Second)
+	h.mod.muted["still"] = time.Now().Add(time.Minute)
+
+	h.enforce(&Message{Kind: KindMute, Target: "alice", Duration: 60, SenderID: "host"})
+	if _, ok := h.mod.muted["gone"]; ok {
+		t.Error("expired mute was kept")
+	}
+	if h.mutedFor("still") <= 0 || h.mutedFor("alice") <= 0 {
+		t.Error("running mutes were removed")
+	}
+}
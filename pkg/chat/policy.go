@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxSlowMode is the longest interval slow mode can enforce
+const maxSlowMode = time.Hour
+
+// defaultFollowerAge is how long participants wait in followers-only mode when no age is given
+const defaultFollowerAge = 10 * time.Minute
+
+// Policy holds the posting rules hosts switch on at runtime, hosts are never held to them.
+// There is no authenticated-only mode: chat tokens are handed to every browser that asks
+// and are not tied to an account, so requiring one would keep nobody out.
+type Policy struct {
+	SlowMode      int  `json:"slow_mode,omitempty"`      // Seconds a participant waits between messages, 0 disables slow mode
+	FollowersOnly bool `json:"followers_only,omitempty"` // Only participants who have been in the room for FollowerAge may post
+	FollowerAge   int  `json:"follower_age,omitempty"`   // Seconds a participant must have been in the room in followers-only mode, 10 minutes when not given
+	EmoteOnly     bool `json:"emote_only,omitempty"`     // Messages may only contain emoji
+}
+
+// policyState is the policy of a room, read by commands outside the hub goroutine
+type policyState struct {
+	lock     sync.RWMutex         // Mutex for policy
+	policy   Policy               // Current posting rules
+	lastPost map[string]time.Time // Time of the last message of each participant, used by Run only
+}
+
+// Policy returns the posting rules of the room
+func (h *Hub) Policy() Policy {
+	h.policy.lock.RLock()
+	defer h.policy.lock.RUnlock()
+	return h.policy.policy
+}
+
+// setPolicy replaces the posting rules on behalf of a host and announces what changed
+func (h *Hub) setPolicy(m *Message) {
+	if !h.IsHost(m.SenderID) {
+		m.from.notify(KindWarning, "Only hosts can change the chat modes.")
+		return
+	}
+	if m.Policy == nil {
+		return
+	}
+	policy := m.Policy.normalized()
+
+	h.policy.lock.Lock()
+	previous := h.policy.policy
+	h.policy.policy = policy
+	h.policy.lock.Unlock()
+
+	changes := policyChanges(previous, policy)
+	if len(changes) == 0 {
+		return
+	}
+	h.announce(fmt.Sprintf("%s %s.", m.DisplayName, strings.Join(changes, ", ")))
+	h.sendRoomState(m.SenderID)
+}
+
+// normalized returns the policy with its durations within bounds.
+// Followers-only mode without an age would let anyone post, so it gets the default age.
+func (p Policy) normalized() Policy {
+	p.SlowMode = clampSeconds(p.SlowMode, maxSlowMode)
+	p.FollowerAge = clampSeconds(p.FollowerAge, maxMuteDuration)
+	if !p.FollowersOnly {
+		p.FollowerAge = 0
+	} else if p.FollowerAge == 0 {
+		p.FollowerAge = int(defaultFollowerAge / time.Second)
+	}
+	return p
+}
+
+// clampSeconds keeps a number of seconds between 0 and max
+func clampSeconds(seconds int, max time.Duration) int {
+	if seconds < 0 {
+		return 0
+	}
+	if limit := int(max / time.Second); seconds > limit {
+		return limit
+	}
+	return seconds
+}
+
+// policyChanges describes the differences between two policies, for the announcement
+func policyChanges(before, after Policy) []string {
+	var changes []string
+	switch {
+	case after.SlowMode == before.SlowMode:
+	case after.SlowMode == 0:
+		changes = append(changes, "turned off slow mode")
+	default:
+		changes = append(changes, fmt.Sprintf("set slow mode to %s", time.Duration(after.SlowMode)*time.Second))
+	}
+	switch {
+	case after.FollowersOnly == before.FollowersOnly && after.FollowerAge == before.FollowerAge:
+	case !after.FollowersOnly:
+		changes = append(changes, "turned off followers-only mode")
+	default:
+		changes = append(changes, fmt.Sprintf("turned on followers-only mode for participants here for %s", time.Duration(after.FollowerAge)*time.Second))
+	}
+	if after.EmoteOnly != before.EmoteOnly {
+		changes = append(changes, "turned "+onOff(after.EmoteOnly)+" emote-only mode")
+	}
+	return changes
+}
+
+// onOff names the state of a switch
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// allowPost checks a public message against the posting rules of the room.
+// It sends the sender the reason when the message is refused.
+func (h *Hub) allowPost(m *Message) bool {
+	if h.IsHost(m.SenderID) {
+		return true
+	}
+	policy := h.Policy()
+	reason := ""
+	switch {
+	case policy.FollowersOnly && !h.follower(m.SenderID, time.Duration(policy.FollowerAge)*time.Second):
+		wait := time.Until(h.memberSince(m.SenderID).Add(time.Duration(policy.FollowerAge) * time.Second))
+		reason = fmt.Sprintf("The chat is in followers-only mode, you can post in %s.", wait.Round(time.Second))
+	case policy.EmoteOnly && (!emoteOnly(m.Body) || len(m.Attachments) > 0 || m.Kind == KindPoll):
+		reason = "The chat is in emote-only mode, messages may only contain emoji."
+	case policy.SlowMode > 0:
+		next := h.policy.lastPost[m.SenderID].Add(time.Duration(policy.SlowMode) * time.Second)
+		if wait := time.Until(next); wait > 0 {
+			reason = fmt.Sprintf("The chat is in slow mode, you can post again in %s.", wait.Round(time.Second))
+		}
+	}
+	if reason != "" {
+		m.from.notify(KindRejected, reason)
+		return false
+	}
+	if policy.SlowMode > 0 {
+		h.policy.lastPost[m.SenderID] = time.Now()
+	}
+	return true
+}
+
+// follower reports whether a participant has been in the room for at least the given age
+func (h *Hub) follower(id string, age time.Duration) bool {
+	since := h.memberSince(id)
+	return !since.IsZero() && time.Since(since) >= age
+}
+
+// emoji holds the code points of emoji and of the characters that combine them: joiners,
+// variation selectors, skin tones, flags and keycaps. Other symbols and punctuation are left out,
+// so that a row of them does not pass as an emote.
+var emoji = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x200d, Hi: 0x200d, Stride: 1}, // Zero width joiner
+		{Lo: 0x20e3, Hi: 0x20e3, Stride: 1}, // Keycap
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x23e9, Hi: 0x23f3, Stride: 1},
+		{Lo: 0x23f8, Hi: 0x23fa, Stride: 1},
+		{Lo: 0x2600, Hi: 0x27bf, Stride: 1}, // Miscellaneous symbols and dingbats
+		{Lo: 0x2b05, Hi: 0x2b07, Stride: 1},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b50, Stride: 1},
+		{Lo: 0x2b55, Hi: 0x2b55, Stride: 1},
+		{Lo: 0xfe0e, Hi: 0xfe0f, Stride: 1}, // Variation selectors
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1faff, Stride: 1}, // Pictographs, emoticons, flags and skin tones
+		{Lo: 0xe0020, Hi: 0xe007f, Stride: 1}, // Tags of subdivision flags
+	},
+}
+
+// emoteOnly reports whether a message body holds nothing but emoji
+func emoteOnly(body string) bool {
+	if strings.TrimSpace(body) == "" {
+		return false
+	}
+	for _, r := range body {
+		if !unicode.IsSpace(r) && !unicode.Is(emoji, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// setPolicyState applies the posting rules published by another replica
+func (h *Hub) setPolicyState(policy *Policy) {
+	if policy == nil {
+		policy = &Policy{}
+	}
+	h.policy.lock.Lock()
+	h.policy.policy = *policy
+	h.policy.lock.Unlock()
+}
@@ -0,0 +1,91 @@
+package chat
+
+import "testing"
+
+func TestPolicyNormalized(t *testing.T) {
+	defaultAge := int(defaultFollowerAge.Seconds())
+	tests := []struct {
+		name   string
+		policy Policy
+		want   Policy
+	}{
+		{"followers without age", Policy{FollowersOnly: true}, Policy{FollowersOnly: true, FollowerAge: defaultAge}},
+		{"followers with negative age", Policy{FollowersOnly: true, FollowerAge: -5}, Policy{FollowersOnly: true, FollowerAge: defaultAge}},
+		{"followers with age", Policy{FollowersOnly: true, FollowerAge: 60}, Policy{FollowersOnly: true, FollowerAge: 60}},
+		{"age without followers", Policy{FollowerAge: 60}, Policy{}},
+		{"slow mode too long", Policy{SlowMode: 2 * 3600}, Policy{SlowMode: 3600}},
+		{"negative slow mode", Policy{SlowMode: -1}, Policy{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.policy.normalized(); got != test.want {
+				t.Errorf("normalized() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFollowersCommand(t *testing.T) {
+	tests := []struct {
+		args string
+		age  int // Follower age submitted, -1 if the command is refused
+	}{
+		{"", int(defaultFollowerAge.Seconds())},
+		{"90s", 90},
+		{"0s", -1},
+		{"-1m", -1},
+		{"soon", -1},
+	}
+	for _, test := range tests {
+		t.Run(test.args, func(t *testing.T) {
+			h := newTestHub(t, DefaultConfig())
+			c := newClient(h, ClientInfo{ID: "host", Name: "host", Role: RoleHost, Version: ProtocolVersion})
+			err := followersCommand(&CommandContext{Hub: h, Client: c, Args: test.args})
+			if test.age < 0 {
+				if err == nil {
+					t.Errorf("/followers %s was accepted", test.args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("/followers %s: %v", test.args, err)
+			}
+			m := <-h.broadcast
+			if !m.Policy.FollowersOnly || m.Policy.FollowerAge != test.age {
+				t.Errorf("submitted %+v, want followers-only for %d seconds", *m.Policy, test.age)
+			}
+		})
+	}
+}
+
+func TestEmoteOnly(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{"🎉", true},
+		{"👍🏽 🎉", true},
+		{"❤️", true},
+		{"👨‍👩‍👧", true},
+		{"🇫🇷", true},
+		{"⭐⌛", true},
+		{"", false},
+		{"   ", false},
+		{"hi 🎉", false},
+		{"!!!", false},
+		{"$$$", false},
+		{"+++", false},
+		{"€€€", false},
+		{"→→", false},
+		{"©", false},
+		{"！！", false},
+		{"…", false},
+		{"你好", false},
+		{"٣", false},
+	}
+	for _, test := range tests {
+		if got := emoteOnly(test.body); got != test.want {
+			t.Errorf("emoteOnly(%q) = %v, want %v", test.body, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Limits of polls
+const (
+	maxPollOptions      = 10             // Most options of a poll
+	maxPollOptionLength = 100            // Longest option text in characters
+	maxPollDuration     = 24 * time.Hour // Longest time a poll may stay open
+)
+
+// Poll is a question with options participants vote on, the question is the Body of its message
+type Poll struct {
+	Options   []PollOption     `json:"options"`             // Choices of the poll with their tallies
+	Multiple  bool             `json:"multiple,omitempty"`  // Whether participants may pick several options
+	Anonymous bool             `json:"anonymous,omitempty"` // Whether voters are hidden from everyone
+	ClosesAt  *time.Time       `json:"closes_at,omitempty"` // When the poll closes by itself, nil if it stays open until closed
+	Closed    bool             `json:"closed,omitempty"`    // Whether voting has ended
+	Votes     map[string][]int `json:"votes,omitempty"`     // Options chosen by each participant, never sent to clients
+}
+
+// PollOption is a choice of a poll
+type PollOption struct {
+	Text   string   `json:"text"`             // Text of the option
+	Count  int      `json:"count"`            // Number of votes for the option
+	Voters []string `json:"voters,omitempty"` // Ids of the voters, empty for anonymous polls
+}
+
+// public returns the poll as shown to clients, without the votes and, for anonymous polls, the voters
+func (p *Poll) public() *Poll {
+	shown := *p
+	shown.Votes = nil
+	shown.Options = make([]PollOption, len(p.Options))
+	for i, option := range p.Options {
+		shown.Options[i] = PollOption{Text: option.Text, Count: option.Count}
+		if !p.Anonymous {
+			shown.Options[i].Voters = option.Voters
+		}
+	}
+	return &shown
+}
+
+// tally returns a copy of the poll with the votes counted again
+func (p *Poll) tally(votes map[string][]int) *Poll {
+	counted := *p
+	counted.Votes = votes
+	counted.Options = make([]PollOption, len(p.Options))
+	for i, option := range p.Options {
+		counted.Options[i] = PollOption{Text: option.Text}
+	}
+	for id, choices := range votes {
+		for _, choice := range choices {
+			counted.Options[choice].Count++
+			counted.Options[choice].Voters = append(counted.Options[choice].Voters, id)
+		}
+	}
+	return &counted
+}
+
+// results describes the outcome of a poll in one line
+func (p *Poll) results() string {
+	parts := make([]string, 0, len(p.Options))
+	for _, option := range p.Options {
+		parts = append(parts, fmt.Sprintf("%s: %d", option.Text, option.Count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// publicPolls hides the votes of the polls in a message before it is sent to clients
+func publicPolls(m *Message) *Message {
+	if m.Poll == nil && len(m.Pinned) == 0 {
+		return m
+	}
+	shown := *m
+	if m.Poll != nil {
+		shown.Poll = m.Poll.public()
+	}
+	if len(m.Pinned) > 0 {
+		shown.Pinned = make([]*Message, len(m.Pinned))
+		for i, pinned := range m.Pinned {
+			shown.Pinned[i] = publicPolls(pinned)
+		}
+	}
+	return &shown
+}
+
+// createPoll checks a new poll, stores it and sends it to everyone
+func (h *Hub) createPoll(m *Message) {
+	if muted := h.mutedFor(m.SenderID); muted > 0 {
+		m.from.notify(KindWarning, fmt.Sprintf("You are muted for another %s.", muted.Round(time.Second)))
+		return
+	}
+	if m.Body == "" || m.Poll == nil || len(m.Poll.Options) < 2 || len(m.Poll.Options) > maxPollOptions {
+		m.from.notify(KindWarning, fmt.Sprintf("A poll needs a question and 2 to %d options.", maxPollOptions))
+		return
+	}
+	if h.history == nil {
+		m.from.notify(KindWarning, "Polls need a chat history.")
+		return
+	}
+
+	poll := &Poll{Multiple: m.Poll.Multiple, Anonymous: m.Poll.Anonymous, Votes: map[string][]int{}}
+	for _, option := range m.Poll.Options {
+		text := strings.TrimSpace(option.Text)
+		if text == "" || len([]rune(text)) > maxPollOptionLength {
+			m.from.notify(KindWarning, fmt.Sprintf("Poll options need 1 to %d characters.", maxPollOptionLength))
+			return
+		}
+		poll.Options = append(poll.Options, PollOption{Text: text})
+	}
+	if !h.allowPost(m) {
+		return
+	}
+	m.Poll = poll
+	m.Parent = ""
+
+	h.stamp(m)
+	if m.Duration > 0 {
+		duration := time.Duration(m.Duration) * time.Second
+		if duration > maxPollDuration {
+			duration = maxPollDuration
+		}
+		closesAt := m.Timestamp.Add(duration)
+		poll.ClosesAt = &closesAt
+		h.scheduleClose(m.ID, duration)
+	}
+	m.Duration = 0
+	h.render(m)
+	h.store(m)
+	h.fanout(m)
+}
+
+// scheduleClose closes a poll once its time is up, through the hub goroutine
+func (h *Hub) scheduleClose(id string, after time.Duration) {
+	h.pollTimers[id] = time.AfterFunc(after, func() {
+		select {
+		case h.broadcast <- &Message{Kind: KindPollClose, Ref: id}:
+		case <-h.done:
+		}
+	})
+}
+
+// stopPollTimer cancels the close timer of a poll that ended another way
+func (h *Hub) stopPollTimer(id string) {
+	if timer := h.pollTimers[id]; timer != nil {
+		timer.Stop()
+		delete(h.pollTimers, id)
+	}
+}
+
+// vote records the choices of a participant, replacing any earlier vote, and sends the new tally
+func (h *Hub) vote(m *Message) {
+	poll, ok := h.openPoll(m)
+	if !ok {
+		return
+	}
+
+	choices, err := validChoices(poll.Poll, m.Choices)
+	if err != nil {
+		m.from.notify(KindWarning, err.Error())
+		return
+	}
+
+	updated, err := h.history.Update(m.Ref, func(stored *Message) {
+		votes := make(map[string][]int, len(stored.Poll.Votes)+1)
+		for id, chosen := range stored.Poll.Votes {
+			votes[id] = chosen
+		}
+		if len(choices) == 0 {
+			delete(votes, m.SenderID) // An empty vote withdraws the earlier one
+		} else {
+			votes[m.SenderID] = choices
+		}
+		stored.Poll = stored.Poll.tally(votes)
+	})
+	if err != nil {
+		log.Printf("error storing vote on poll %s in room %s: %v", m.Ref, h.Room, err)
+		return
+	}
+	h.fanout(h.event(&Message{Kind: KindPollUpdate, Ref: m.Ref, Body: updated.Body, Poll: updated.Poll}))
+}
+
+// openPoll returns the poll a vote is for, closing it first if its time is up
+func (h *Hub) openPoll(m *Message) (*Message, bool) {
+	if h.history == nil {
+		return nil, false
+	}
+	poll, err := h.history.Get(m.Ref)
+	if err != nil || poll.Poll == nil || poll.Deleted {
+		m.from.notify(KindWarning, "Unknown poll "+m.Ref+".")
+		return nil, false
+	}
+	// Close timers do not survive a restart, so late votes close the poll instead
+	if !poll.Poll.Closed && poll.Poll.ClosesAt != nil && time.Now().After(*poll.Poll.ClosesAt) {
+		h.finishPoll(poll)
+	}
+	if poll.Poll.Closed || (poll.Poll.ClosesAt != nil && time.Now().After(*poll.Poll.ClosesAt)) {
+		m.from.notify(KindWarning, "This poll is closed.")
+		return nil, false
+	}
+	return poll, true
+}
+
+// validChoices checks the options picked in a vote and removes duplicates
+func validChoices(poll *Poll, choices []int) ([]int, error) {
+	seen := make(map[int]bool, len(choices))
+	valid := make([]int, 0, len(choices))
+	for _, choice := range choices {
+		if choice < 0 || choice >= len(poll.Options) {
+			return nil, fmt.Errorf("Unknown poll option %d.", choice)
+		}
+		if !seen[choice] {
+			seen[choice] = true
+			valid = append(valid, choice)
+		}
+	}
+	if len(valid) > 1 && !poll.Multiple {
+		return nil, fmt.Errorf("This poll allows a single choice.")
+	}
+	return valid, nil
+}
+
+// closePoll ends a poll when its time is up, or early on request of its author or a host
+func (h *Hub) closePoll(m *Message) {
+	if h.history == nil {
+		return
+	}
+	poll, err := h.history.Get(m.Ref)
+	if err != nil || poll.Poll == nil || poll.Poll.Closed {
+		if m.from != nil {
+			m.from.notify(KindWarning, "Unknown poll "+m.Ref+".")
+		}
+		return
+	}
+	// Timers submit close requests without a client
+	if m.from != nil && poll.SenderID != m.SenderID && !h.IsHost(m.SenderID) {
+		m.from.notify(KindWarning, "Only the author of a poll or a host can close it.")
+		return
+	}
+	h.finishPoll(poll)
+}
+
+// finishPoll marks a poll closed and sends the final results
+func (h *Hub) finishPoll(poll *Message) {
+	h.stopPollTimer(poll.ID)
+	updated, err := h.history.Update(poll.ID, func(stored *Message) {
+		closed := *stored.Poll
+		closed.Closed = true
+		stored.Poll = &closed
+	})
+	if err != nil {
+		log.Printf("error closing poll %s in room %s: %v", poll.ID, h.Room, err)
+		return
+	}
+	h.fanout(h.event(&Message{Kind: KindPollClosed, Ref: poll.ID, Body: updated.Body, Poll: updated.Poll}))
+	h.announce(fmt.Sprintf("Poll closed: %s (%s)", updated.Body, updated.Poll.results()))
+}
+
+// applyPoll stores the tally or the results of a poll published by another replica
+func (h *Hub) applyPoll(m *Message) {
+	if h.history == nil || m.Poll == nil {
+		return
+	}
+	if _, err := h.history.Update(m.Ref, func(stored *Message) {
+		stored.Poll = m.Poll
+	}); err != nil && err != ErrMessageNotFound {
+		log.Printf("error storing relayed poll %s in room %s: %v", m.Ref, h.Room, err)
+	}
+	if m.Poll.Closed {
+		h.stopPollTimer(m.Ref)
+	}
+}
@@ -0,0 +1,42 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollTimers(t *testing.T) {
+	h := newTestHub(t, DefaultConfig())
+	h.history = NewMemoryHistory(20)
+	c := newClient(h, ClientInfo{ID: "alice", Name: "alice", Version: ProtocolVersion})
+	h.add(c)
+	poll := func() string {
+		m := &Message{Kind: KindPoll, Body: "lunch?", Duration: 3600, SenderID: c.ID, DisplayName: c.Name, from: c,
+			Poll: &Poll{Options: []PollOption{{Text: "pizza"}, {Text: "sushi"}}}}
+		h.createPoll(m)
+		if h.pollTimers[m.ID] == nil {
+			t.Fatal("poll with a time limit has no close timer")
+		}
+		return m.ID
+	}
+
+	// Closing a poll early stops its timer
+	early := poll()
+	timer := h.pollTimers[early]
+	h.closePoll(&Message{Kind: KindPollClose, Ref: early, SenderID: c.ID, from: c})
+	if _, ok := h.pollTimers[early]; ok || timer.Stop() {
+		t.Error("timer of a closed poll is still running")
+	}
+
+	// Closing the hub stops the timers of the polls still open
+	timers := []*time.Timer{h.pollTimers[poll()], h.pollTimers[poll()]}
+	h.shutdown()
+	if len(h.pollTimers) != 0 {
+		t.Errorf("%d poll timers left after shutdown", len(h.pollTimers))
+	}
+	for _, timer := range timers {
+		if timer.Stop() {
+			t.Error("timer of an open poll is still running after shutdown")
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package chat
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// presenceBuffer is the number of presence events queued for a signaling connection
+const presenceBuffer = 64
+
+// Participant is a member of the room as shown in the presence roster
+type Participant struct {
+	ID       string    `json:"id"`        // Id of the participant
+	Name     string    `json:"name"`      // Display name of the participant
+	Role     Role      `json:"role"`      // Role of the participant in the room
+	JoinedAt time.Time `json:"joined_at"` // When the participant arrived
+	Chat     bool      `json:"chat"`      // Whether the participant has a chat connection
+	Media    bool      `json:"media"`     // Whether the participant has an audio and video connection
+}
+
+// presence is a roster entry with the connections that keep it alive
+type presence struct {
+	Participant
+	chat  int // Open chat connections
+	media int // Open signaling connections
+}
+
+// PresenceWatch streams the presence events of a room to a signaling connection
+type PresenceWatch struct {
+	Events chan []byte // Encoded presence messages, closed when the watch ends
+
+	hub  *Hub
+	info ClientInfo
+	once sync.Once
+}
+
+// presenceChange is a signaling connection joining or leaving the roster
+type presenceChange struct {
+	watch *PresenceWatch
+	join  bool
+}
+
+// JoinMedia adds a participant connected over signaling to the roster.
+// The returned watch starts with a snapshot of the roster, it is nil if the hub has been closed.
+func (h *Hub) JoinMedia(info ClientInfo) *PresenceWatch {
+	w := &PresenceWatch{Events: make(chan []byte, presenceBuffer), hub: h, info: info}
+	select {
+	case h.presence <- presenceChange{watch: w, join: true}:
+		return w
+	case <-h.done:
+		return nil
+	}
+}
+
+// Leave removes the signaling connection from the roster, its Events channel is then closed
+func (w *PresenceWatch) Leave() {
+	w.once.Do(func() {
+		select {
+		case w.hub.presence <- presenceChange{watch: w}:
+		case <-w.hub.done:
+		}
+	})
+}
+
+// deliver queues an event without blocking, events are dropped if the connection falls behind
+func (w *PresenceWatch) deliver(data []byte) {
+	select {
+	case w.Events <- data:
+	default:
+		log.Printf("dropping presence event for %s", w.info.ID)
+	}
+}
+
+// changePresence handles a signaling connection joining or leaving, it runs on the hub goroutine
+func (h *Hub) changePresence(c presenceChange) {
+	info := c.watch.info
+	if !c.join {
+		if !h.watchers[c.watch] {
+			return
+		}
+		delete(h.watchers, c.watch)
+		close(c.watch.Events)
+		h.updatePresence(info.ID, "", "", 0, -1)
+		return
+	}
+
+	role := RoleParticipant
+	if h.IsHost(info.ID) {
+		role = RoleHost
+	}
+	name := cleanName(info.Name, info.ID)
+	h.membersLock.RLock()
+	if m := h.members[info.ID]; m != nil && info.Name == "" {
+		name = m.name
+	}
+	h.membersLock.RUnlock()
+
+	h.watchers[c.watch] = true
+	h.updatePresence(info.ID, name, role, 0, 1)
+	c.watch.deliver(encodeJSON(h.roster()))
+}
+
+// updatePresence applies a change of connections, name or role of a participant to the roster
+// and tells everyone about it. Empty names and roles leave the current ones in place.
+func (h *Hub) updatePresence(id, name string, role Role, chat, media int) {
+	p := h.present[id]
+	joined := p == nil
+	if joined {
+		if chat+media <= 0 {
+			return
+		}
+		p = &presence{Participant: Participant{ID: id, Name: name, Role: role, JoinedAt: time.Now().UTC()}}
+		h.present[id] = p
+	}
+	before := p.Participant
+	p.chat += chat
+	p.media += media
+	if p.chat+p.media <= 0 {
+		delete(h.present, id)
+		h.sendPresence(KindLeave, before)
+		return
+	}
+
+	if name != "" {
+		p.Name = name
+	}
+	if role != "" && roleRank(role) > roleRank(p.Role) {
+		p.Role = role
+	}
+	p.Chat = p.chat > 0
+	p.Media = p.media > 0
+	switch {
+	case joined:
+		h.sendPresence(KindJoin, p.Participant)
+	case p.Participant != before:
+		h.sendPresence(KindPresenceUpdate, p.Participant)
+	}
+}
+
+// sendPresence sends a join, leave or update event to chat and signaling clients
+func (h *Hub) sendPresence(kind Kind, p Participant) {
+	if p.Role == RoleViewer && !p.Media && h.crowded() {
+		// Viewers of a large audience are only counted in the roster snapshots
+		return
+	}
+	m := h.event(&Message{Kind: kind, SenderID: p.ID, DisplayName: p.Name, Participants: []Participant{p}})
+	h.fanout(m)
+	data := encodeJSON(m)
+	for w := range h.watchers {
+		w.deliver(data)
+	}
+}
+
+// crowded reports whether the room has more participants than its roster lists
+func (h *Hub) crowded() bool {
+	return len(h.present) >= h.config.Fanout.RosterLimit
+}
+
+// roster returns a snapshot of the participants of the room, earliest arrivals first.
+// In a crowded room hosts and media participants come before viewers, and the count
+// tells how many are in the room.
+func (h *Hub) roster() *Message {
+	crowded := h.crowded()
+	participants := make([]Participant, 0, len(h.present))
+	for _, p := range h.present {
+		participants = append(participants, p.Participant)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		if crowded {
+			a, b := listedFirst(participants[i]), listedFirst(participants[j])
+			if a != b {
+				return a
+			}
+		}
+		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
+	})
+
+	m := &Message{Kind: KindPresence, Participants: participants}
+	if crowded {
+		if len(participants) > h.config.Fanout.RosterLimit {
+			m.Participants = participants[:h.config.Fanout.RosterLimit]
+		}
+		m.Count = len(participants)
+	}
+	return h.event(m)
+}
+
+// listedFirst reports whether a participant keeps its place in the roster of a crowded room
+func listedFirst(p Participant) bool {
+	return p.Role != RoleViewer || p.Media
+}
+
+// roleRank orders roles so that a participant shows up with the strongest one it holds
+func roleRank(role Role) int {
+	switch role {
+	case RoleHost:
+		return 3
+	case RoleParticipant:
+		return 2
+	case RoleViewer:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,262 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Limits of the question queue
+const (
+	maxQuestions      = 200 // Most questions kept per room
+	maxQuestionLength = 300 // Longest question in characters
+)
+
+// QuestionStatus is the stage a question of the Q&A queue is in
+type QuestionStatus string
+
+// Stages of a question
+const (
+	QuestionPending   QuestionStatus = "pending"   // Waiting for a host, only shown to hosts and its author
+	QuestionApproved  QuestionStatus = "approved"  // In the public queue, open for upvotes
+	QuestionAnswered  QuestionStatus = "answered"  // Answered by a host
+	QuestionDismissed QuestionStatus = "dismissed" // Rejected by a host, only shown to hosts and its author
+)
+
+// Question is an entry of the Q&A queue, kept apart from the chat history
+type Question struct {
+	ID          string         `json:"id"`                    // Unique id of the question
+	SenderID    string         `json:"sender_id"`             // Participant who asked the question
+	DisplayName string         `json:"display_name"`          // Name of the participant when asking
+	Body        string         `json:"body"`                  // Text of the question
+	HTML        string         `json:"html,omitempty"`        // Body rendered from its Markdown subset
+	AskedAt     time.Time      `json:"ts"`                    // When the question was asked
+	Status      QuestionStatus `json:"status"`                // Stage of the question
+	Voters      []string       `json:"voters,omitempty"`      // Participants who upvoted the question
+	AnsweredAt  *time.Time     `json:"answered_at,omitempty"` // When a host marked the question answered
+}
+
+// qaState is the Q&A mode and queue of a room, read outside the hub goroutine by exports
+type qaState struct {
+	lock      sync.RWMutex // Mutex for the fields below
+	open      bool         // Whether viewers may ask questions
+	questions []*Question  // Questions in the order they were asked, replaced on every change
+}
+
+// questionRank orders the stages in the queue, open questions first
+var questionRank = map[QuestionStatus]int{
+	QuestionApproved:  0,
+	QuestionPending:   1,
+	QuestionAnswered:  2,
+	QuestionDismissed: 3,
+}
+
+// Questions returns the Q&A queue in the order it is shown: approved questions by upvotes,
+// then pending, answered and dismissed ones
+func (h *Hub) Questions() []*Question {
+	h.qa.lock.RLock()
+	questions := append([]*Question{}, h.qa.questions...)
+	h.qa.lock.RUnlock()
+
+	sort.SliceStable(questions, func(i, j int) bool {
+		a, b := questions[i], questions[j]
+		if questionRank[a.Status] != questionRank[b.Status] {
+			return questionRank[a.Status] < questionRank[b.Status]
+		}
+		if a.Status == QuestionApproved && len(a.Voters) != len(b.Voters) {
+			return len(a.Voters) > len(b.Voters)
+		}
+		return false // Otherwise the order they were asked in
+	})
+	return questions
+}
+
+// QAOpen reports whether the room takes questions
+func (h *Hub) QAOpen() bool {
+	h.qa.lock.RLock()
+	defer h.qa.lock.RUnlock()
+	return h.qa.open
+}
+
+// setQA opens or closes the Q&A on behalf of a host
+func (h *Hub) setQA(m *Message) {
+	if !h.IsHost(m.SenderID) {
+		m.from.notify(KindWarning, "Only hosts can open or close the Q&A.")
+		return
+	}
+	open := m.Body == "open"
+	h.qa.lock.Lock()
+	changed := h.qa.open != open
+	h.qa.open = open
+	h.qa.lock.Unlock()
+	if !changed {
+		return
+	}
+
+	if open {
+		h.announce(fmt.Sprintf("%s opened the Q&A, ask with /ask <question>.", m.DisplayName))
+	} else {
+		h.announce(fmt.Sprintf("%s closed the Q&A.", m.DisplayName))
+	}
+	h.sendQA()
+}
+
+// ask adds a question to the queue, questions of hosts skip the approval
+func (h *Hub) ask(m *Message) {
+	if !h.QAOpen() {
+		m.from.notify(KindWarning, "The Q&A is not open.")
+		return
+	}
+	if muted := h.mutedFor(m.SenderID); muted > 0 {
+		m.from.notify(KindWarning, fmt.Sprintf("You are muted for another %s.", muted.Round(time.Second)))
+		return
+	}
+	if m.Body == "" || len([]rune(m.Body)) > maxQuestionLength {
+		m.from.notify(KindWarning, fmt.Sprintf("Questions need 1 to %d characters.", maxQuestionLength))
+		return
+	}
+	// Chat modes such as slow mode apply to questions like they do to messages
+	if !h.allowPost(m) {
+		return
+	}
+
+	h.render(m)
+	q := &Question{
+		ID:          uuid.New().String(),
+		SenderID:    m.SenderID,
+		DisplayName: m.DisplayName,
+		Body:        m.Body,
+		HTML:        m.HTML,
+		AskedAt:     time.Now().UTC(),
+		Status:      QuestionPending,
+	}
+	if h.IsHost(m.SenderID) {
+		q.Status = QuestionApproved
+	}
+
+	h.qa.lock.Lock()
+	if len(h.qa.questions) >= maxQuestions {
+		h.qa.lock.Unlock()
+		m.from.notify(KindWarning, "The question queue is full.")
+		return
+	}
+	h.qa.questions = append(h.qa.questions[:len(h.qa.questions):len(h.qa.questions)], q)
+	h.qa.lock.Unlock()
+
+	if q.Status == QuestionPending {
+		m.from.notify(KindSystem, "Your question was sent to the hosts for approval.")
+	}
+	h.sendQA()
+}
+
+// updateQuestion applies an upvote or a host decision to the question Ref
+func (h *Hub) updateQuestion(m *Message) {
+	host := h.IsHost(m.SenderID)
+	if !host && m.Kind != KindUpvote && m.Kind != KindUnvote {
+		m.from.notify(KindWarning, "Only hosts can moderate questions.")
+		return
+	}
+
+	h.qa.lock.Lock()
+	i := h.findQuestion(m.Ref)
+	if i < 0 {
+		h.qa.lock.Unlock()
+		m.from.notify(KindWarning, "Unknown question "+m.Ref+".")
+		return
+	}
+	// Questions are copied on write so exports and encoders never see them change
+	q := *h.qa.questions[i]
+	switch m.Kind {
+	case KindUpvote, KindUnvote:
+		if q.Status != QuestionApproved {
+			h.qa.lock.Unlock()
+			m.from.notify(KindWarning, "Only open questions can be upvoted.")
+			return
+		}
+		q.Voters = toggleID(q.Voters, m.SenderID, m.Kind == KindUpvote)
+	case KindApprove:
+		q.Status = QuestionApproved
+		q.AnsweredAt = nil
+	case KindAnswer:
+		now := time.Now().UTC()
+		q.Status = QuestionAnswered
+		q.AnsweredAt = &now
+	case KindDismiss:
+		q.Status = QuestionDismissed
+	}
+	questions := append([]*Question{}, h.qa.questions...)
+	questions[i] = &q
+	h.qa.questions = questions
+	h.qa.lock.Unlock()
+
+	h.sendQA()
+}
+
+// findQuestion returns the index of a question, the caller holds the Q&A lock
+func (h *Hub) findQuestion(id string) int {
+	for i, q := range h.qa.questions {
+		if q.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// qaState returns the Q&A event for a participant, with the questions it may see
+func (h *Hub) qaState(id string, host bool) *Message {
+	return h.qaEvent(h.QAOpen(), h.Questions(), id, host)
+}
+
+// qaEvent builds the Q&A event for a participant out of the queue in the order it is shown.
+// An empty id and no host gives the public queue.
+func (h *Hub) qaEvent(open bool, questions []*Question, id string, host bool) *Message {
+	state := h.event(&Message{Kind: KindQAState, Questions: []*Question{}})
+	if open {
+		state.Body = "open"
+	}
+	for _, q := range questions {
+		if host || q.SenderID == id || q.Status == QuestionApproved || q.Status == QuestionAnswered {
+			state.Questions = append(state.Questions, q)
+		}
+	}
+	return state
+}
+
+// sendQA sends the Q&A queue to every client, to the other replicas of the room and to the webhooks.
+// Pending and dismissed questions are only sent to hosts and their authors.
+func (h *Hub) sendQA() {
+	h.deliverQA()
+	h.publish(h.qaState("", true), nil)
+	h.hook(h.qaState("", false))
+}
+
+// deliverQA sends the Q&A queue to the clients of this hub. The public queue is encoded once
+// for the whole room, hosts and the authors of hidden questions then get their own view.
+func (h *Hub) deliverQA() {
+	open, questions := h.QAOpen(), h.Questions()
+	h.queue(h.qaEvent(open, questions, "", false), "")
+
+	hidden := make(map[string]bool)
+	for _, q := range questions {
+		if q.Status == QuestionPending || q.Status == QuestionDismissed {
+			hidden[q.SenderID] = true
+		}
+	}
+	for client := range h.clients {
+		if client.Role == RoleHost || hidden[client.ID] {
+			// Queued behind the public queue, so it replaces it
+			h.unicast(client, client.encode(h.qaEvent(open, questions, client.ID, client.Role == RoleHost)))
+		}
+	}
+}
+
+// setQAState applies the Q&A queue published by another replica
+func (h *Hub) setQAState(m *Message) {
+	h.qa.lock.Lock()
+	h.qa.open = m.Body == "open"
+	h.qa.questions = append([]*Question{}, m.Questions...)
+	h.qa.lock.Unlock()
+}
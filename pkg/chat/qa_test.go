@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAskFollowsPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		host   bool
+		asks   []string
+		queued int // Questions that made it into the queue
+	}{
+		{"no modes", Policy{}, false, []string{"why?", "how?"}, 2},
+		{"slow mode", Policy{SlowMode: 60}, false, []string{"why?", "how?"}, 1},
+		{"followers-only", Policy{FollowersOnly: true, FollowerAge: 600}, false, []string{"why?"}, 0},
+		{"emote-only", Policy{EmoteOnly: true}, false, []string{"why?", "🎉"}, 1},
+		{"hosts are exempt", Policy{SlowMode: 60, EmoteOnly: true}, true, []string{"why?", "how?"}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHub(t, DefaultConfig())
+			h.qa.open = true
+			h.policy.policy = test.policy
+			c := newClient(h, ClientInfo{ID: "alice", Name: "alice", Version: ProtocolVersion})
+			if test.host {
+				h.mod.hosts["alice"] = true
+			}
+			h.add(c)
+			for _, body := range test.asks {
+				h.ask(&Message{Kind: KindQuestion, Body: body, SenderID: c.ID, DisplayName: c.Name, from: c, Timestamp: time.Now()})
+			}
+			if queued := len(h.Questions()); queued != test.queued {
+				t.Errorf("%d questions queued, want %d", queued, test.queued)
+			}
+		})
+	}
+}
+
+func TestDeliverQA(t *testing.T) {
+	config := DefaultConfig()
+	config.Fanout.Shards = 2
+	h := newTestHub(t, config)
+	h.mod.hosts["host"] = true
+	clients := map[string]*Client{}
+	for _, id := range []string{"host", "author", "dismissed", "viewer"} {
+		clients[id] = newClient(h, ClientInfo{ID: id, Name: id, Version: ProtocolVersion})
+		h.add(clients[id])
+	}
+	h.qa.questions = []*Question{
+		{ID: "q1", SenderID: "author", Status: QuestionPending},
+		{ID: "q2", SenderID: "viewer", Status: QuestionApproved},
+		{ID: "q3", SenderID: "dismissed", Status: QuestionDismissed},
+		{ID: "q4", SenderID: "host", Status: QuestionAnswered},
+	}
+	h.deliverQA()
+	h.stopFanout()
+
+	tests := []struct {
+		id     string
+		states int      // Q&A events received
+		want   []string // Questions of the last one
+	}{
+		{"host", 2, []string{"q2", "q1", "q4", "q3"}},
+		{"author", 2, []string{"q2", "q1", "q4"}},
+		{"dismissed", 2, []string{"q2", "q4", "q3"}},
+		{"viewer", 1, []string{"q2", "q4"}},
+	}
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			var states []*Message
+			for _, m := range received(t, clients[test.id]) {
+				if m.Kind == KindQAState {
+					states = append(states, m)
+				}
+			}
+			if len(states) != test.states {
+				t.Fatalf("%d Q&A events, want %d", len(states), test.states)
+			}
+			var got []string
+			for _, q := range states[len(states)-1].Questions {
+				got = append(got, q.ID)
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("last Q&A event shows %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// RateLimit configures the flood protection applied to chat clients.
+// Only a participant's own bucket counts violations and escalates to mutes and disconnects.
+// The limits of an IP are coarse caps shared by everyone behind it, such as a campus or an office
+// network, so going over them holds messages back without blaming anyone.
+type RateLimit struct {
+	Rate            float64       // Messages per second a single client may send
+	Burst           int           // Messages a single client may send at once
+	IPRate          float64       // Messages per second all clients behind one IP may send
+	IPBurst         int           // Messages all clients behind one IP may send at once
+	IPConnections   int           // Connections all clients behind one IP may hold in the room, 0 for no cap
+	MuteAfter       int           // Violations after which the client is muted
+	MuteFor         time.Duration // How long a mute lasts
+	DisconnectAfter int           // Violations after which the client is disconnected
+	Forgive         time.Duration // Quiet period after which the violation count is reset, 0 never forgives
+}
+
+// tokenBucket is a classic token bucket refilled continuously over time
+type tokenBucket struct {
+	tokens float64   // Tokens currently available
+	last   time.Time // Time the bucket was last refilled
+}
+
+// take refills the bucket and consumes a token if one is available
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ipLimiter holds the token buckets shared by all clients behind the same IP
+type ipLimiter struct {
+	lock    sync.Mutex              // Mutex for the buckets map
+	buckets map[string]*tokenBucket // Buckets by IP address
+	swept   time.Time               // Time idle buckets were last removed
+}
+
+// take consumes a token from the bucket of an IP
+func (l *ipLimiter) take(ip string, now time.Time, rate float64, burst int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Drop buckets that have been idle long enough to be full again
+	if now.Sub(l.swept) > time.Minute {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{}
+		l.buckets[ip] = b
+	}
+	return b.take(now, rate, burst)
+}
+
+// floodState holds the token buckets of one client, it is only used by readPump
+type floodState struct {
+	bucket    tokenBucket // Per-client token bucket
+	ephemeral tokenBucket // Separate bucket for typing and read events
+}
+
+// floodRecord is the escalation of a participant, it outlives their connections
+type floodRecord struct {
+	violations    int       // Violations since the last quiet period
+	lastViolation time.Time // Time of the most recent violation
+	mutedUntil    time.Time // End of the current mute
+}
+
+// floodTracker keeps the escalation of the room by participant id, so that reconnecting does not
+// start it over
+type floodTracker struct {
+	lock    sync.Mutex              // Mutex for the fields below
+	records map[string]*floodRecord // Records by participant id
+	swept   time.Time               // Time forgiven records were last removed
+}
+
+// forgiven reports whether a record has been quiet long enough for its violations to be forgotten
+func (r *floodRecord) forgiven(now time.Time, limit *RateLimit) bool {
+	return limit.Forgive > 0 && now.Sub(r.lastViolation) > limit.Forgive
+}
+
+// get returns the record of a participant, forgiving it if it has been quiet long enough.
+// It returns nil if there is none and create is false. The caller holds the lock.
+func (t *floodTracker) get(id string, now time.Time, limit *RateLimit, create bool) *floodRecord {
+	// Drop records that have been forgiven and whose mute is over
+	if now.Sub(t.swept) > time.Minute {
+		for key, r := range t.records {
+			if r.forgiven(now, limit) && now.After(r.mutedUntil) {
+				delete(t.records, key)
+			}
+		}
+		t.swept = now
+	}
+
+	r, ok := t.records[id]
+	if !ok {
+		if !create {
+			return nil
+		}
+		r = &floodRecord{}
+		t.records[id] = r
+	}
+	if r.violations > 0 && r.forgiven(now, limit) {
+		r.violations = 0
+	}
+	return r
+}
+
+// escalate records the outcome of the rate limit of a participant for a message and decides what
+// happens to it
+func (t *floodTracker) escalate(id string, now time.Time, allowed bool, limit *RateLimit) floodAction {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r := t.get(id, now, limit, !allowed)
+	muted := r != nil && now.Before(r.mutedUntil)
+	if allowed {
+		if muted {
+			return floodDrop
+		}
+		return floodAllow
+	}
+
+	r.violations++
+	r.lastViolation = now
+	switch {
+	case limit.DisconnectAfter > 0 && r.violations >= limit.DisconnectAfter:
+		return floodDisconnect
+	case limit.MuteAfter > 0 && r.violations >= limit.MuteAfter && !muted:
+		r.mutedUntil = now.Add(limit.MuteFor)
+		return floodMute
+	case r.violations == 1:
+		return floodWarn
+	}
+	return floodDrop
+}
+
+// standing tells whether a participant joining the room has been disconnected for flooding and
+// not been forgiven yet, and how long its mute still lasts
+func (t *floodTracker) standing(id string, now time.Time, limit *RateLimit) (barred bool, muted time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r := t.get(id, now, limit, false)
+	if r == nil {
+		return false, 0
+	}
+	barred = limit.DisconnectAfter > 0 && r.violations >= limit.DisconnectAfter
+	if left := r.mutedUntil.Sub(now); left > 0 {
+		muted = left
+	}
+	return barred, muted
+}
+
+// floodAction is what readPump has to do with a message after the flood check
+type floodAction int
+
+const (
+	floodAllow      floodAction = iota // Forward the message
+	floodDrop                          // Drop the message silently
+	floodWarn                          // Drop the message and warn the client
+	floodMute                          // Drop the message and mute the client
+	floodDisconnect                    // Drop the message and disconnect the client
+	floodShared                        // Drop the message, the IP of the client is over its limit
+)
+
+// checkFlood applies the rate limits to a message sent by the client
+func (c *Client) checkFlood(now time.Time) floodAction {
+	limit := c.Hub.config.RateLimit
+	if limit == nil {
+		return floodAllow
+	}
+
+	if !c.flood.bucket.take(now, limit.Rate, limit.Burst) {
+		return c.Hub.floods.escalate(c.ID, now, false, limit)
+	}
+	action := c.Hub.floods.escalate(c.ID, now, true, limit)
+	if action == floodAllow && limit.IPRate > 0 && c.IP != "" && !c.Hub.ips.take(c.IP, now, limit.IPRate, limit.IPBurst) {
+		return floodShared
+	}
+	return action
+}
+
+// admitFlooder checks a joining client against the flood protection of the room.
+// A participant disconnected for flooding is turned away until it has been forgiven, and an IP
+// cannot hold more than its share of connections. It reports whether the client may join.
+func (h *Hub) admitFlooder(c *Client) bool {
+	limit := h.config.RateLimit
+	if limit == nil {
+		return true
+	}
+	if barred, _ := h.floods.standing(c.ID, time.Now(), limit); barred {
+		h.audit(AuditDisconnect, c.ID, c.displayName(), c.IP, "", "rejoined while flooding")
+		c.close(websocket.ClosePolicyViolation, "flooding")
+		return false
+	}
+	if limit.IPConnections > 0 && c.IP != "" && h.ipConns[c.IP] >= limit.IPConnections {
+		h.audit(AuditDisconnect, c.ID, c.displayName(), c.IP, "", "too many connections from the IP")
+		c.close(websocket.ClosePolicyViolation, "too many connections")
+		return false
+	}
+	return true
+}
+
+// remindFloodMute tells a client that joined while muted for flooding how long the mute lasts
+func (h *Hub) remindFloodMute(c *Client) {
+	limit := h.config.RateLimit
+	if limit == nil {
+		return
+	}
+	if _, muted := h.floods.standing(c.ID, time.Now(), limit); muted > 0 {
+		c.notify(KindWarning, fmt.Sprintf("You are still muted for %s for flooding the chat.", muted.Round(time.Second)))
+	}
+}
+
+// enforceFlood carries out a flood action and reports whether the message may be forwarded.
+// It returns false together with closed set when the client has been disconnected.
+func (c *Client) enforceFlood(action floodAction) (forward bool, closed bool) {
+	limit := c.Hub.config.RateLimit
+	switch action {
+	case floodAllow:
+		return true, false
+	case floodWarn:
+		c.Hub.audit(AuditWarn, c.ID, c.displayName(), c.IP, "", "sending messages too fast")
+		c.notify(KindWarning, "You are sending messages too fast, slow down or you will be muted.")
+	case floodMute:
+		c.Hub.audit(AuditMute, c.ID, c.displayName(), c.IP, "", "flooding, muted for "+limit.MuteFor.String())
+		c.notify(KindWarning, "You have been muted for "+limit.MuteFor.String()+" for flooding the chat.")
+	case floodDisconnect:
+		c.Hub.audit(AuditDisconnect, c.ID, c.displayName(), c.IP, "", "flooding")
+		c.disconnect(websocket.ClosePolicyViolation, "flooding")
+		return false, true
+	case floodShared:
+		c.notify(KindWarning, "Too many messages are coming from your network, try again in a moment.")
+	}
+	return false, false
+}
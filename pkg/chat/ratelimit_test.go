@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		at    []time.Duration // When each token is taken, after start
+		want  []bool
+	}{
+		{"burst then empty", 1, 3, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refills over time", 1, 1, []time.Duration{0, 0, time.Second}, []bool{true, false, true}},
+		{"partial refill is not enough", 2, 1, []time.Duration{0, 0, 400 * time.Millisecond, 500 * time.Millisecond}, []bool{true, false, false, true}},
+		{"refill capped at burst", 10, 2, []time.Duration{0, 0, time.Minute, time.Minute, time.Minute}, []bool{true, true, true, true, false}},
+		{"zero burst never allows", 1, 0, []time.Duration{0, time.Second}, []bool{false, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &tokenBucket{}
+			for i, at := range test.at {
+				if got := b.take(start.Add(at), test.rate, test.burst); got != test.want[i] {
+					t.Errorf("take %d at %v = %v, want %v", i, at, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIPLimiterTake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	l := &ipLimiter{buckets: make(map[string]*tokenBucket)}
+	tests := []struct {
+		ip   string
+		at   time.Duration
+		want bool
+	}{
+		{"10.0.0.1", 0, true},
+		{"10.0.0.1", 0, true},
+		{"10.0.0.1", 0, false}, // Both tokens of the IP are used
+		{"10.0.0.2", 0, true},  // Other IPs have their own bucket
+		{"10.0.0.1", 2 * time.Minute, true},
+	}
+	for i, test := range tests {
+		if got := l.take(test.ip, start.Add(test.at), 1, 2); got != test.want {
+			t.Errorf("take %d from %s = %v, want %v", i, test.ip, got, test.want)
+		}
+	}
+	if _, ok := l.buckets["10.0.0.2"]; ok {
+		t.Error("idle bucket of 10.0.0.2 was not swept")
+	}
+}
+
+func TestFloodEscalationSurvivesReconnect(t *testing.T) {
+	limit := &RateLimit{Rate: 0.001, Burst: 1, MuteAfter: 2, MuteFor: time.Minute, DisconnectAfter: 4, Forgive: time.Minute}
+	tests := []struct {
+		name string
+		id   string // Participant id of the connection, a new connection for every step
+		ip   string
+		want floodAction // Outcome of a message over the limit
+	}{
+		{"first violation", "alice", "10.0.0.1", floodWarn},
+		{"reconnected", "alice", "10.0.0.1", floodMute},
+		{"someone else on the same IP", "bob", "10.0.0.1", floodWarn},
+		{"same id from another IP", "alice", "10.0.0.2", floodDrop},
+		{"fourth violation of the id", "alice", "10.0.0.2", floodDisconnect},
+	}
+	config := DefaultConfig()
+	config.RateLimit = limit
+	h := newTestHub(t, config)
+	now := time.Now()
+	for _, test := range tests {
+		c := newClient(h, ClientInfo{ID: test.id, Name: test.id, IP: test.ip, Version: ProtocolVersion})
+		c.flood.bucket.take(now, limit.Rate, limit.Burst) // Use up the burst of the fresh connection
+		if got := c.checkFlood(now); got != test.want {
+			t.Errorf("%s: checkFlood = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// The flooder is turned away when it comes back, until it has been forgiven
+	if barred, _ := h.floods.standing("alice", now, limit); !barred {
+		t.Error("flooder was let back in")
+	}
+	if barred, muted := h.floods.standing("alice", now.Add(2*time.Minute), limit); barred || muted > 0 {
+		t.Errorf("forgiven flooder barred = %v, muted for %v", barred, muted)
+	}
+
+	// Others behind the flooder's addresses are not held to its record
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		c := newClient(h, ClientInfo{ID: "carol", Name: "carol", IP: ip, Version: ProtocolVersion})
+		if !h.admitFlooder(c) {
+			t.Errorf("carol was turned away from %s", ip)
+		}
+		if got := c.checkFlood(now); got != floodAllow {
+			t.Errorf("carol from %s: checkFlood = %v, want %v", ip, got, floodAllow)
+		}
+	}
+}
+
+func TestFloodSharedIP(t *testing.T) {
+	limit := &RateLimit{Rate: 100, Burst: 100, IPRate: 0.001, IPBurst: 3, MuteAfter: 1, MuteFor: time.Minute, DisconnectAfter: 2, IPConnections: 2}
+	config := DefaultConfig()
+	config.RateLimit = limit
+	h := newTestHub(t, config)
+	now := time.Now()
+
+	// Everyone behind the address shares its bucket, going over it blames nobody
+	want := []floodAction{floodAllow, floodAllow, floodAllow, floodShared, floodShared, floodShared}
+	for i, id := range []string{"alice", "bob", "carol", "alice", "bob", "alice"} {
+		c := newClient(h, ClientInfo{ID: id, Name: id, IP: "10.0.0.1", Version: ProtocolVersion})
+		if got := c.checkFlood(now); got != want[i] {
+			t.Errorf("message %d by %s: checkFlood = %v, want %v", i, id, got, want[i])
+		}
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if barred, muted := h.floods.standing(id, now, limit); barred || muted > 0 {
+			t.Errorf("%s barred = %v, muted for %v", id, barred, muted)
+		}
+	}
+
+	// The address holds a limited number of connections
+	for i, id := range []string{"alice", "bob", "carol"} {
+		c := newClient(h, ClientInfo{ID: id, Name: id, IP: "10.0.0.1", Version: ProtocolVersion})
+		if admitted := h.admitFlooder(c); admitted != (i < 2) {
+			t.Errorf("%s admitted = %v, want %v", id, admitted, i < 2)
+		} else if admitted {
+			h.add(c)
+		}
+	}
+	for client := range h.byID["alice"] {
+		h.remove(client, 0, "")
+	}
+	if !h.admitFlooder(newClient(h, ClientInfo{ID: "carol", Name: "carol", IP: "10.0.0.1", Version: ProtocolVersion})) {
+		t.Error("carol was turned away after alice left")
+	}
+}
+
+func TestFloodForgive(t *testing.T) {
+	tests := []struct {
+		name     string
+		forgive  time.Duration
+		after    time.Duration // Quiet time before the next violation
+		want     floodAction
+		recorded bool // Whether the record is still kept after a sweep
+	}{
+		{"forgiven", time.Minute, 2 * time.Minute, floodWarn, false},
+		{"not yet forgiven", time.Minute, 30 * time.Second, floodDisconnect, true},
+		{"zero never forgives", 0, time.Hour, floodDisconnect, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limit := &RateLimit{DisconnectAfter: 2, Forgive: test.forgive}
+			tracker := &floodTracker{records: make(map[string]*floodRecord)}
+			now := time.Now()
+			tracker.escalate("alice", now, false, limit)
+
+			// A sweep runs before the record is looked at again
+			tracker.lock.Lock()
+			tracker.get("bob", now.Add(test.after), limit, false)
+			_, recorded := tracker.records["alice"]
+			tracker.lock.Unlock()
+			if recorded != test.recorded {
+				t.Errorf("record kept = %v, want %v", recorded, test.recorded)
+			}
+			if got := tracker.escalate("alice", now.Add(test.after), false, limit); got != test.want {
+				t.Errorf("second violation = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"log"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxEmojiLength      = 8  // Longest reaction in characters, enough for emoji sequences
+	maxEmojisPerMessage = 20 // Different emojis a single message can collect
+)
+
+// validEmoji reports whether a reaction looks like an emoji rather than text
+func validEmoji(emoji string) bool {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxEmojiLength {
+		return false
+	}
+	for _, r := range emoji {
+		if r < 0x80 || unicode.IsLetter(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// react adds or removes the reaction of a participant to a message and sends the change to everyone who can see it
+func (h *Hub) react(m *Message) {
+	if !validEmoji(m.Body) {
+		m.from.notify(KindWarning, "Reactions must be a single emoji.")
+		return
+	}
+	store, original := h.lookup(m.Ref)
+	if original == nil || original.Deleted {
+		m.from.notify(KindWarning, "Unknown message "+m.Ref+".")
+		return
+	}
+	if !original.visibleTo(m.SenderID) {
+		m.from.notify(KindWarning, "Unknown message "+m.Ref+".")
+		return
+	}
+
+	users := original.Reactions[m.Body]
+	reacted := false
+	for _, id := range users {
+		reacted = reacted || id == m.SenderID
+	}
+	if reacted == (m.Kind == KindReact) {
+		return // Nothing changes
+	}
+	if m.Kind == KindReact && len(users) == 0 && len(original.Reactions) >= maxEmojisPerMessage {
+		m.from.notify(KindWarning, "This message has too many different reactions.")
+		return
+	}
+
+	updated, err := store.Update(m.Ref, func(stored *Message) {
+		// Copy the map so readers of the previous version never see it change
+		reactions := make(map[string][]string, len(stored.Reactions)+1)
+		for emoji, ids := range stored.Reactions {
+			reactions[emoji] = ids
+		}
+		reactions[m.Body] = toggleID(reactions[m.Body], m.SenderID, m.Kind == KindReact)
+		if len(reactions[m.Body]) == 0 {
+			delete(reactions, m.Body)
+		}
+		stored.Reactions = reactions
+	})
+	if err != nil {
+		log.Printf("error storing reaction to chat message %s in room %s: %v", m.Ref, h.Room, err)
+		return
+	}
+
+	// Send the delta with the new count to everyone who can see the message
+	event := h.event(&Message{
+		Kind:        m.Kind,
+		Ref:         m.Ref,
+		Body:        m.Body,
+		SenderID:    m.SenderID,
+		DisplayName: m.DisplayName,
+		Count:       len(updated.Reactions[m.Body]),
+		To:          updated.To,
+	})
+	if len(updated.To) > 0 {
+		h.deliverTo(event, append([]string{updated.SenderID}, updated.To...))
+	} else {
+		h.fanout(event)
+	}
+}
+
+// toggleID returns a copy of ids with id added or removed
+func toggleID(ids []string, id string, add bool) []string {
+	result := make([]string, 0, len(ids)+1)
+	for _, existing := range ids {
+		if existing != id {
+			result = append(result, existing)
+		}
+	}
+	if add {
+		result = append(result, id)
+	}
+	return result
+}
@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"log"
+	"time"
+)
+
+// Rate limits of ephemeral events, which do not count against the chat flood protection
+const (
+	ephemeralRate  = 2 // Ephemeral events per second a client may send
+	ephemeralBurst = 5 // Ephemeral events a client may send at once
+)
+
+// ephemeral reports whether messages of a kind are fanned out without being stored
+func (k Kind) ephemeral() bool {
+	return k == KindTyping || k == KindTypingStop || k == KindRead
+}
+
+// allowEphemeral throttles the ephemeral events of a client, it is only used by readPump
+func (c *Client) allowEphemeral(now time.Time) bool {
+	return c.flood.ephemeral.take(now, ephemeralRate, ephemeralBurst)
+}
+
+// setTyping fans out a typing indicator to everyone but the typing participant
+func (h *Hub) setTyping(m *Message) {
+	typing := m.Kind == KindTyping
+	if h.typing[m.SenderID] == typing {
+		return
+	}
+	if typing {
+		h.typing[m.SenderID] = true
+	} else {
+		delete(h.typing, m.SenderID)
+	}
+	h.fanoutOthers(h.event(&Message{Kind: m.Kind, SenderID: m.SenderID, DisplayName: m.DisplayName}), m.SenderID)
+}
+
+// stopTyping clears the typing indicator of a participant that left
+func (h *Hub) stopTyping(id string) {
+	if h.typing[id] {
+		h.setTyping(&Message{Kind: KindTypingStop, SenderID: id, DisplayName: h.members[id].name})
+	}
+}
+
+// markRead records the last message a participant has read and tells the others
+func (h *Hub) markRead(m *Message) {
+	if m.Ref == "" || h.lastRead[m.SenderID] == m.Ref {
+		return
+	}
+	h.lastRead[m.SenderID] = m.Ref
+	h.fanoutOthers(h.event(&Message{Kind: KindRead, Ref: m.Ref, SenderID: m.SenderID, DisplayName: m.DisplayName}), m.SenderID)
+}
+
+// sendReadState tells a newly registered client where it stopped reading and how many messages it has not read,
+// followed by the read positions of the other connected participants
+func (h *Hub) sendReadState(client *Client) {
+	if ref, ok := h.lastRead[client.ID]; ok && h.history != nil {
+		messages, err := h.history.After(ref)
+		if err != nil && err != ErrUnknownCursor {
+			log.Printf("error reading chat history of room %s: %v", h.Room, err)
+		}
+		if err == nil {
+			unread := 0
+			for _, m := range messages {
+				if m.SenderID != client.ID && !m.Deleted {
+					unread++
+				}
+			}
+			client.deliver(client.encode(h.event(&Message{Kind: KindReadState, Ref: ref, Count: unread})))
+		}
+	}
+
+	for id := range h.byID {
+		if ref, ok := h.lastRead[id]; ok && id != client.ID {
+			client.deliver(client.encode(h.event(&Message{Kind: KindRead, Ref: ref, SenderID: id, DisplayName: h.members[id].name})))
+		}
+	}
+}
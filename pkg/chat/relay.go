@@ -0,0 +1,243 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+)
+
+// relayBuffer is the number of messages from other replicas queued for a hub.
+// The broker delivers every room over one subscription, so a hub whose queue is full drops
+// what arrives instead of holding up the others, and resyncs its clients once it caught up.
+const relayBuffer = 256
+
+// publishBuffer is the number of messages a hub queues for the broker. They are published by a
+// goroutine of its own, so a slow or unreachable broker never holds up the hub; once it falls this
+// far behind, further messages are dropped.
+const publishBuffer = 1024
+
+// relayed is the envelope of a message published to the hubs of the same room on other replicas.
+// Messages, edits, reactions, typing, the topic, pins, the host and moderation are shared; presence and
+// read positions stay local to each replica. Changes that need a host are only applied when the
+// receiving replica knows their sender as the host, so a replica cannot hand out authority on its own.
+type relayed struct {
+	Origin  string   `json:"origin"`       // Id of the hub that handled the message
+	To      []string `json:"to,omitempty"` // Participants the message is delivered to, empty for everyone
+	Message *Message `json:"message"`      // The message as fanned out by the origin
+}
+
+// relayTopic returns the broker topic of a room
+func relayTopic(room string) string {
+	return "chat:" + room
+}
+
+// relayed reports whether messages of a kind are shared with other replicas
+func (k Kind) relayed() bool {
+	switch k {
+	case KindWelcome, KindReadState, KindWarning, KindRejected, KindThread, KindVote, KindPollClose,
+		KindPresence, KindJoin, KindLeave, KindPresenceUpdate:
+		return false
+	}
+	return true
+}
+
+// subscribe starts receiving the messages published by the other replicas of the room
+func (h *Hub) subscribe() {
+	unsubscribe, err := h.config.Broker.Subscribe(relayTopic(h.Room), func(data []byte) {
+		r := &relayed{}
+		if err := json.Unmarshal(data, r); err != nil || r.Message == nil {
+			log.Printf("error decoding relayed chat message for room %s: %v", h.Room, err)
+			return
+		}
+		if r.Origin == h.origin {
+			return
+		}
+		select {
+		case h.relay <- r:
+		default:
+			if atomic.AddInt64(&h.relayDropped, 1) == 1 {
+				log.Printf("chat room %s is falling behind, dropping messages from other replicas", h.Room)
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("error subscribing to chat of room %s: %v", h.Room, err)
+		return
+	}
+	h.unsubscribe = unsubscribe
+}
+
+// resync sends the clients the room state and the Q&A queue again after messages from other
+// replicas were dropped, and tells them that some messages are missing from their log
+func (h *Hub) resync() {
+	dropped := atomic.SwapInt64(&h.relayDropped, 0)
+	if dropped == 0 {
+		return
+	}
+	log.Printf("chat room %s dropped %d messages from other replicas", h.Room, dropped)
+	h.fanoutLocal(h.roomState(), "")
+	h.fanoutLocal(h.event(&Message{Kind: KindWarning, Body: "The server fell behind, some messages may be missing from the chat."}), "")
+	h.deliverQA()
+}
+
+// publish shares a message handled by this hub with the other replicas of the room
+func (h *Hub) publish(m *Message, to []string) {
+	if h.config.Broker == nil || !m.Kind.relayed() {
+		return
+	}
+	data, err := json.Marshal(&relayed{Origin: h.origin, To: to, Message: m})
+	if err != nil {
+		return
+	}
+	select {
+	case h.outbox <- data:
+	default:
+		if atomic.AddInt64(&h.outboxDropped, 1) == 1 {
+			log.Printf("chat room %s is publishing faster than the broker takes it, dropping messages", h.Room)
+		}
+	}
+}
+
+// publishing hands the queued messages to the broker until the hub has stopped and its last
+// messages are out
+func (h *Hub) publishing() {
+	topic := relayTopic(h.Room)
+	send := func(data []byte) {
+		if err := h.config.Broker.Publish(topic, data); err != nil {
+			log.Printf("error publishing chat message of room %s: %v", h.Room, err)
+		}
+		if dropped := atomic.SwapInt64(&h.outboxDropped, 0); dropped > 0 {
+			log.Printf("chat room %s dropped %d messages for other replicas", h.Room, dropped)
+		}
+	}
+	for {
+		select {
+		case data := <-h.outbox:
+			send(data)
+		case <-h.done:
+			for {
+				select {
+				case data := <-h.outbox:
+					send(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// receive applies a message published by another replica and delivers it to the local clients
+func (h *Hub) receive(r *relayed) {
+	m := r.Message
+	switch m.Kind {
+	case KindHostClaim:
+		h.applyHostClaim(m)
+		return
+	case KindMute, KindUnmute, KindKick, KindBan, KindBanIP, KindUnban:
+		h.enforce(m)
+		return
+	case KindRoomState:
+		if !h.setRoomState(m) {
+			return
+		}
+	case KindQAState:
+		// The published queue holds every question, each client only gets the ones it may see
+		h.setQAState(m)
+		h.deliverQA()
+		return
+	case KindEdit, KindDelete:
+		if !h.applyChange(m) {
+			return
+		}
+	case KindReact, KindUnreact:
+		h.applyReaction(m)
+	case KindPollUpdate, KindPollClosed:
+		h.applyPoll(m)
+	}
+
+	// Messages with an id are stored, so replays and exports on this replica include them
+	if m.ID != "" {
+		store := h.history
+		if len(r.To) > 0 {
+			store = h.direct
+		}
+		if store != nil {
+			if err := store.Append(m); err != nil {
+				log.Printf("error storing relayed chat message in room %s: %v", h.Room, err)
+			}
+		}
+		if m.Parent != "" && h.history != nil {
+			if root, err := h.history.Get(m.Parent); err == nil {
+				h.countReply(root)
+			}
+		}
+	}
+
+	if len(r.To) > 0 {
+		h.deliverLocal(m, r.To)
+	} else {
+		h.fanoutLocal(m, "")
+	}
+}
+
+// applyChange stores an edit or a deletion made on another replica. Like changeMessage, it only
+// lets authors edit their messages and hosts delete the messages of others; it reports false if
+// the change is refused.
+func (h *Hub) applyChange(m *Message) bool {
+	store, original := h.lookup(m.Ref)
+	if store == nil {
+		return false
+	}
+	if original.SenderID != m.SenderID && (m.Kind == KindEdit || !h.IsHost(m.SenderID) || !original.visibleTo(m.SenderID)) {
+		log.Printf("ignoring change of chat message %s in room %s by %q", m.Ref, h.Room, m.SenderID)
+		return false
+	}
+	if _, err := store.Update(m.Ref, func(stored *Message) {
+		stored.Revisions = append(stored.Revisions, Revision{Body: stored.Body, Time: m.Timestamp, By: m.SenderID})
+		if m.Kind == KindDelete {
+			stored.Deleted = true
+			stored.Body = ""
+			stored.HTML = ""
+			stored.Mentions = nil
+			return
+		}
+		stored.Body = m.Body
+		stored.HTML = m.HTML
+		stored.Mentions = m.Mentions
+		stored.EditedAt = m.EditedAt
+	}); err != nil {
+		log.Printf("error changing relayed chat message %s in room %s: %v", m.Ref, h.Room, err)
+		return false
+	}
+
+	// Pinned messages are shown from the room state, which follows their changes
+	if h.isPinned(m.Ref) {
+		if m.Kind == KindDelete {
+			h.unpinDeleted(m.Ref)
+		}
+		h.fanoutLocal(h.roomState(), "")
+	}
+	return true
+}
+
+// applyReaction stores a reaction made on another replica
+func (h *Hub) applyReaction(m *Message) {
+	store, _ := h.lookup(m.Ref)
+	if store == nil {
+		return
+	}
+	if _, err := store.Update(m.Ref, func(stored *Message) {
+		reactions := make(map[string][]string, len(stored.Reactions)+1)
+		for emoji, ids := range stored.Reactions {
+			reactions[emoji] = ids
+		}
+		reactions[m.Body] = toggleID(reactions[m.Body], m.SenderID, m.Kind == KindReact)
+		if len(reactions[m.Body]) == 0 {
+			delete(reactions, m.Body)
+		}
+		stored.Reactions = reactions
+	}); err != nil {
+		log.Printf("error storing relayed reaction in room %s: %v", h.Room, err)
+	}
+}
@@ -0,0 +1,206 @@
+package chat
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelayDropsWhenBehind(t *testing.T) {
+	broker := NewMemoryBroker()
+	config := DefaultConfig()
+	config.Broker = broker
+	h := newTestHub(t, config)
+	c := newClient(h, ClientInfo{ID: "alice", Name: "alice", Version: ProtocolVersion})
+	h.add(c)
+
+	// The hub is not running, the broker must not wait for it
+	data, _ := json.Marshal(&relayed{Origin: "other", Message: &Message{Kind: KindText, Body: "hi"}})
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < relayBuffer+10; i++ {
+			broker.Publish(relayTopic(h.Room), data)
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a hub that is behind")
+	}
+	if dropped := atomic.LoadInt64(&h.relayDropped); dropped != 10 {
+		t.Errorf("dropped %d messages, want 10", dropped)
+	}
+
+	// Once caught up, the clients are told that messages are missing
+	for len(h.relay) > 0 {
+		<-h.relay
+	}
+	h.resync()
+	h.flush()
+	warned := false
+	for deadline := time.After(5 * time.Second); !warned; {
+		select {
+		case f := <-c.send:
+			m := &Message{}
+			json.Unmarshal(f.data, m)
+			warned = m.Kind == KindWarning
+		case <-deadline:
+			t.Fatal("client was not told about the missing messages")
+		}
+	}
+	if dropped := atomic.LoadInt64(&h.relayDropped); dropped != 0 {
+		t.Errorf("%d dropped messages left after the resync", dropped)
+	}
+}
+
+func TestReceiveNeedsHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *Message
+		applied func(h *Hub) bool
+	}{
+		{"topic", &Message{Kind: KindRoomState, Body: "new topic"}, func(h *Hub) bool { return h.Topic() == "new topic" }},
+		{"policy", &Message{Kind: KindRoomState, Policy: &Policy{EmoteOnly: true}}, func(h *Hub) bool { return h.Policy().EmoteOnly }},
+		{"delete", &Message{Kind: KindDelete, Ref: "m1"}, func(h *Hub) bool { m, _ := h.history.Get("m1"); return m.Deleted }},
+		{"ban", &Message{Kind: KindBan, Target: "alice"}, func(h *Hub) bool { return h.Banned("alice", "") }},
+		{"mute", &Message{Kind: KindMute, Target: "alice", Duration: 60}, func(h *Hub) bool { return h.mutedFor("alice") > 0 }},
+	}
+	for _, test := range tests {
+		for _, sender := range []string{"host", "rogue"} {
+			t.Run(test.name+" by "+sender, func(t *testing.T) {
+				h := newTestHub(t, DefaultConfig())
+				h.history = NewMemoryHistory(10)
+				h.mod.hosts["host"] = true
+				h.history.Append(&Message{ID: "m1", Kind: KindText, Body: "hi", SenderID: "alice"})
+
+				m := *test.message
+				m.SenderID = sender
+				h.receive(&relayed{Origin: "other", Message: &m})
+				if applied := test.applied(h); applied != (sender == "host") {
+					t.Errorf("applied = %v, want %v", applied, sender == "host")
+				}
+			})
+		}
+	}
+}
+
+func TestReceiveEditByAuthorOnly(t *testing.T) {
+	h := newTestHub(t, DefaultConfig())
+	h.history = NewMemoryHistory(10)
+	h.mod.hosts["host"] = true
+	h.history.Append(&Message{ID: "m1", Kind: KindText, Body: "hi", SenderID: "alice"})
+
+	for _, sender := range []string{"host", "bob", "alice"} {
+		h.receive(&relayed{Origin: "other", Message: &Message{Kind: KindEdit, Ref: "m1", Body: "by " + sender, SenderID: sender}})
+	}
+	if m, _ := h.history.Get("m1"); m.Body != "by alice" || len(m.Revisions) != 1 {
+		t.Errorf("message is %q with %d revisions, want only the edit of its author", m.Body, len(m.Revisions))
+	}
+}
+
+func TestHostClaims(t *testing.T) {
+	claimed := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		claim   *Message
+		host    string // Host of the room after the claim
+		answers bool   // Whether the local claim is published again
+	}{
+		{"earlier claim wins", &Message{SenderID: "bob", Timestamp: claimed.Add(-time.Second)}, "bob", false},
+		{"later claim loses", &Message{SenderID: "bob", Timestamp: claimed.Add(time.Second)}, "host", true},
+		{"tie goes to the lower id", &Message{SenderID: "alice", Timestamp: claimed}, "alice", false},
+		{"tie with a higher id loses", &Message{SenderID: "zoe", Timestamp: claimed}, "host", true},
+		{"own claim", &Message{SenderID: "host", Timestamp: claimed}, "host", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Broker = NewMemoryBroker()
+			h := newTestHub(t, config)
+			h.mod.hosts["host"] = true
+			h.mod.hostSince = claimed
+
+			var published int32
+			unsubscribe, _ := config.Broker.Subscribe(relayTopic(h.Room), func(data []byte) {
+				r := &relayed{}
+				if json.Unmarshal(data, r) == nil && r.Message.Kind == KindHostClaim && r.Message.SenderID == "host" {
+					atomic.AddInt32(&published, 1)
+				}
+			})
+			defer unsubscribe()
+
+			test.claim.Kind = KindHostClaim
+			h.receive(&relayed{Origin: "other", Message: test.claim})
+			if !h.IsHost(test.host) {
+				t.Errorf("host is not %s", test.host)
+			}
+			if test.answers {
+				waitFor(t, "the local claim", func() bool { return atomic.LoadInt32(&published) == 1 })
+			} else if n := atomic.LoadInt32(&published); n != 0 {
+				t.Errorf("local claim published %d times", n)
+			}
+		})
+	}
+}
+
+func TestClaimHostAcrossReplicas(t *testing.T) {
+	config := DefaultConfig()
+	config.Broker = NewMemoryBroker()
+	first, second := newTestHub(t, config), newTestHub(t, config)
+	go first.Run()
+	go second.Run()
+	defer first.Close("")
+	defer second.Close("")
+
+	if !first.ClaimHost("alice") {
+		t.Fatal("first visitor did not become the host")
+	}
+	waitFor(t, "the claim to reach the other replica", func() bool { return second.IsHost("alice") })
+	if second.ClaimHost("bob") {
+		t.Error("a visitor of the other replica became a host too")
+	}
+}
+
+// stalledBroker is a broker whose Publish hangs until it is released
+type stalledBroker struct {
+	*MemoryBroker
+	release chan struct{}
+}
+
+func (b *stalledBroker) Publish(topic string, data []byte) error {
+	<-b.release
+	return b.MemoryBroker.Publish(topic, data)
+}
+
+func TestPublishDoesNotWaitForTheBroker(t *testing.T) {
+	broker := &stalledBroker{MemoryBroker: NewMemoryBroker(), release: make(chan struct{})}
+	config := DefaultConfig()
+	config.Broker = broker
+	h := newTestHub(t, config)
+
+	var received int32
+	unsubscribe, _ := broker.Subscribe(relayTopic(h.Room), func([]byte) { atomic.AddInt32(&received, 1) })
+	defer unsubscribe()
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < publishBuffer+10; i++ {
+			h.publish(&Message{Kind: KindText, Body: "hi"}, nil)
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a stalled broker")
+	}
+
+	// The writer holds one message while it waits, the queue the rest that fit
+	close(broker.release)
+	waitFor(t, "the queued messages", func() bool { return atomic.LoadInt32(&received) >= publishBuffer })
+	if n := atomic.LoadInt32(&received); n > publishBuffer+1 {
+		t.Errorf("%d messages published, want at most %d", n, publishBuffer+1)
+	}
+}
@@ -0,0 +1,164 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Limits of the room state
+const (
+	maxTopicLength = 200 // Longest topic a host can set
+	maxPinned      = 10  // Most messages pinned at once
+)
+
+// roomState is the room-level chat state, read by commands outside the hub goroutine
+type roomState struct {
+	lock   sync.RWMutex // Mutex for the fields below
+	topic  string       // Topic of the room
+	pinned []string     // Ids of the pinned messages, oldest pin first
+}
+
+// Topic returns the current topic of the room
+func (h *Hub) Topic() string {
+	h.state.lock.RLock()
+	defer h.state.lock.RUnlock()
+	return h.state.topic
+}
+
+// setTopic changes the topic on behalf of a host and announces it
+func (h *Hub) setTopic(m *Message) {
+	if !h.IsHost(m.SenderID) {
+		m.from.notify(KindWarning, "Only hosts can change the topic.")
+		return
+	}
+	topic := m.Body
+	if len([]rune(topic)) > maxTopicLength {
+		topic = string([]rune(topic)[:maxTopicLength])
+	}
+
+	h.state.lock.Lock()
+	h.state.topic = topic
+	h.state.lock.Unlock()
+	h.announce(fmt.Sprintf("%s set the topic to: %s", m.DisplayName, topic))
+	h.sendRoomState(m.SenderID)
+}
+
+// Pinned returns the ids of the pinned messages, oldest pin first
+func (h *Hub) Pinned() []string {
+	h.state.lock.RLock()
+	defer h.state.lock.RUnlock()
+	return append([]string{}, h.state.pinned...)
+}
+
+// isPinned reports whether a message is pinned
+func (h *Hub) isPinned(id string) bool {
+	for _, pinned := range h.Pinned() {
+		if pinned == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pin pins or unpins the public message Ref on behalf of a host and announces it
+func (h *Hub) pin(m *Message) {
+	if !h.IsHost(m.SenderID) {
+		m.from.notify(KindWarning, "Only hosts can pin messages.")
+		return
+	}
+	if h.history == nil {
+		m.from.notify(KindWarning, "Messages cannot be pinned without a chat history.")
+		return
+	}
+	target, err := h.history.Get(m.Ref)
+	if err != nil || target.Deleted {
+		m.from.notify(KindWarning, "Unknown message "+m.Ref+".")
+		return
+	}
+
+	h.state.lock.Lock()
+	pinned := h.state.pinned
+	if (m.Kind == KindPin) == h.containsPin(target.ID) {
+		h.state.lock.Unlock()
+		return // Nothing changes
+	}
+	if m.Kind == KindPin && len(pinned) >= maxPinned {
+		h.state.lock.Unlock()
+		m.from.notify(KindWarning, fmt.Sprintf("At most %d messages can be pinned.", maxPinned))
+		return
+	}
+	h.state.pinned = toggleID(pinned, target.ID, m.Kind == KindPin)
+	h.state.lock.Unlock()
+
+	if m.Kind == KindPin {
+		h.announce(fmt.Sprintf("%s pinned a message from %s.", m.DisplayName, target.DisplayName))
+	} else {
+		h.announce(fmt.Sprintf("%s unpinned a message from %s.", m.DisplayName, target.DisplayName))
+	}
+	h.sendRoomState(m.SenderID)
+}
+
+// containsPin reports whether a message is pinned, the caller holds the state lock
+func (h *Hub) containsPin(id string) bool {
+	for _, pinned := range h.state.pinned {
+		if pinned == id {
+			return true
+		}
+	}
+	return false
+}
+
+// unpinDeleted drops a deleted message from the pins
+func (h *Hub) unpinDeleted(id string) {
+	h.state.lock.Lock()
+	h.state.pinned = toggleID(h.state.pinned, id, false)
+	h.state.lock.Unlock()
+}
+
+// roomState returns the topic, the pinned messages and the posting rules of the room
+func (h *Hub) roomState() *Message {
+	policy := h.Policy()
+	state := h.event(&Message{Kind: KindRoomState, Body: h.Topic(), Policy: &policy})
+	if h.history == nil {
+		return state
+	}
+	for _, id := range h.Pinned() {
+		pinned, err := h.history.Get(id)
+		if err != nil || pinned.Deleted {
+			continue
+		}
+		// The audit trail of pinned messages is only shown to hosts, through the history
+		copied := *pinned
+		copied.Revisions = nil
+		state.Pinned = append(state.Pinned, &copied)
+	}
+	return state
+}
+
+// sendRoomState sends the current room state to every client after the host by changed it.
+// The other replicas only apply it if they know by as a host too.
+func (h *Hub) sendRoomState(by string) {
+	state := h.roomState()
+	state.SenderID = by
+	h.fanout(state)
+}
+
+// setRoomState applies the room state published by another replica, it reports false if the
+// state was not changed by a host of the room
+func (h *Hub) setRoomState(m *Message) bool {
+	if !h.IsHost(m.SenderID) {
+		log.Printf("ignoring chat room state of room %s changed by %q, who is not a host", h.Room, m.SenderID)
+		return false
+	}
+	pinned := make([]string, 0, len(m.Pinned))
+	for _, p := range m.Pinned {
+		pinned = append(pinned, p.ID)
+	}
+	h.state.lock.Lock()
+	h.state.topic = m.Body
+	h.state.pinned = pinned
+	h.state.lock.Unlock()
+	h.setPolicyState(m.Policy)
+	return true
+}
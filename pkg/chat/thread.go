@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"log"
+)
+
+// resolveParent checks the message a reply belongs to and points the reply at the root of its thread.
+// Replies to replies join the thread of their parent instead of starting a new one.
+// It returns the root, nil if the message is not a reply, and reports false if the parent is unknown.
+func (h *Hub) resolveParent(m *Message) (*Message, bool) {
+	if m.Parent == "" {
+		return nil, true
+	}
+	if m.Kind == KindDirect || h.history == nil {
+		m.Parent = ""
+		return nil, true
+	}
+
+	parent, err := h.history.Get(m.Parent)
+	if err != nil || parent.Deleted || (parent.Kind != KindText && parent.Kind != KindAction) {
+		if err != nil && err != ErrMessageNotFound {
+			log.Printf("error reading chat history of room %s: %v", h.Room, err)
+		}
+		return nil, false
+	}
+	if parent.Parent == "" {
+		return parent, true
+	}
+
+	m.Parent = parent.Parent
+	root, err := h.history.Get(parent.Parent)
+	if err != nil {
+		return nil, false
+	}
+	return root, true
+}
+
+// countReply records a new reply on the root of its thread
+func (h *Hub) countReply(root *Message) {
+	if _, err := h.history.Update(root.ID, func(stored *Message) {
+		stored.Replies++
+	}); err != nil {
+		log.Printf("error updating thread %s in room %s: %v", root.ID, h.Room, err)
+	}
+}
+
+// Thread returns the root of a thread followed by its replies, oldest first, as shown to the participant viewer.
+// Only hosts see the revisions of edited messages, and nobody sees the votes of polls.
+func (h *Hub) Thread(id, viewer string) ([]*Message, error) {
+	thread, err := h.thread(id)
+	if err != nil {
+		return nil, err
+	}
+	host := h.IsHost(viewer)
+	shown := make([]*Message, len(thread))
+	for i, m := range thread {
+		if len(m.Revisions) > 0 && !host {
+			stripped := *m
+			stripped.Revisions = nil
+			m = &stripped
+		}
+		shown[i] = publicPolls(m)
+	}
+	return shown, nil
+}
+
+// thread returns the stored root of a thread followed by its replies.
+// Deleted messages and messages that cannot be replied to have no thread.
+func (h *Hub) thread(id string) ([]*Message, error) {
+	if h.history == nil {
+		return nil, ErrMessageNotFound
+	}
+	root, err := h.history.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if root.Parent != "" {
+		return h.thread(root.Parent)
+	}
+	if root.Deleted || (root.Kind != KindText && root.Kind != KindAction) {
+		return nil, ErrMessageNotFound
+	}
+
+	messages, err := h.history.All()
+	if err != nil {
+		return nil, err
+	}
+	thread := []*Message{root}
+	for _, m := range messages {
+		if m.Parent == root.ID {
+			thread = append(thread, m)
+		}
+	}
+	return thread, nil
+}
+
+// sendThread answers a thread request with the root and the replies of the thread Ref
+func (h *Hub) sendThread(m *Message) {
+	thread, err := h.thread(m.Ref)
+	if err != nil {
+		m.from.notify(KindWarning, "Unknown thread "+m.Ref+".")
+		return
+	}
+	for _, reply := range thread {
+		if !m.from.deliver(m.from.encode(reply)) {
+			return
+		}
+	}
+}
+
+// threaded orders messages so that replies follow the root of their thread.
+// It returns the roots in their original order and the replies by root id.
+func threaded(messages []*Message) ([]*Message, map[string][]*Message) {
+	ids := make(map[string]bool, len(messages))
+	for _, m := range messages {
+		ids[m.ID] = true
+	}
+
+	var roots []*Message
+	replies := make(map[string][]*Message)
+	for _, m := range messages {
+		if m.Parent != "" && ids[m.Parent] {
+			replies[m.Parent] = append(replies[m.Parent], m)
+			continue
+		}
+		roots = append(roots, m)
+	}
+	return roots, replies
+}
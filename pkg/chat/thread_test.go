@@ -0,0 +1,68 @@
+package chat
+
+import "testing"
+
+func TestThread(t *testing.T) {
+	h := newTestHub(t, DefaultConfig())
+	h.history = NewMemoryHistory(20)
+	h.mod.hosts["host"] = true
+	for _, m := range []*Message{
+		{ID: "root", Kind: KindText, Body: "fixed", SenderID: "alice", Revisions: []Revision{{Body: "secret typo", By: "alice"}}},
+		{ID: "reply", Kind: KindText, Body: "hi", SenderID: "bob", Parent: "root"},
+		{ID: "vote", Kind: KindPoll, Body: "lunch?", SenderID: "bob", Parent: "root", Poll: &Poll{
+			Anonymous: true,
+			Options:   []PollOption{{Text: "yes", Count: 1, Voters: []string{"carol"}}},
+			Votes:     map[string][]int{"carol": {0}},
+		}},
+		{ID: "gone", Kind: KindText, Deleted: true, SenderID: "alice"},
+		{ID: "poll", Kind: KindPoll, Body: "tea?", SenderID: "alice", Poll: &Poll{Options: []PollOption{{Text: "yes"}}}},
+		{ID: "notice", Kind: KindSystem, Body: "bob joined"},
+	} {
+		h.history.Append(m)
+	}
+
+	tests := []struct {
+		name      string
+		id        string
+		viewer    string
+		messages  int // Messages in the thread, 0 if there is none
+		revisions bool
+	}{
+		{"member", "root", "bob", 3, false},
+		{"host", "root", "host", 3, true},
+		{"from a reply", "reply", "bob", 3, false},
+		{"deleted root", "gone", "bob", 0, false},
+		{"poll", "poll", "bob", 0, false},
+		{"system message", "notice", "bob", 0, false},
+		{"unknown", "nope", "bob", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thread, err := h.Thread(test.id, test.viewer)
+			if test.messages == 0 {
+				if err != ErrMessageNotFound {
+					t.Errorf("Thread(%s) = %d messages, %v, want ErrMessageNotFound", test.id, len(thread), err)
+				}
+				return
+			}
+			if err != nil || len(thread) != test.messages {
+				t.Fatalf("Thread(%s) = %d messages, %v, want %d", test.id, len(thread), err, test.messages)
+			}
+			if revisions := len(thread[0].Revisions) > 0; revisions != test.revisions {
+				t.Errorf("revisions shown = %v, want %v", revisions, test.revisions)
+			}
+			poll := thread[2].Poll
+			if poll.Votes != nil || poll.Options[0].Voters != nil || poll.Options[0].Count != 1 {
+				t.Errorf("anonymous poll shown as %+v", poll)
+			}
+		})
+	}
+
+	// The stored messages keep what is hidden from the members
+	if root, _ := h.history.Get("root"); len(root.Revisions) == 0 {
+		t.Error("revisions were removed from the history")
+	}
+	if vote, _ := h.history.Get("vote"); vote.Poll.Votes == nil {
+		t.Error("votes were removed from the history")
+	}
+}
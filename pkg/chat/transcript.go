@@ -0,0 +1,244 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TranscriptFormat is an output format of a chat transcript
+type TranscriptFormat string
+
+// Supported transcript formats
+const (
+	TranscriptJSON     TranscriptFormat = "json" // Machine readable, includes the audit trail of edits
+	TranscriptMarkdown TranscriptFormat = "md"   // Markdown document
+	TranscriptText     TranscriptFormat = "txt"  // Plain text, one line per message
+)
+
+// ErrTranscriptFormat is returned for an unknown transcript format
+var ErrTranscriptFormat = errors.New("chat: unknown transcript format")
+
+// transcriptTime is the layout of timestamps in text and Markdown transcripts
+const transcriptTime = "2006-01-02 15:04:05 UTC"
+
+// Transcript is the exported chat of a room
+type Transcript struct {
+	Room       string      `json:"room"`        // Room the chat belongs to
+	Topic      string      `json:"topic"`       // Topic of the room at export time
+	Pinned     []string    `json:"pinned"`      // Ids of the messages pinned at export time
+	ExportedAt time.Time   `json:"exported_at"` // Time of the export
+	Messages   []*Message  `json:"messages"`    // Public messages, oldest first, replies link to their thread with parent
+	Questions  []*Question `json:"questions"`   // Q&A queue in the order it was shown, including dismissed questions
+
+	resolve func(name string) string // Finds mentioned participants when rendering Markdown
+}
+
+// Transcript collects the public chat of the room, private messages are never exported
+func (h *Hub) Transcript() (*Transcript, error) {
+	t := &Transcript{Room: h.Room, Topic: h.Topic(), ExportedAt: time.Now().UTC(), Messages: []*Message{}, Pinned: h.Pinned(), Questions: h.Questions(), resolve: h.findMember}
+	if h.history == nil {
+		return t, nil
+	}
+
+	messages, err := h.history.All()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		if len(m.To) == 0 {
+			t.Messages = append(t.Messages, publicPolls(m)) // Anonymous votes stay anonymous in exports
+		}
+	}
+	return t, nil
+}
+
+// Write renders the transcript in the given format
+func (t *Transcript) Write(w io.Writer, format TranscriptFormat) error {
+	switch format {
+	case TranscriptJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	case TranscriptMarkdown:
+		return t.writeMarkdown(w)
+	case TranscriptText:
+		return t.writeText(w)
+	}
+	return ErrTranscriptFormat
+}
+
+// ContentType returns the media type of a transcript format
+func (f TranscriptFormat) ContentType() string {
+	switch f {
+	case TranscriptJSON:
+		return "application/json; charset=utf-8"
+	case TranscriptMarkdown:
+		return "text/markdown; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// writeText renders one line per message
+func (t *Transcript) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "Chat transcript of room %s, exported %s\n", t.Room, t.ExportedAt.Format(transcriptTime))
+	if t.Topic != "" {
+		fmt.Fprintf(w, "Topic: %s\n", t.Topic)
+	}
+	fmt.Fprintln(w)
+
+	// Replies are indented below the root of their thread
+	roots, replies := threaded(t.Messages)
+	for _, root := range roots {
+		for i, m := range append([]*Message{root}, replies[root.ID]...) {
+			indent := ""
+			if i > 0 {
+				indent = "    > "
+			}
+			line := fmt.Sprintf("%s[%s] %s", indent, m.Timestamp.Format(transcriptTime), t.line(m, false))
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(t.Questions) > 0 {
+		fmt.Fprintln(w, "\nQ&A")
+	}
+	for _, q := range t.Questions {
+		if _, err := fmt.Fprintf(w, "[%s] %s\n", q.AskedAt.Format(transcriptTime), t.question(q, false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMarkdown renders the transcript as a Markdown list
+func (t *Transcript) writeMarkdown(w io.Writer) error {
+	fmt.Fprintf(w, "# Chat transcript of room %s\n\n", escapeMarkdown(t.Room))
+	fmt.Fprintf(w, "Exported %s\n\n", t.ExportedAt.Format(transcriptTime))
+	if t.Topic != "" {
+		fmt.Fprintf(w, "**Topic:** %s\n\n", escapeMarkdown(t.Topic))
+	}
+
+	// Replies are nested below the root of their thread
+	roots, replies := threaded(t.Messages)
+	for _, root := range roots {
+		for i, m := range append([]*Message{root}, replies[root.ID]...) {
+			indent := ""
+			if i > 0 {
+				indent = "  "
+			}
+			line := fmt.Sprintf("%s- `%s` %s", indent, m.Timestamp.Format(transcriptTime), t.line(m, true))
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(t.Questions) > 0 {
+		fmt.Fprint(w, "\n## Q&A\n\n")
+	}
+	for _, q := range t.Questions {
+		if _, err := fmt.Fprintf(w, "- `%s` %s\n", q.AskedAt.Format(transcriptTime), t.question(q, true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// question renders a question of the Q&A queue for text and Markdown transcripts
+func (t *Transcript) question(q *Question, markdown bool) string {
+	name, body := q.DisplayName, q.Body
+	if markdown {
+		name = "**" + escapeMarkdown(name) + "**"
+		body = spansMarkdown((&markup{resolve: t.resolve}).parse(q.Body, 0, true))
+	}
+	line := fmt.Sprintf("%s: %s (%s", name, body, q.Status)
+	switch len(q.Voters) {
+	case 0:
+	case 1:
+		line += ", 1 upvote"
+	default:
+		line += fmt.Sprintf(", %d upvotes", len(q.Voters))
+	}
+	return line + ")"
+}
+
+// line renders the content of a message for text and Markdown transcripts.
+// Markdown transcripts keep the formatting of the body, everything else in it is escaped.
+func (t *Transcript) line(m *Message, markdown bool) string {
+	text := func(s string) string {
+		if markdown {
+			return escapeMarkdown(s)
+		}
+		return s
+	}
+	body := m.Body
+	if markdown {
+		body = spansMarkdown((&markup{resolve: t.resolve}).parse(m.Body, 0, true))
+	}
+	name := text(m.DisplayName)
+	if markdown {
+		name = "**" + name + "**"
+	}
+
+	var line string
+	switch {
+	case m.Deleted:
+		line = name + ": (deleted)"
+	case m.Kind == KindSystem:
+		line = "-- " + text(m.Body)
+	case m.Kind == KindAction:
+		line = "* " + name + " " + body
+	case m.Poll != nil:
+		state := "open"
+		if m.Poll.Closed {
+			state = "closed"
+		}
+		line = fmt.Sprintf("%s: Poll: %s (%s, %s)", name, body, text(m.Poll.results()), state)
+	default:
+		line = name + ": " + body
+	}
+	if m.EditedAt != nil && !m.Deleted {
+		line += " (edited)"
+	}
+	for _, id := range t.Pinned {
+		if id == m.ID {
+			line += " (pinned)"
+		}
+	}
+	switch {
+	case m.Replies == 1:
+		line += " (1 reply)"
+	case m.Replies > 1:
+		line += fmt.Sprintf(" (%d replies)", m.Replies)
+	}
+	for _, a := range m.Attachments {
+		line += " [file: " + text(a.Name) + "]"
+	}
+	if len(m.Reactions) > 0 && !m.Deleted {
+		emojis := make([]string, 0, len(m.Reactions))
+		for emoji, users := range m.Reactions {
+			emojis = append(emojis, fmt.Sprintf("%s %d", emoji, len(users)))
+		}
+		sort.Strings(emojis)
+		line += " (" + strings.Join(emojis, ", ") + ")"
+	}
+	return line
+}
+
+// markdownEscaper escapes the characters that have a meaning in Markdown
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`, "\n", " ",
+)
+
+// escapeMarkdown makes user text safe to embed in a Markdown document
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
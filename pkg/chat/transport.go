@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"log"
+)
+
+// Transport is a connection other than a websocket that a chat client can be served over,
+// such as a WebRTC DataChannel. Frames carry the same JSON envelopes as the websocket protocol.
+type Transport interface {
+	Send(data []byte) error              // Writes one frame to the client
+	Close(code int, reason string) error // Ends the connection, code and reason follow the websocket close codes
+}
+
+// TransportConn registers a client served over a transport with the hub.
+// The caller feeds the frames it receives to Receive and calls Leave once the transport is gone.
+// It returns nil if the hub has been closed.
+func TransportConn(t Transport, hub *Hub, info ClientInfo) *Client {
+	client := newClient(hub, info)
+	client.transport = t
+	if !client.join() {
+		t.Close(1001, "room closed")
+		return nil
+	}
+
+	go client.sendPump()
+	return client
+}
+
+// Receive handles a frame read from the transport of the client
+func (c *Client) Receive(raw []byte) {
+	if len(raw) > maxMessageSize {
+		c.notify(KindWarning, "Message too long.")
+		return
+	}
+	if !c.receive(raw) {
+		c.Leave()
+	}
+}
+
+// Leave unregisters the client from the hub, it is called when its transport is gone
+func (c *Client) Leave() {
+	c.leaveOnce.Do(func() {
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.done:
+		}
+	})
+}
+
+// sendPump writes the messages queued by the hub to the transport, then closes it
+func (c *Client) sendPump() {
+	for f := range c.send {
+		if err := c.transport.Send(f.data); err != nil {
+			log.Printf("error writing to chat transport: %v", err)
+			c.Leave()
+			break
+		}
+	}
+
+	// The hub closed the channel, or the transport failed
+	c.lock.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.lock.Unlock()
+	c.transport.Close(code, reason)
+}
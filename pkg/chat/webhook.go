@@ -0,0 +1,308 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of signed webhook requests, in both directions
+const (
+	WebhookSignatureHeader = "X-Chat-Signature" // "sha256=" and the hex HMAC of the timestamp, a dot and the body
+	WebhookTimestampHeader = "X-Chat-Timestamp" // Unix time the request was signed at
+)
+
+// Limits of webhooks
+const (
+	webhookQueue     = 256              // Events waiting for delivery per hub and endpoint, newer events are dropped beyond it
+	webhookClockSkew = 5 * time.Minute  // How old a signed incoming request may be
+	webhookMaxDelay  = 30 * time.Second // Longest wait between two delivery attempts
+)
+
+// Errors of signed webhook requests
+var (
+	ErrWebhookSignature = errors.New("chat: invalid webhook signature") // Missing or wrong signature, or a stale timestamp
+	ErrWebhookReplayed  = errors.New("chat: replayed webhook request")  // Signature of a request accepted before
+)
+
+// Webhooks configures the outgoing and incoming webhooks of every hub
+type Webhooks struct {
+	URLs     []string      // Endpoints receiving the public events of every room, empty disables outgoing webhooks
+	Secret   string        // Signs outgoing events and derives the secret of each room, empty disables incoming webhooks
+	Attempts int           // Deliveries tried per event and endpoint before it is dropped
+	Backoff  time.Duration // Wait after the first failed attempt, doubled after every further one
+	Timeout  time.Duration // Time allowed for a single delivery
+}
+
+// WebhookEvent is the JSON body posted to outgoing webhooks
+type WebhookEvent struct {
+	Room    string   `json:"room"`    // Room the event happened in
+	Event   Kind     `json:"event"`   // Kind of the message
+	Message *Message `json:"message"` // The message as clients receive it
+}
+
+// IncomingWebhook is the JSON body services post to a room
+type IncomingWebhook struct {
+	Name   string `json:"name"`             // Display name of the service, "Webhook" when empty
+	Body   string `json:"body"`             // Text of the message
+	Action bool   `json:"action,omitempty"` // Whether the message is an action like /me
+}
+
+// webhookSender delivers the events of a hub to the outgoing webhooks. Every endpoint has its
+// own queue and goroutine, so one that is down and being retried does not hold up the others.
+type webhookSender struct {
+	config    Webhooks           // Endpoints and retry settings
+	client    *http.Client       // Client used for every delivery
+	endpoints []*webhookEndpoint // Queues of the endpoints, in the order they are configured
+	done      sync.WaitGroup     // Endpoints still draining their queue
+}
+
+// webhookEndpoint is the queue of events of one outgoing webhook, delivered one at a time in order
+type webhookEndpoint struct {
+	url   string      // Address the events are posted to
+	queue chan []byte // Encoded events waiting for delivery, closed when the hub stops
+}
+
+// newWebhookSender starts delivering events to the configured endpoints
+func newWebhookSender(config Webhooks) *webhookSender {
+	if config.Attempts < 1 {
+		config.Attempts = 1
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	s := &webhookSender{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	for _, url := range config.URLs {
+		e := &webhookEndpoint{url: url, queue: make(chan []byte, webhookQueue)}
+		s.endpoints = append(s.endpoints, e)
+		s.done.Add(1)
+		go s.run(e)
+	}
+	return s
+}
+
+// run delivers the queued events of an endpoint until its queue is closed
+func (s *webhookSender) run(e *webhookEndpoint) {
+	defer s.done.Done()
+	for body := range e.queue {
+		s.deliver(e.url, body)
+	}
+}
+
+// send queues an event for every endpoint without blocking, an endpoint whose queue is full misses it
+func (s *webhookSender) send(room string, kind Kind, body []byte) {
+	for _, e := range s.endpoints {
+		select {
+		case e.queue <- body:
+		default:
+			log.Printf("chat webhook queue of %s in room %s is full, dropping a %s event", e.url, room, kind)
+		}
+	}
+}
+
+// deliver posts an event to an endpoint, retrying with exponential backoff
+func (s *webhookSender) deliver(url string, body []byte) {
+	delay := s.config.Backoff
+	for attempt := 1; ; attempt++ {
+		err := s.post(url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= s.config.Attempts {
+			log.Printf("error delivering chat webhook to %s, giving up after %d attempts: %v", url, attempt, err)
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > webhookMaxDelay {
+			delay = webhookMaxDelay
+		}
+	}
+}
+
+// post sends a signed event once, server errors and rate limits are reported as failures to retry
+func (s *webhookSender) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(s.config.Secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		// Other errors will not go away by trying again
+		log.Printf("chat webhook %s refused an event: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// close stops accepting events, the ones already queued are still delivered
+func (s *webhookSender) close() {
+	for _, e := range s.endpoints {
+		close(e.queue)
+	}
+}
+
+// SignWebhook returns the signature header value of a webhook body signed at the given Unix time
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook body and that it was signed recently
+func VerifyWebhook(secret, timestamp, signature string, body []byte) error {
+	if secret == "" || signature == "" {
+		return ErrWebhookSignature
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > webhookClockSkew || age < -webhookClockSkew {
+		return ErrWebhookSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignWebhook(secret, timestamp, body))) {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+// WebhookReplays remembers the signatures of the webhook requests a receiver accepted while their
+// timestamp is still valid, so that a captured request cannot be sent again. The zero value is
+// ready to use.
+type WebhookReplays struct {
+	lock  sync.Mutex           // Mutex for the fields below
+	seen  map[string]time.Time // Time each accepted signature can be forgotten
+	swept time.Time            // Time forgotten signatures were last removed
+}
+
+// Check records the signature of a verified request, it returns ErrWebhookReplayed if the request
+// was accepted before
+func (r *WebhookReplays) Check(signature string) error {
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+	if now.Sub(r.swept) > time.Minute {
+		for sig, forget := range r.seen {
+			if now.After(forget) {
+				delete(r.seen, sig)
+			}
+		}
+		r.swept = now
+	}
+	if _, ok := r.seen[signature]; ok {
+		return ErrWebhookReplayed
+	}
+	// A timestamp ahead of the clock stays valid until the skew has passed twice. Header values of
+	// fiber point into buffers that are reused, so the signature is copied before it is kept.
+	r.seen[strings.Clone(signature)] = now.Add(2 * webhookClockSkew)
+	return nil
+}
+
+// hook queues a public event for the outgoing webhooks without blocking the hub
+func (h *Hub) hook(m *Message) {
+	if h.webhooks == nil || m.Kind.ephemeral() {
+		return
+	}
+	shown := *publicPolls(m)
+	shown.Revisions = nil // The audit trail of edits is only shown to hosts
+	body, err := json.Marshal(&WebhookEvent{Room: h.Room, Event: m.Kind, Message: &shown})
+	if err != nil {
+		return
+	}
+	h.webhooks.send(h.Room, m.Kind, body)
+}
+
+// WebhookSecret returns the secret services sign incoming webhooks of the room with.
+// It is derived from the configured secret, so every replica agrees on it. It is empty when
+// incoming webhooks are disabled.
+func (h *Hub) WebhookSecret() string {
+	if h.config.Webhooks == nil || h.config.Webhooks.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(h.config.Webhooks.Secret))
+	mac.Write([]byte("room:" + h.Room))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// VerifyWebhook checks that an incoming webhook request was signed recently with the secret of
+// the room and has not been accepted before. Replays are only caught by the replica that accepted
+// the request.
+func (h *Hub) VerifyWebhook(timestamp, signature string, body []byte) error {
+	if err := VerifyWebhook(h.WebhookSecret(), timestamp, signature, body); err != nil {
+		return err
+	}
+	return h.replays.Check(signature)
+}
+
+// PostWebhook posts a message of an incoming webhook into the room and returns it.
+// Content filters apply like they do to participants, a rejection is returned as a *RejectError.
+func (h *Hub) PostWebhook(in IncomingWebhook) (*Message, error) {
+	name := cleanName(in.Name, "webhook")
+	if strings.TrimSpace(in.Name) == "" {
+		name = "Webhook"
+	}
+	// Participant ids are hex, so services can never be impersonated by a participant or the other way round
+	id := "webhook-" + ClientID("webhook:" + name)[:8]
+	m := &Message{Kind: KindText, Body: strings.TrimSpace(in.Body), SenderID: id, DisplayName: name}
+	if in.Action {
+		m.Kind = KindAction
+	}
+	if m.Body == "" {
+		return nil, &RejectError{Reason: "The message is empty."}
+	}
+	if reject := h.applyFilters(m); reject != nil {
+		return nil, reject
+	}
+
+	// The hub stamps the message when it handles it, the id is set here so it can be returned
+	h.stamp(m)
+	select {
+	case <-h.done:
+		// The broadcast channel is buffered and would still take the message
+		return nil, ErrHubClosed
+	default:
+	}
+	select {
+	case h.broadcast <- m:
+		return m, nil
+	case <-h.done:
+		return nil, ErrHubClosed
+	}
+}
+
+// postWebhook stores and sends a message of an incoming webhook, it runs on the hub goroutine
+func (h *Hub) postWebhook(m *Message) {
+	h.render(m)
+	h.store(m)
+	h.fanout(m)
+}
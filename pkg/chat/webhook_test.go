@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"body":"hello"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-webhookClockSkew-time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(webhookClockSkew+time.Minute).Unix(), 10)
+	tests := []struct {
+		name      string
+		secret    string // Secret the receiver verifies with
+		timestamp string
+		signature string
+		body      []byte
+		valid     bool
+	}{
+		{"valid", "secret", now, SignWebhook("secret", now, body), body, true},
+		{"slightly skewed clock", "secret", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10),
+			SignWebhook("secret", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10), body), body, true},
+		{"wrong secret", "other", now, SignWebhook("secret", now, body), body, false},
+		{"tampered body", "secret", now, SignWebhook("secret", now, body), []byte(`{"body":"bye"}`), false},
+		{"timestamp not signed", "secret", strconv.FormatInt(time.Now().Unix()-1, 10), SignWebhook("secret", now, body), body, false},
+		{"stale timestamp", "secret", stale, SignWebhook("secret", stale, body), body, false},
+		{"timestamp in the future", "secret", future, SignWebhook("secret", future, body), body, false},
+		{"malformed timestamp", "secret", "yesterday", SignWebhook("secret", "yesterday", body), body, false},
+		{"missing signature", "secret", now, "", body, false},
+		{"signature without prefix", "secret", now, SignWebhook("secret", now, body)[len("sha256="):], body, false},
+		{"no secret", "", now, SignWebhook("", now, body), body, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyWebhook(test.secret, test.timestamp, test.signature, test.body)
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("VerifyWebhook() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// Computed with: printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := SignWebhook("secret", "1700000000", []byte("{}")); got != want {
+		t.Errorf("SignWebhook() = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookReplays(t *testing.T) {
+	var replays WebhookReplays
+	if err := replays.Check("sha256=aa"); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := replays.Check("sha256=bb"); err != nil {
+		t.Errorf("other request: %v", err)
+	}
+	if err := replays.Check("sha256=aa"); err != ErrWebhookReplayed {
+		t.Errorf("replayed request: %v, want ErrWebhookReplayed", err)
+	}
+
+	// Signatures are forgotten once their timestamp can no longer be valid
+	replays.seen["sha256=aa"] = time.Now().Add(-time.Second)
+	replays.swept = time.Time{}
+	if err := replays.Check("sha256=cc"); err != nil {
+		t.Errorf("new request: %v", err)
+	}
+	if _, ok := replays.seen["sha256=aa"]; ok {
+		t.Error("expired signature was kept")
+	}
+}
+
+// webhookReceiver is an endpoint answering deliveries with the given statuses in turn, then 200
+type webhookReceiver struct {
+	*httptest.Server
+	attempts int32       // Deliveries received
+	events   chan []byte // Bodies of the deliveries answered with 200
+}
+
+// newWebhookReceiver starts an endpoint checking the signature of every delivery
+func newWebhookReceiver(t *testing.T, secret string, statuses ...int) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{events: make(chan []byte, 16)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if err := VerifyWebhook(secret, req.Header.Get(WebhookTimestampHeader), req.Header.Get(WebhookSignatureHeader), body); err != nil {
+			t.Errorf("delivery with a bad signature: %v", err)
+		}
+		if n := int(atomic.AddInt32(&r.attempts, 1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			if statuses[n-1] < 300 || (statuses[n-1] < 500 && statuses[n-1] != http.StatusTooManyRequests) {
+				r.events <- body
+			}
+			return
+		}
+		r.events <- body
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// next waits for the next event the endpoint accepted
+func (r *webhookReceiver) next(t *testing.T, within time.Duration) []byte {
+	t.Helper()
+	select {
+	case body := <-r.events:
+		return body
+	case <-time.After(within):
+		t.Fatalf("no delivery to %s within %v", r.URL, within)
+		return nil
+	}
+}
+
+func TestWebhookSenderRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int // Answers before the endpoint accepts deliveries
+		attempts int   // Deliveries expected for one event
+	}{
+		{"accepted", nil, 1},
+		{"server errors retried", []int{500, 503}, 3},
+		{"rate limit retried", []int{http.StatusTooManyRequests}, 2},
+		{"client error not retried", []int{http.StatusBadRequest}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newWebhookReceiver(t, "secret", test.statuses...)
+			s := newWebhookSender(Webhooks{URLs: []string{receiver.URL}, Secret: "secret", Attempts: 5, Backoff: time.Millisecond})
+			s.send("room", KindText, []byte(`{"event":"text"}`))
+			if body := receiver.next(t, 5*time.Second); string(body) != `{"event":"text"}` {
+				t.Errorf("delivered %s", body)
+			}
+			s.close()
+			s.done.Wait()
+			if attempts := atomic.LoadInt32(&receiver.attempts); int(attempts) != test.attempts {
+				t.Errorf("%d attempts, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestWebhookSenderGivesUp(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret", 500, 500, 500, 500)
+	s := newWebhookSender(Webhooks{URLs: []string{receiver.URL}, Secret: "secret", Attempts: 3, Backoff: time.Millisecond})
+	s.send("room", KindText, []byte(`{}`))
+	s.close()
+	s.done.Wait()
+	if attempts := atomic.LoadInt32(&receiver.attempts); attempts != 3 {
+		t.Errorf("%d attempts, want 3", attempts)
+	}
+}
+
+func TestWebhookSenderSlowEndpoint(t *testing.T) {
+	// The first endpoint is down and retried for a second and a half, the second one must not wait for it
+	down := newWebhookReceiver(t, "secret", 503, 503, 503)
+	up := newWebhookReceiver(t, "secret")
+	s := newWebhookSender(Webhooks{URLs: []string{down.URL, up.URL}, Secret: "secret", Attempts: 3, Backoff: 500 * time.Millisecond})
+	defer s.done.Wait()
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		s.send("room", KindText, []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 3; i++ {
+		if body := up.next(t, 500*time.Millisecond); string(body) != strconv.Itoa(i) {
+			t.Errorf("event %d delivered as %s, want them in order", i, body)
+		}
+	}
+}
+
+func TestHookSendsPublicEvents(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	config := DefaultConfig()
+	config.Webhooks = &Webhooks{URLs: []string{receiver.URL}, Secret: "secret", Attempts: 1}
+	h := newTestHub(t, config)
+
+	h.hook(&Message{Kind: KindTyping, SenderID: "alice"}) // Ephemeral events are not sent
+	h.hook(&Message{ID: "m1", Kind: KindText, Body: "hi", Revisions: []Revision{{Body: "hello"}}})
+	var event WebhookEvent
+	if err := json.Unmarshal(receiver.next(t, 5*time.Second), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Room != "test" || event.Event != KindText || event.Message.ID != "m1" || event.Message.Revisions != nil {
+		t.Errorf("delivered %+v, want the text message without its revisions", event)
+	}
+}
@@ -0,0 +1,87 @@
+package webrtc
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
+)
+
+// chatChannelID is the id of the negotiated DataChannel carrying chat, browsers create it with the same id
+const chatChannelID uint16 = 0
+
+// chatChannel serves a chat client over a DataChannel of a peer connection
+type chatChannel struct {
+	channel *webrtc.DataChannel // DataChannel carrying the chat frames
+	lock    sync.Mutex          // Mutex for client
+	client  *chat.Client        // Chat client, set once the channel is open
+	left    bool                // Whether the peer has gone, the client must not join anymore
+	once    sync.Once           // Makes Close idempotent
+}
+
+// Send writes one chat frame to the DataChannel
+func (c *chatChannel) Send(data []byte) error {
+	return c.channel.SendText(string(data))
+}
+
+// Close closes the DataChannel, browsers fall back to the chat websocket and learn the reason there
+func (c *chatChannel) Close(code int, reason string) error {
+	var err error
+	c.once.Do(func() {
+		err = c.channel.Close()
+	})
+	return err
+}
+
+// openChat negotiates a chat DataChannel on a peer connection and bridges it into the hub
+func openChat(peerConnection *webrtc.PeerConnection, hub *chat.Hub, info chat.ClientInfo) (*chatChannel, error) {
+	negotiated := true
+	id := chatChannelID
+	channel, err := peerConnection.CreateDataChannel("chat", &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &chatChannel{channel: channel}
+	// Join the hub once the channel is open, so the welcome and replay reach the browser
+	channel.OnOpen(func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if !c.left {
+			c.client = chat.TransportConn(c, hub, info)
+		}
+	})
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if client := c.chatClient(); client != nil {
+			client.Receive(msg.Data)
+		}
+	})
+	channel.OnClose(c.leave)
+	channel.OnError(func(err error) {
+		log.Println("error on chat DataChannel:", err)
+	})
+	return c, nil
+}
+
+// leave unregisters the chat client of the channel, if it has joined
+func (c *chatChannel) leave() {
+	c.lock.Lock()
+	c.left = true
+	client := c.client
+	c.lock.Unlock()
+	if client != nil {
+		client.Leave()
+	}
+}
+
+// chatClient returns the chat client of the channel, nil until the channel is open
+func (c *chatChannel) chatClient() *chat.Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client
+}
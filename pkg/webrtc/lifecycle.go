@@ -0,0 +1,120 @@
+package webrtc
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Count returns the number of peer connections that are not closed
+func (p *Peers) Count() int {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	count := 0
+	for i := range p.Connections {
+		if p.Connections[i].PeerConnection.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			count++
+		}
+	}
+	return count
+}
+
+// join adds a peer connection to the list, it reports false if the peers have been closed
+func (p *Peers) join(peer PeerConnectionState) bool {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+	if p.closed {
+		return false
+	}
+	p.Connections = append(p.Connections, peer)
+	return true
+}
+
+// Close tells every peer why it is disconnected and closes its connections
+func (p *Peers) Close(reason string) {
+	p.ListLock.Lock()
+	p.closed = true
+	connections := p.Connections
+	p.Connections = nil
+	p.ListLock.Unlock()
+
+	for i := range connections {
+		if err := connections[i].Websocket.WriteJSON(&websocketMessage{Event: "close", Data: reason}); err != nil {
+			log.Println("error writing close event:", err)
+		}
+		if err := connections[i].PeerConnection.Close(); err != nil {
+			log.Println("error closing peer connection:", err)
+		}
+		connections[i].Websocket.Conn.Close()
+	}
+}
+
+// Close disconnects the peers and the chat clients of a room
+func (r *Room) Close(reason string) {
+	r.Peers.Close(reason)
+	if r.Hub != nil {
+		r.Hub.Close(reason)
+	}
+}
+
+// active reports whether anyone is connected to the room
+func (r *Room) active() bool {
+	return r.Peers.Count() > 0 || (r.Hub != nil && r.Hub.ClientCount() > 0)
+}
+
+// CloseIdleRooms closes the rooms that have had no peers and no chat clients for the given duration.
+// Closed rooms are removed from both Rooms and Streams.
+func CloseIdleRooms(idle time.Duration) {
+	now := time.Now()
+	var closed []*Room
+
+	RoomsLock.Lock()
+	for uuid, room := range Rooms {
+		if room.active() {
+			room.idleSince = time.Time{}
+			continue
+		}
+		if room.idleSince.IsZero() {
+			room.idleSince = now
+			continue
+		}
+		if now.Sub(room.idleSince) < idle {
+			continue
+		}
+		delete(Rooms, uuid)
+		closed = append(closed, room)
+	}
+	for suuid, room := range Streams {
+		for _, c := range closed {
+			if room == c {
+				delete(Streams, suuid)
+			}
+		}
+	}
+	RoomsLock.Unlock()
+
+	// Close the rooms outside the lock, telling clients takes a while
+	for _, room := range closed {
+		room.Close("idle timeout")
+	}
+}
+
+// CloseRooms closes every room, used when the server shuts down
+func CloseRooms(reason string) {
+	RoomsLock.Lock()
+	rooms := make([]*Room, 0, len(Rooms))
+	for uuid, room := range Rooms {
+		rooms = append(rooms, room)
+		delete(Rooms, uuid)
+	}
+	for suuid := range Streams {
+		delete(Streams, suuid)
+	}
+	RoomsLock.Unlock()
+
+	for _, room := range rooms {
+		room.Close(reason)
+	}
+}
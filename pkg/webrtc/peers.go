@@ -40,21 +40,25 @@ var turnConfig = webrtc.Configuration{
 
 // Room represents a WebRTC room
 type Room struct {
-	Peers *Peers      // Peers in the room
-	Hub   *chat.Hub   // Chat hub associated with the room
+	Peers *Peers    // Peers in the room
+	Hub   *chat.Hub // Chat hub associated with the room
+
+	idleSince time.Time // When the room was first seen empty, guarded by RoomsLock
 }
 
 // Peers represents peers in a room
 type Peers struct {
-	ListLock     sync.RWMutex              // Mutex for peers list
-	Connections  []PeerConnectionState     // Peer connections
-	TrackLocals  map[string]*webrtc.TrackLocalStaticRTP // Local tracks
+	ListLock    sync.RWMutex          // Mutex for peers list
+	Connections []PeerConnectionState // Peer connections
+	TrackLocals map[string]*Track     // Published tracks by id
+	closed      bool                  // Whether the room has been closed
 }
 
 // PeerConnectionState represents the state of a peer connection
 type PeerConnectionState struct {
 	PeerConnection *webrtc.PeerConnection // WebRTC peer connection
-	Websocket      *ThreadSafeWriter       // Thread-safe writer for WebSocket
+	Websocket      *ThreadSafeWriter      // Thread-safe writer for WebSocket
+	View           *View                  // What the peer displays, decides the simulcast layers it receives
 }
 
 // ThreadSafeWriter is a thread-safe writer for WebSocket
@@ -70,33 +74,39 @@ func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
 	return t.Conn.WriteJSON(v)
 }
 
-// AddTrack adds a track to the peers list
-func (p *Peers) AddTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+// AddTrack adds a published track to the peers list. The layers of a simulcast track arrive
+// as separate remote tracks with the same id, they are added to the same track.
+func (p *Peers) AddTrack(publisher *webrtc.PeerConnection, t *webrtc.TrackRemote) *Track {
 	p.ListLock.Lock()
-	defer func() {
-		p.ListLock.Unlock()
-		p.SignalPeerConnections()
-	}()
-
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
-	if err != nil {
-		log.Println(err.Error())
-		return nil
+	track := p.TrackLocals[t.ID()]
+	added := track == nil
+	if added {
+		track = newTrack(publisher, t)
+		p.TrackLocals[t.ID()] = track
 	}
+	track.addLayer(t)
+	p.ListLock.Unlock()
 
-	p.TrackLocals[t.ID()] = trackLocal
-	return trackLocal
+	// Another layer does not change the tracks the peers receive
+	if added {
+		p.SignalPeerConnections()
+	}
+	return track
 }
 
-// RemoveTrack removes a track from the peers list
-func (p *Peers) RemoveTrack(t *webrtc.TrackLocalStaticRTP) {
+// RemoveTrack removes a layer of a track, and the track from the peers list once it has no layers left
+func (p *Peers) RemoveTrack(t *Track, rid string) {
 	p.ListLock.Lock()
-	defer func() {
+	if t.removeLayer(rid) > 0 {
 		p.ListLock.Unlock()
-		p.SignalPeerConnections()
-	}()
+		return
+	}
+	if p.TrackLocals[t.ID()] == t {
+		delete(p.TrackLocals, t.ID())
+	}
+	p.ListLock.Unlock()
 
-	delete(p.TrackLocals, t.ID())
+	p.SignalPeerConnections()
 }
 
 // SignalPeerConnections signals peer connections to establish and update tracks.
@@ -159,7 +169,8 @@ func (p *Peers) SignalPeerConnections() {
 			// Add local tracks to the connection if not already present
 			for trackID := range p.TrackLocals {
 				if _, ok := existingSenders[trackID]; !ok {
-					if _, err := p.Connections[i].PeerConnection.AddTrack(p.TrackLocals[trackID]); err != nil {
+					// Every peer gets its own copy of the track, carrying the simulcast layer that suits it
+					if _, err := p.Connections[i].PeerConnection.AddTrack(p.TrackLocals[trackID].subscribe(p.Connections[i].View)); err != nil {
 						return true
 					}
 				}
@@ -212,6 +223,46 @@ func (p *Peers) SignalPeerConnections() {
 	}
 }
 
+// answerOffer applies an offer from the peer and sends it the answer.
+// The client's offer wins when it collides with one the server has sent, the server's offer is rolled back and
+// rolledBack reports that it has to be made again once the answer is out. The list lock keeps
+// SignalPeerConnections from sending a new offer between the two.
+func (p *Peers) answerOffer(peer PeerConnectionState, offer webrtc.SessionDescription) (rolledBack bool, err error) {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	pc := peer.PeerConnection
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return false, err
+		}
+		rolledBack = true
+	}
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return rolledBack, err
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return rolledBack, err
+	}
+
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return rolledBack, err
+	}
+
+	answerString, err := json.Marshal(answer)
+	if err != nil {
+		return rolledBack, err
+	}
+
+	return rolledBack, peer.Websocket.WriteJSON(&websocketMessage{
+		Event: "answer",
+		Data:  string(answerString),
+	})
+}
+
 // DispatchKeyFrame sends key frame requests to peer connections
 func (p *Peers) DispatchKeyFrame() {
 	p.ListLock.Lock()
@@ -219,15 +270,17 @@ func (p *Peers) DispatchKeyFrame() {
 
 	for i := range p.Connections {
 		for _, receiver := range p.Connections[i].PeerConnection.GetReceivers() {
-			if receiver.Track() == nil {
-				continue
+			// A simulcast receiver has a track for each layer
+			for _, track := range receiver.Tracks() {
+				if track.SSRC() == 0 {
+					continue
+				}
+				_ = p.Connections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{
+						MediaSSRC: uint32(track.SSRC()),
+					},
+				})
 			}
-
-			_ = p.Connections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{
-					MediaSSRC: uint32(receiver.Track().SSRC()),
-				},
-			})
 		}
 	}
 }
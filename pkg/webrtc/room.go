@@ -4,14 +4,21 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strconv"
 	"sync"
 
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v3"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
 )
 
-// RoomConn establishes a new WebRTC connection for a room
-func RoomConn(c *websocket.Conn, p *Peers) {
+// RoomConn establishes a new WebRTC connection for a room.
+// The client offers first, so that it can publish its video in several simulcast layers,
+// and joins the room once it has been answered. Unless hub is nil, the participant shows up
+// in the room's roster and chat is carried over a DataChannel of the connection, except for
+// banned participants.
+func RoomConn(c *websocket.Conn, p *Peers, hub *chat.Hub, info chat.ClientInfo) {
 	// Configuration for the WebRTC connection
 	var config webrtc.Configuration
 	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
@@ -19,20 +26,20 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 	}
 
 	// Create a new peer connection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(config)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 	defer peerConnection.Close() // Close the peer connection when the function exits
 
-	// Add transceivers for video and audio
-	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
-		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		}); err != nil {
-			log.Print("error adding transceiver:", err)
-			return
+	// Bridge a chat DataChannel into the room's hub, it is part of the first offer
+	if hub != nil && !hub.Banned(info.ID, info.IP) {
+		channel, err := openChat(peerConnection, hub, info)
+		if err != nil {
+			log.Print("error opening chat channel:", err)
+		} else {
+			defer channel.leave() // Leave the hub when the signaling connection ends
 		}
 	}
 
@@ -43,15 +50,9 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 			Conn:  c,
 			Mutex: sync.Mutex{},
 		},
+		View: &View{},
 	}
 
-	// Add the new PeerConnection to the global list
-	p.ListLock.Lock()
-	p.Connections = append(p.Connections, newPeer)
-	p.ListLock.Unlock()
-
-	log.Println("New peer connection established: ", p.Connections)
-
 	// Handle ICE candidate messages from the client
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
@@ -85,33 +86,63 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 		}
 	})
 
-	// Handle incoming tracks
+	// Handle incoming tracks, a simulcast track arrives once for each of its layers
 	peerConnection.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-		// Add the track to the peer's track list
-		trackLocal := p.AddTrack(t)
-		if trackLocal == nil {
-			log.Println("error adding track")
-			return
-		}
-		defer p.RemoveTrack(trackLocal)
+		// Add the track, or this layer of it, to the peer's track list
+		track := p.AddTrack(peerConnection, t)
+		defer p.RemoveTrack(track, t.RID())
 
-		// Read and write incoming video stream
-		buf := make([]byte, 1500)
+		// Read the incoming stream and forward it to the other peers
 		for {
-			i, _, err := t.Read(buf)
+			packet, _, err := t.ReadRTP()
 			if err != nil {
 				log.Println("error reading from track:", err)
 				return
 			}
+			track.forward(t.RID(), packet)
+		}
+	})
 
-			if _, err = trackLocal.Write(buf[:i]); err != nil {
-				log.Println("error writing to track:", err)
-				return
+	// Leave the roster when the signaling connection ends
+	var watch *chat.PresenceWatch
+	defer func() {
+		if watch != nil {
+			watch.Leave()
+		}
+	}()
+
+	// join adds the peer to the room once its first offer has been answered
+	joined := false
+	join := func() bool {
+		joined = true
+
+		// Add the new PeerConnection to the global list, unless the room has been closed
+		if !p.join(newPeer) {
+			log.Println("room is closed")
+			return false
+		}
+
+		log.Println("New peer connection established: ", p.Connections)
+
+		// Send the roster and its changes over the signaling websocket
+		if hub != nil {
+			if watch = hub.JoinMedia(info); watch != nil {
+				go func(events <-chan []byte) {
+					for data := range events {
+						if err := newPeer.Websocket.WriteJSON(&websocketMessage{
+							Event: "presence",
+							Data:  string(data),
+						}); err != nil {
+							log.Println("error writing presence:", err)
+						}
+					}
+				}(watch.Events)
 			}
 		}
-	})
 
-	p.SignalPeerConnections() // Signal peer connections upon successful setup
+		p.SignalPeerConnections() // Signal peer connections upon successful setup
+		return true
+	}
 
 	message := &websocketMessage{}
 	for {
@@ -126,6 +157,28 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 		}
 
 		switch message.Event {
+		case "offer":
+			// Handle the SDP offer publishing the client's media
+			offer := webrtc.SessionDescription{}
+			if err := json.Unmarshal([]byte(message.Data), &offer); err != nil {
+				log.Println(err)
+				return
+			}
+
+			// The server may have sent an offer of its own in the meantime, answering rolls it back
+			rolledBack, err := p.answerOffer(newPeer, offer)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			if joined && rolledBack {
+				// Offer again what the rolled back offer carried
+				p.SignalPeerConnections()
+			}
+			if !joined && !join() {
+				return
+			}
 		case "candidate":
 			// Handle ICE candidate message
 			candidate := webrtc.ICECandidateInit{}
@@ -146,10 +199,24 @@ func RoomConn(c *websocket.Conn, p *Peers) {
 				return
 			}
 
+			// An answer to an offer that was rolled back is stale
+			if peerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+				log.Println("ignoring an answer with no offer pending")
+				continue
+			}
+
 			if err := peerConnection.SetRemoteDescription(answer); err != nil {
 				log.Println(err)
 				return
 			}
+		case "tiles":
+			// Handle the number of video tiles the client displays
+			tiles, err := strconv.Atoi(message.Data)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			newPeer.View.SetTiles(tiles)
 		}
 	}
 }
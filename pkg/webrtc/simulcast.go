@@ -0,0 +1,164 @@
+package webrtc
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// LayerPolicy decides which simulcast layer a subscriber receives
+type LayerPolicy string
+
+// Layer policies
+const (
+	LayerPolicyTiles LayerPolicy = "tiles" // The more tiles a subscriber displays, the smaller the layer
+	LayerPolicyHigh  LayerPolicy = "high"  // Always the largest layer
+	LayerPolicyLow   LayerPolicy = "low"   // Always the smallest layer, saving bandwidth
+)
+
+// SimulcastPolicy is the layer policy of every room
+var SimulcastPolicy = LayerPolicyTiles
+
+// Ranks of the simulcast layers, browsers send them with the RIDs q, h and f
+const (
+	layerLow    = iota // Quarter resolution
+	layerMedium        // Half resolution
+	layerHigh          // Full resolution, also the only layer of a track sent without simulcast
+)
+
+// api creates the peer connections. Its media engine negotiates the header extensions
+// that tell the simulcast layers of a track apart.
+var api = newAPI()
+
+// newAPI creates the WebRTC API with the default codecs and interceptors, and the MID and RID header extensions
+func newAPI() *webrtc.API {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		panic(err)
+	}
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			panic(err)
+		}
+	}
+
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptors); err != nil {
+		panic(err)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptors))
+}
+
+// View is what a subscriber displays, it decides the simulcast layers the subscriber receives
+type View struct {
+	tiles int32 // Video tiles shown, 0 until the subscriber tells
+}
+
+// Tiles returns the number of video tiles the subscriber shows
+func (v *View) Tiles() int {
+	if v == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&v.tiles))
+}
+
+// SetTiles records how many video tiles the subscriber shows, its tracks switch layers on their next keyframe
+func (v *View) SetTiles(tiles int) {
+	if tiles < 0 {
+		tiles = 0
+	}
+	atomic.StoreInt32(&v.tiles, int32(tiles))
+}
+
+// rank returns the largest layer the policy allows for a subscriber showing the given number of tiles
+func (policy LayerPolicy) rank(tiles int) int {
+	switch policy {
+	case LayerPolicyHigh:
+		return layerHigh
+	case LayerPolicyLow:
+		return layerLow
+	}
+	switch {
+	case tiles <= 1:
+		return layerHigh
+	case tiles <= 4:
+		return layerMedium
+	}
+	return layerLow
+}
+
+// layerRank returns the rank of a simulcast layer from its RID
+func layerRank(rid string) int {
+	switch rid {
+	case "q":
+		return layerLow
+	case "h":
+		return layerMedium
+	}
+	return layerHigh
+}
+
+// switchable reports whether the keyframes of a video codec are recognized, so its tracks can switch layers
+func switchable(mimeType string) bool {
+	for _, known := range []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeH264} {
+		if strings.EqualFold(mimeType, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// isKeyFrame reports whether a video packet starts a keyframe, layers can only be switched there
+func isKeyFrame(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		vp8 := &codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil || len(vp8.Payload) == 0 {
+			return false
+		}
+		// First partition of a frame whose payload header has the inverse keyframe bit clear
+		return vp8.S == 1 && vp8.PID == 0 && vp8.Payload[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		vp9 := &codecs.VP9Packet{}
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		// Start of a frame that is not predicted from another one
+		return vp9.B && !vp9.P
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264KeyFrame(payload)
+	}
+	return false
+}
+
+// h264KeyFrame reports whether an H264 packet carries a sequence parameter set or starts an IDR slice
+func h264KeyFrame(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch naluType := payload[0] & 0x1F; naluType {
+	case 5, 7:
+		return true
+	case 24:
+		// STAP-A, aggregated units each preceded by their size
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if size == 0 {
+				return false // Malformed, units hold at least their header
+			}
+			if t := payload[i] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			i += size
+		}
+	case 28:
+		// FU-A, the start of a fragmented unit
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == 5
+	}
+	return false
+}
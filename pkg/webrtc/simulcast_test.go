@@ -0,0 +1,94 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIsKeyFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00, 0x9d}, true},
+		{"vp8 lower case mime type", "video/vp8", []byte{0x10, 0x00, 0x9d}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01, 0x9d}, false},
+		{"vp8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00, 0x9d}, false},
+		{"vp8 other partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00, 0x9d}, false},
+		{"vp8 no payload", webrtc.MimeTypeVP8, []byte{0x10}, false},
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x08, 0xaa}, true},
+		{"vp9 predicted", webrtc.MimeTypeVP9, []byte{0x48, 0xaa}, false},
+		{"vp9 middle of a frame", webrtc.MimeTypeVP9, []byte{0x00, 0xaa}, false},
+		{"vp9 empty", webrtc.MimeTypeVP9, nil, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67, 0x42}, true},
+		{"h264 slice", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"unknown codec", "video/AV1", []byte{0x65}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isKeyFrame(test.mimeType, test.payload); got != test.want {
+				t.Errorf("isKeyFrame(%s, % x) = %v, want %v", test.mimeType, test.payload, got, test.want)
+			}
+		})
+	}
+}
+
+func TestH264KeyFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"empty", nil, false},
+		{"idr", []byte{0x65}, true},
+		{"sps", []byte{0x67}, true},
+		{"pps", []byte{0x68}, false},
+		{"stap-a with sps", []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"stap-a with idr second", []byte{0x78, 0x00, 0x02, 0x41, 0x9a, 0x00, 0x02, 0x65, 0x88}, true},
+		{"stap-a without keyframe", []byte{0x78, 0x00, 0x02, 0x41, 0x9a, 0x00, 0x01, 0x68}, false},
+		{"stap-a header only", []byte{0x78}, false},
+		{"stap-a truncated size", []byte{0x78, 0x00}, false},
+		{"stap-a size without unit", []byte{0x78, 0x00, 0x02}, false},
+		{"stap-a size past the end", []byte{0x78, 0xff, 0xff, 0x41}, false},
+		{"stap-a zero size", []byte{0x78, 0x00, 0x00, 0x65, 0x00, 0x01, 0x65}, false},
+		{"fu-a idr start", []byte{0x7c, 0x85}, true},
+		{"fu-a idr middle", []byte{0x7c, 0x05}, false},
+		{"fu-a slice start", []byte{0x7c, 0x81}, false},
+		{"fu-a header only", []byte{0x7c}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := h264KeyFrame(test.payload); got != test.want {
+				t.Errorf("h264KeyFrame(% x) = %v, want %v", test.payload, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLayerPolicyRank(t *testing.T) {
+	tests := []struct {
+		policy LayerPolicy
+		tiles  int
+		want   int
+	}{
+		{LayerPolicyTiles, 0, layerHigh},
+		{LayerPolicyTiles, 1, layerHigh},
+		{LayerPolicyTiles, 2, layerMedium},
+		{LayerPolicyTiles, 4, layerMedium},
+		{LayerPolicyTiles, 5, layerLow},
+		{LayerPolicyTiles, 100, layerLow},
+		{LayerPolicyHigh, 100, layerHigh},
+		{LayerPolicyLow, 1, layerLow},
+		{"unknown", 3, layerMedium},
+	}
+	for _, test := range tests {
+		if got := test.policy.rank(test.tiles); got != test.want {
+			t.Errorf("%s.rank(%d) = %d, want %d", test.policy, test.tiles, got, test.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strconv"
 	"sync"
 
 	"github.com/gofiber/websocket/v2"
@@ -19,7 +20,7 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 	}
 
 	// Create a new peer connection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(config)
 	if err != nil {
 		log.Print(err)
 		return
@@ -43,12 +44,14 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 			Conn:  c,
 			Mutex: sync.Mutex{},
 		},
+		View: &View{},
 	}
 
-	// Add the new PeerConnection to the global list
-	p.ListLock.Lock()
-	p.Connections = append(p.Connections, newPeer)
-	p.ListLock.Unlock()
+	// Add the new PeerConnection to the global list, unless the room has been closed
+	if !p.join(newPeer) {
+		log.Println("room is closed")
+		return
+	}
 
 	log.Println(p.Connections)
 
@@ -123,6 +126,14 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 				log.Println(err)
 				return
 			}
+		case "tiles":
+			// Handle the number of video tiles the viewer displays
+			tiles, err := strconv.Atoi(message.Data)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			newPeer.View.SetTiles(tiles)
 		}
 	}
 }
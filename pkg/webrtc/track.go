@@ -0,0 +1,293 @@
+package webrtc
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// keyFrameInterval is the least time between two keyframe requests for one layer
+const keyFrameInterval = 500 * time.Millisecond
+
+// Track forwards a published track to its subscribers. A simulcast track is received
+// in several layers, and every subscriber gets the one that suits what it displays.
+type Track struct {
+	id         string                    // Id of the published track
+	streamID   string                    // Id of the stream of the published track
+	kind       webrtc.RTPCodecType       // Audio or video
+	codec      webrtc.RTPCodecCapability // Codec of the published track
+	switchable bool                      // Whether the keyframes of the codec are recognized, so layers can be switched
+	publisher  *webrtc.PeerConnection    // Connection of the publisher, keyframes are requested over it
+
+	lock   sync.RWMutex        // Mutex for layers and subscribers
+	layers []*layer            // Layers received, smallest first
+	downs  map[*downTrack]bool // Subscribers the track is bound to
+}
+
+// layer is one simulcast encoding of a track
+type layer struct {
+	rid         string      // RID of the layer, empty without simulcast
+	rank        int         // Size of the layer compared to the others
+	ssrc        webrtc.SSRC // SSRC the publisher sends the layer with
+	lastRequest int64       // When a keyframe was last requested, in Unix nanoseconds
+}
+
+// newTrack creates a track forwarding a published track, its layers are added as they arrive
+func newTrack(publisher *webrtc.PeerConnection, t *webrtc.TrackRemote) *Track {
+	codec := t.Codec().RTPCodecCapability
+	return &Track{
+		id:         t.ID(),
+		streamID:   t.StreamID(),
+		kind:       t.Kind(),
+		codec:      codec,
+		switchable: t.Kind() == webrtc.RTPCodecTypeVideo && switchable(codec.MimeType),
+		publisher:  publisher,
+		downs:      make(map[*downTrack]bool),
+	}
+}
+
+// ID returns the id of the published track
+func (t *Track) ID() string {
+	return t.id
+}
+
+// addLayer adds the layer a remote track carries
+func (t *Track) addLayer(remote *webrtc.TrackRemote) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.layers = append(t.layers, &layer{rid: remote.RID(), rank: layerRank(remote.RID()), ssrc: remote.SSRC()})
+	sort.Slice(t.layers, func(i, j int) bool {
+		if t.layers[i].rank != t.layers[j].rank {
+			return t.layers[i].rank < t.layers[j].rank
+		}
+		return t.layers[i].rid < t.layers[j].rid
+	})
+}
+
+// removeLayer removes a layer that is no longer received and returns how many are left.
+// Subscribers of the layer move to another one on its next keyframe.
+func (t *Track) removeLayer(rid string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, l := range t.layers {
+		if l.rid == rid {
+			t.layers = append(t.layers[:i], t.layers[i+1:]...)
+			break
+		}
+	}
+	return len(t.layers)
+}
+
+// subscribe returns the track as sent to one subscriber
+func (t *Track) subscribe(view *View) webrtc.TrackLocal {
+	return &downTrack{track: t, view: view}
+}
+
+// pick returns the layer a subscriber showing the given number of tiles should receive:
+// the largest the policy allows, or the smallest one if they are all larger
+func (t *Track) pick(tiles int) *layer {
+	if len(t.layers) == 0 {
+		return nil
+	}
+	rank := SimulcastPolicy.rank(tiles)
+	picked := t.layers[0]
+	for _, l := range t.layers[1:] {
+		if l.rank <= rank {
+			picked = l
+		}
+	}
+	return picked
+}
+
+// forward sends a packet of a layer to the subscribers receiving it, and to those waiting
+// for a keyframe of the layer to switch to it
+func (t *Track) forward(rid string, packet *rtp.Packet) {
+	// Padding only packets probe the bandwidth of the publisher, they carry no media
+	if len(packet.Payload) == 0 {
+		return
+	}
+	keyFrame := t.kind == webrtc.RTPCodecTypeAudio || (t.switchable && isKeyFrame(t.codec.MimeType, packet.Payload))
+
+	var requests []*layer
+	t.lock.RLock()
+	for d := range t.downs {
+		want := t.pick(d.view.Tiles())
+		if want == nil {
+			continue
+		}
+		if waiting := d.write(rid, want.rid, packet, keyFrame); waiting {
+			requests = append(requests, want)
+		}
+	}
+	t.lock.RUnlock()
+
+	// Writing to the publisher can block, subscribers must not wait for it to come and go
+	for _, l := range requests {
+		t.requestKeyFrame(l)
+	}
+}
+
+// requestKeyFrame asks the publisher for a keyframe of a layer, at most once per keyFrameInterval
+func (t *Track) requestKeyFrame(l *layer) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.lastRequest)
+	if now-last < int64(keyFrameInterval) || !atomic.CompareAndSwapInt64(&l.lastRequest, last, now) {
+		return
+	}
+	_ = t.publisher.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(l.ssrc)}})
+}
+
+// downTrack is a track as sent to one subscriber. It forwards a single layer of the track,
+// rewriting sequence numbers and timestamps so that switching layers looks like one stream.
+type downTrack struct {
+	track *Track // Track being forwarded
+	view  *View  // What the subscriber displays
+
+	lock        sync.Mutex              // Mutex for the fields below
+	writer      webrtc.TrackLocalWriter // Writes to the subscriber, nil until bound
+	ssrc        webrtc.SSRC             // SSRC of the track in the subscriber's connection
+	payloadType webrtc.PayloadType      // Payload type of the codec in the subscriber's connection
+	started     bool                    // Whether a layer is being forwarded
+	current     string                  // RID of the layer being forwarded
+	seqOffset   uint16                  // Added to the sequence numbers of the current layer
+	tsOffset    uint32                  // Added to the timestamps of the current layer
+	lastSeq     uint16                  // Highest sequence number sent
+	lastTS      uint32                  // Timestamp of the packet with the highest sequence number
+	lastSent    time.Time               // When the packet with the highest sequence number was sent
+}
+
+// Bind is called when the subscriber's connection starts sending the track
+func (d *downTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(d.track.codec, ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	d.lock.Lock()
+	d.writer = ctx.WriteStream()
+	d.ssrc = ctx.SSRC()
+	d.payloadType = codec.PayloadType
+	d.lock.Unlock()
+
+	d.track.lock.Lock()
+	d.track.downs[d] = true
+	d.track.lock.Unlock()
+	return codec, nil
+}
+
+// Unbind is called when the subscriber's connection stops sending the track
+func (d *downTrack) Unbind(webrtc.TrackLocalContext) error {
+	d.track.lock.Lock()
+	delete(d.track.downs, d)
+	d.track.lock.Unlock()
+
+	d.lock.Lock()
+	d.writer = nil
+	d.lock.Unlock()
+	return nil
+}
+
+// ID returns the id of the published track
+func (d *downTrack) ID() string {
+	return d.track.id
+}
+
+// RID returns an empty RID, a subscriber receives a single layer
+func (d *downTrack) RID() string {
+	return ""
+}
+
+// StreamID returns the id of the stream of the published track
+func (d *downTrack) StreamID() string {
+	return d.track.streamID
+}
+
+// Kind returns whether the track is audio or video
+func (d *downTrack) Kind() webrtc.RTPCodecType {
+	return d.track.kind
+}
+
+// write sends a packet of a layer to the subscriber if it receives that layer. The subscriber
+// switches to the layer it wants on a keyframe of that layer. It reports whether the subscriber
+// is waiting for such a keyframe.
+func (d *downTrack) write(rid, want string, packet *rtp.Packet, keyFrame bool) (waiting bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.writer == nil {
+		return false
+	}
+
+	switch {
+	case d.started && rid == d.current:
+		// Keep forwarding the current layer until the wanted one has a keyframe
+	case rid == want && (keyFrame || (!d.started && !d.track.switchable)):
+		// Tracks in codecs whose keyframes are not recognized stay on the layer they start with
+		d.switchTo(rid, packet)
+	default:
+		return d.track.switchable && (!d.started || d.current != want)
+	}
+	waiting = d.track.switchable && d.current != want
+
+	header := packet.Header
+	header.SequenceNumber += d.seqOffset
+	header.Timestamp += d.tsOffset
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	// Extensions were negotiated with the publisher, the padding has been stripped from the payload
+	header.Extension = false
+	header.Extensions = nil
+	header.Padding = false
+	if diff := int16(header.SequenceNumber - d.lastSeq); diff > 0 || d.lastSent.IsZero() {
+		d.lastSeq = header.SequenceNumber
+		d.lastTS = header.Timestamp
+		d.lastSent = time.Now()
+	}
+
+	// Failures are those of the subscriber's connection, which is cleaned up when it closes
+	_, _ = d.writer.WriteRTP(&header, packet.Payload)
+	return waiting
+}
+
+// switchTo starts forwarding a layer from one of its packets. The sequence numbers and the
+// timestamps of the new layer continue those sent from the previous one.
+func (d *downTrack) switchTo(rid string, packet *rtp.Packet) {
+	if d.started {
+		d.seqOffset = d.lastSeq + 1 - packet.SequenceNumber
+		elapsed := uint32(time.Since(d.lastSent).Seconds() * float64(d.track.codec.ClockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		d.tsOffset = d.lastTS + elapsed - packet.Timestamp
+	}
+	d.started = true
+	d.current = rid
+}
+
+// matchCodec finds the codec of the published track among those negotiated with a subscriber,
+// preferring the same format parameters
+func matchCodec(codec webrtc.RTPCodecCapability, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	var match *webrtc.RTPCodecParameters
+	for i := range negotiated {
+		if !strings.EqualFold(negotiated[i].MimeType, codec.MimeType) {
+			continue
+		}
+		if negotiated[i].SDPFmtpLine == codec.SDPFmtpLine {
+			return negotiated[i], true
+		}
+		if match == nil {
+			match = &negotiated[i]
+		}
+	}
+	if match == nil {
+		return webrtc.RTPCodecParameters{}, false
+	}
+	return *match, true
+}
@@ -0,0 +1,197 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// testLayers returns the three simulcast layers browsers send, smallest first
+func testLayers() []*layer {
+	return []*layer{{rid: "q", rank: layerLow}, {rid: "h", rank: layerMedium}, {rid: "f", rank: layerHigh}}
+}
+
+func TestPick(t *testing.T) {
+	defer func(policy LayerPolicy) { SimulcastPolicy = policy }(SimulcastPolicy)
+
+	tests := []struct {
+		name   string
+		policy LayerPolicy
+		layers []*layer
+		tiles  int
+		want   string // RID of the picked layer, "none" if there is none
+	}{
+		{"no layers", LayerPolicyTiles, nil, 1, "none"},
+		{"tiles alone", LayerPolicyTiles, testLayers(), 1, "f"},
+		{"tiles unknown", LayerPolicyTiles, testLayers(), 0, "f"},
+		{"tiles few", LayerPolicyTiles, testLayers(), 4, "h"},
+		{"tiles many", LayerPolicyTiles, testLayers(), 9, "q"},
+		{"high", LayerPolicyHigh, testLayers(), 9, "f"},
+		{"low", LayerPolicyLow, testLayers(), 1, "q"},
+		{"without simulcast", LayerPolicyLow, []*layer{{rid: "", rank: layerHigh}}, 9, ""},
+		{"missing medium", LayerPolicyTiles, []*layer{{rid: "q", rank: layerLow}, {rid: "f", rank: layerHigh}}, 4, "q"},
+		{"only larger layers", LayerPolicyLow, []*layer{{rid: "h", rank: layerMedium}, {rid: "f", rank: layerHigh}}, 1, "h"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SimulcastPolicy = test.policy
+			got := "none"
+			if l := (&Track{layers: test.layers}).pick(test.tiles); l != nil {
+				got = l.rid
+			}
+			if got != test.want {
+				t.Errorf("pick(%d) = %q, want %q", test.tiles, got, test.want)
+			}
+		})
+	}
+}
+
+// fakeWriter records the packets written to a subscriber
+type fakeWriter struct {
+	headers []rtp.Header
+}
+
+func (w *fakeWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.headers = append(w.headers, *header)
+	return len(payload), nil
+}
+
+func (w *fakeWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestDownTrackWrite(t *testing.T) {
+	tests := []struct {
+		rid     string // Layer of the packet
+		want    string // Layer the subscriber wants
+		seq     uint16
+		ts      uint32
+		key     bool
+		out     int  // Sequence number sent, -1 if the packet is not sent
+		starts  bool // Whether the packet starts a new layer
+		waiting bool
+	}{
+		{"h", "h", 100, 1000, false, -1, false, true},           // Waits for a keyframe to start
+		{"h", "h", 101, 1000, true, 101, true, false},           // Starts without rewriting
+		{"h", "h", 102, 4000, false, 102, false, false},         // Forwarded as is
+		{"f", "f", 65534, 4294967000, false, -1, false, true},   // Wanted layer has no keyframe yet
+		{"h", "f", 103, 7000, false, 103, false, true},          // Current layer goes on meanwhile
+		{"f", "f", 65535, 4294967000, true, 104, true, false},   // Switches on the keyframe
+		{"f", "f", 0, 2704, false, 105, false, false},           // Sequence number and timestamp wrap
+		{"h", "f", 104, 10000, false, -1, false, false},         // Previous layer is dropped
+		{"f", "f", 65535, 4294967000, false, 104, false, false}, // Late packet keeps its place
+		{"f", "f", 1, 5704, false, 106, false, false},           // And does not move the end
+		{"q", "q", 60000, 500, true, 107, true, false},          // Switches down on a keyframe right away
+		{"q", "q", 60001, 3500, false, 108, false, false},       // Continues on the new layer
+		{"f", "q", 2, 8704, true, -1, false, false},             // Keyframes of other layers are ignored
+		{"q", "q", 60002, 6500, false, 109, false, false},       // Still on the smallest layer
+	}
+
+	track := &Track{kind: webrtc.RTPCodecTypeVideo, codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, switchable: true}
+	writer := &fakeWriter{}
+	d := &downTrack{track: track, writer: writer, ssrc: 1234, payloadType: 96}
+	var offset uint32       // Timestamp offset of the current layer
+	var lastTS uint32       // Timestamp of the highest sequence number sent
+	var lastSeq uint16 = 99 // Highest sequence number sent
+	for i, test := range tests {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: test.seq, Timestamp: test.ts, SSRC: 5678, PayloadType: 100, Extension: true},
+			Payload: []byte{0x10, 0x00},
+		}
+		sent := len(writer.headers)
+		if waiting := d.write(test.rid, test.want, packet, test.key); waiting != test.waiting {
+			t.Errorf("step %d: waiting = %v, want %v", i, waiting, test.waiting)
+		}
+		if test.out < 0 {
+			if len(writer.headers) != sent {
+				t.Errorf("step %d: packet %s/%d was sent", i, test.rid, test.seq)
+			}
+			continue
+		}
+		if len(writer.headers) != sent+1 {
+			t.Fatalf("step %d: packet %s/%d was not sent", i, test.rid, test.seq)
+		}
+
+		h := writer.headers[sent]
+		if int(h.SequenceNumber) != test.out {
+			t.Errorf("step %d: sequence number %d, want %d", i, h.SequenceNumber, test.out)
+		}
+		if h.SSRC != 1234 || h.PayloadType != 96 || h.Extension {
+			t.Errorf("step %d: header not rewritten for the subscriber: %+v", i, h)
+		}
+		if test.starts && i > 1 {
+			// The new layer continues shortly after the last timestamp sent
+			if gap := h.Timestamp - lastTS; gap < 1 || gap > 90000 {
+				t.Errorf("step %d: timestamp %d after %d", i, h.Timestamp, lastTS)
+			}
+			offset = h.Timestamp - test.ts
+		} else if h.Timestamp-test.ts != offset {
+			t.Errorf("step %d: timestamp %d, want %d", i, h.Timestamp, test.ts+offset)
+		}
+		if int16(h.SequenceNumber-lastSeq) > 0 {
+			lastSeq, lastTS = h.SequenceNumber, h.Timestamp
+		}
+	}
+}
+
+func TestDownTrackWithoutKeyFrames(t *testing.T) {
+	// Tracks whose keyframes are not recognized start right away and stay on their first layer
+	track := &Track{kind: webrtc.RTPCodecTypeVideo, codec: webrtc.RTPCodecCapability{MimeType: "video/AV1", ClockRate: 90000}}
+	writer := &fakeWriter{}
+	d := &downTrack{track: track, writer: writer}
+	for _, step := range []struct {
+		rid, want string
+		seq       uint16
+	}{{"h", "h", 7}, {"f", "f", 900}, {"h", "f", 8}} {
+		if d.write(step.rid, step.want, &rtp.Packet{Header: rtp.Header{SequenceNumber: step.seq}, Payload: []byte{1}}, false) {
+			t.Errorf("%s/%d is waiting for a keyframe", step.rid, step.seq)
+		}
+	}
+	if len(writer.headers) != 2 || writer.headers[0].SequenceNumber != 7 || writer.headers[1].SequenceNumber != 8 {
+		t.Errorf("sent %+v, want the packets of layer h", writer.headers)
+	}
+
+	// Nothing is sent before the subscriber's connection is bound
+	unbound := &downTrack{track: track}
+	if unbound.write("h", "h", &rtp.Packet{Payload: []byte{1}}, true) {
+		t.Error("unbound subscriber is waiting for a keyframe")
+	}
+}
+
+func TestMatchCodec(t *testing.T) {
+	const (
+		mode1 = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+		mode0 = "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"
+	)
+	negotiated := []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: mode1}, PayloadType: 102},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: mode0}, PayloadType: 104},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}, PayloadType: 111},
+	}
+
+	tests := []struct {
+		name  string
+		codec webrtc.RTPCodecCapability
+		want  webrtc.PayloadType // 0 if there is no match
+	}{
+		{"vp8", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, 96},
+		{"mime type case", webrtc.RTPCodecCapability{MimeType: "video/vp8"}, 96},
+		{"same parameters", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, SDPFmtpLine: mode0}, 104},
+		{"other parameters", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, SDPFmtpLine: "profile-level-id=640032"}, 102},
+		{"opus", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, 111},
+		{"not negotiated", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := matchCodec(test.codec, negotiated)
+			if ok != (test.want != 0) || got.PayloadType != test.want {
+				t.Errorf("matchCodec(%s) = %d, %v, want %d", test.codec.MimeType, got.PayloadType, ok, test.want)
+			}
+		})
+	}
+	if _, ok := matchCodec(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, nil); ok {
+		t.Error("matched a codec with nothing negotiated")
+	}
+}
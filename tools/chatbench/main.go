@@ -0,0 +1,199 @@
+// Command chatbench measures how fast a chat hub delivers messages to a large room.
+// It connects thousands of viewers over loopback websockets, posts a burst of messages
+// and reports how long it takes until every viewer has received all of them.
+//
+// The viewers run in a child process, so the server and the clients each get their own
+// file descriptor limit. With -compare the burst is first delivered by a single shard without
+// batching, and then with the configured fanout. The delivery of the hub before it had shards
+// is measured by BenchmarkFanout in pkg/chat, which needs no connections.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
+	"github.com/fasthttp/websocket"
+)
+
+// textKind marks the frames of the posted messages
+var textKind = []byte(`"kind":"text"`)
+
+func main() {
+	// Command-line flags
+	clients := flag.Int("clients", 10000, "viewers connected to the room")
+	messages := flag.Int("messages", 100, "messages posted in the burst")
+	shards := flag.Int("shards", runtime.NumCPU(), "goroutines delivering the messages")
+	batch := flag.Int("batch", 64, "most messages handed to the delivery goroutines at once")
+	queue := flag.Int("queue", 256, "frames buffered per client")
+	policy := flag.String("backpressure", "disconnect", "what happens to viewers that cannot keep up: disconnect, drop-newest or drop-oldest")
+	compare := flag.Bool("compare", true, "measure a single shard without batching first")
+	timeout := flag.Duration("timeout", 2*time.Minute, "how long to wait for the burst to arrive")
+	dial := flag.String("dial", "", "websocket URL to connect the viewers to, used by the child process")
+	flag.Parse()
+
+	if *dial != "" {
+		viewers(*dial, *clients, *messages, *timeout)
+		return
+	}
+
+	fanout := chat.Fanout{Shards: *shards, BatchSize: *batch, QueueSize: *queue, Policy: chat.Backpressure(*policy)}
+	if *compare {
+		run("single shard, no batching", chat.Fanout{Shards: 1, BatchSize: 1, QueueSize: *queue, Policy: fanout.Policy}, *clients, *messages, *timeout)
+	}
+	run("sharded and batched", fanout, *clients, *messages, *timeout)
+}
+
+// run serves a room with the given fanout, connects the viewers and measures the burst
+func run(name string, fanout chat.Fanout, clients, messages int, timeout time.Duration) {
+	config := chat.DefaultConfig()
+	config.RateLimit = nil
+	config.Fanout = fanout
+	hub := chat.NewHub("bench", config)
+	go hub.Run()
+	defer hub.Close("benchmark over")
+
+	// Serve the room on a loopback port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+	upgrader := websocket.Upgrader{}
+	var viewer int64
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		id := atomic.AddInt64(&viewer, 1)
+		info := chat.ClientInfo{
+			ID:      fmt.Sprintf("%032x", id),
+			Name:    "viewer" + strconv.FormatInt(id, 10),
+			Role:    chat.RoleViewer,
+			Version: chat.ProtocolVersion,
+		}
+		chat.PeerChatConn(conn, hub, info)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// Connect the viewers from a child process
+	url := "ws://" + listener.Addr().String() + "/"
+	child := exec.Command(os.Args[0], "-dial", url, "-clients", strconv.Itoa(clients),
+		"-messages", strconv.Itoa(messages), "-timeout", timeout.String())
+	child.Stderr = os.Stderr
+	out, err := child.StdoutPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := child.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer child.Wait()
+	lines := bufio.NewScanner(out)
+	if !lines.Scan() || lines.Text() != "ready" {
+		log.Fatalf("%s: viewers failed to connect", name)
+	}
+	for hub.ClientCount() < clients {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(time.Second)
+
+	// Post the burst and wait for the viewers to receive all of it
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	stats := hub.FanoutStats()
+	start := time.Now()
+	for i := 0; i < messages; i++ {
+		if _, err := hub.PostWebhook(chat.IncomingWebhook{Name: "Bench", Body: "message " + strconv.Itoa(i)}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !lines.Scan() {
+		log.Fatalf("%s: viewers stopped early", name)
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	result := hub.FanoutStats()
+
+	frames := result.Delivered - stats.Delivered
+	fmt.Printf("%s (%d shards, batches of %d)\n", name, fanout.Shards, fanout.BatchSize)
+	fmt.Printf("  %s, %d viewers\n", lines.Text(), clients)
+	fmt.Printf("  %v for %d messages, %.0f frames/s\n", elapsed.Round(time.Millisecond), messages, float64(frames)/elapsed.Seconds())
+	fmt.Printf("  %d batches, %d frames queued, %d dropped, %d viewers evicted\n",
+		result.Batches-stats.Batches, frames, result.Dropped-stats.Dropped, result.Evicted-stats.Evicted)
+	if frames > 0 {
+		fmt.Printf("  %.0f bytes allocated per frame\n", float64(after.TotalAlloc-before.TotalAlloc)/float64(frames))
+	}
+}
+
+// viewers connects the viewers, prints "ready" once they are connected and a summary
+// once every viewer has received the burst or the timeout expires
+func viewers(url string, clients, messages int, timeout time.Duration) {
+	var received, complete int64
+	done := make(chan struct{})
+	var once sync.Once
+
+	// Dial a few viewers at a time, so the listen backlog does not overflow
+	var wg sync.WaitGroup
+	dialing := make(chan struct{}, 64)
+	conns := make([]*websocket.Conn, clients)
+	for i := range conns {
+		dialing <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-dialing }()
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				log.Fatalf("viewer %d: %v", i, err)
+			}
+			conns[i] = conn
+		}(i)
+	}
+	wg.Wait()
+	fmt.Println("ready")
+
+	for _, conn := range conns {
+		go func(conn *websocket.Conn) {
+			count := 0
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if !bytes.Contains(data, textKind) {
+					continue
+				}
+				atomic.AddInt64(&received, 1)
+				if count++; count == messages && atomic.AddInt64(&complete, 1) == int64(len(conns)) {
+					once.Do(func() { close(done) })
+				}
+			}
+		}(conn)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	fmt.Printf("%d of %d viewers got every message, %d frames received\n",
+		atomic.LoadInt64(&complete), clients, atomic.LoadInt64(&received))
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
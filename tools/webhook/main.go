@@ -0,0 +1,98 @@
+// Command webhook is a local stand-in for the services chat webhooks talk to.
+// It prints the events the server delivers, checking their signature, and can post
+// a message into a room through its incoming webhook.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/amitamrutiya/videocall-project/pkg/chat"
+)
+
+func main() {
+	// Command-line flags
+	listen := flag.String("listen", ":9000", "address receiving outgoing chat webhooks")
+	secret := flag.String("secret", "", "secret of the server (-chat-webhook-secret), or of the room when posting")
+	fail := flag.Int("fail", 0, "number of deliveries answered with 503 first, to watch the server retry")
+	post := flag.String("post", "", "incoming webhook URL of a room, posts -body there instead of listening")
+	name := flag.String("name", "Webhook", "display name of the posted message")
+	body := flag.String("body", "", "text of the posted message")
+	flag.Parse()
+
+	if *post != "" {
+		if err := postMessage(*post, *secret, chat.IncomingWebhook{Name: *name, Body: *body}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	failures := *fail
+	var replays chat.WebhookReplays
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signature := r.Header.Get(chat.WebhookSignatureHeader)
+		if err := chat.VerifyWebhook(*secret, r.Header.Get(chat.WebhookTimestampHeader), signature, data); err != nil {
+			log.Printf("rejected delivery: %v", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := replays.Check(signature); err != nil {
+			log.Printf("rejected delivery: %v", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if failures > 0 {
+			failures--
+			log.Printf("failing delivery on purpose, %d more to fail", failures)
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+
+		var event chat.WebhookEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("room %s: %s %s: %s", event.Room, event.Event, event.Message.DisplayName, event.Message.Body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("waiting for chat webhooks on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+// postMessage signs a message with the room's secret and posts it to the room's incoming webhook
+func postMessage(url, secret string, in chat.IncomingWebhook) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(chat.WebhookTimestampHeader, timestamp)
+	req.Header.Set(chat.WebhookSignatureHeader, chat.SignWebhook(secret, timestamp, data))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(resp.Body)
+	log.Printf("%s %s", resp.Status, reply)
+	return nil
+}